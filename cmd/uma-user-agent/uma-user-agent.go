@@ -1,18 +1,49 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/EOEPCA/uma-user-agent/pkg/config"
 	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/EOEPCA/uma-user-agent/pkg/server"
+	"github.com/EOEPCA/uma-user-agent/pkg/tracing"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+
+	// Config from flags - which take precedence over env and files
+	if err := config.ParseFlags(filepath.Base(os.Args[0]), os.Args[1:]); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Refuse to start with an invalid configuration
+	warnings, err := config.Validate()
+	for _, warning := range warnings {
+		logrus.Warn("Configuration: ", warning)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+
 	logrus.Info(filepath.Base(os.Args[0]), " STARTING")
 
 	router := mux.NewRouter()
@@ -22,14 +53,108 @@ func main() {
 	// because the 'target' URL is passed in the http headers
 	// router.Use(handler.RequestLogger)
 
+	// Correlation ID for each request
+	router.Use(handler.RequestIdMiddleware)
+
+	// One configuration snapshot for each request
+	router.Use(handler.ConfigSnapshotMiddleware)
+
 	// Register request handler for status
 	handler.NewStatusRouter(router.PathPrefix("/status").Subrouter())
 
+	// Register request handlers for OIDC login
+	handler.NewLoginRouter(router)
+
 	// Register request handler for auth_request
 	router.PathPrefix("").HandlerFunc(handler.NginxAuthRequestHandler)
 
 	// Start listening
-	port := config.GetPort()
-	logrus.Info("Begin listening on port ", port)
-	logrus.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), router))
+	srv := server.NewServer(router)
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- srv.Serve()
+	}()
+
+	// Start the admin listener, if configured
+	var adminSrv *server.Server
+	if config.GetAdminListenPort() > 0 {
+		adminRouter := mux.NewRouter()
+		handler.NewAdminRouter(adminRouter)
+		adminSrv = server.NewAdminServer(adminRouter)
+		go func() {
+			serveErr <- adminSrv.Serve()
+		}()
+	}
+
+	// Handle signals until shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	if err := handleSignals(signals, serveErr, srv, adminSrv); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// handleSignals reloads the configuration on SIGHUP, until a signal to stop - upon which the
+// graceful shutdown is performed. The error of a failed listener is returned.
+func handleSignals(signals <-chan os.Signal, serveErr <-chan error, srv *server.Server, adminSrv *server.Server) error {
+	for {
+		select {
+		case err := <-serveErr:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := config.Reload(); err != nil {
+					logrus.Error(err)
+				}
+				continue
+			}
+			shutdown(srv, adminSrv, sig)
+			return nil
+		}
+	}
+}
+
+// shutdown performs the graceful shutdown...
+// * readiness reports not-ready, for the shutdown delay
+// * the server stops accepting connections, and in-flight requests complete
+// * pending audit records and traces are flushed
+func shutdown(srv *server.Server, adminSrv *server.Server, sig os.Signal) {
+	logrus.Infof("Received %v - shutting down", sig)
+	handler.BeginShutdown()
+	time.Sleep(config.GetShutdownDelay())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GetShutdownTimeout())
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logrus.Warn("In-flight requests did not complete before the shutdown timeout: ", err)
+	}
+	if adminSrv != nil {
+		adminSrv.Shutdown(ctx)
+	}
+	handler.Close()
+	tracing.Shutdown(ctx)
+	logrus.Info(filepath.Base(os.Args[0]), " STOPPED")
+}
+
+// validate is the `validate` subcommand, which checks the config files in the config
+// directory - returning the exit code
+func validate(args []string) int {
+	flags := pflag.NewFlagSet("validate", pflag.ContinueOnError)
+	configDir := flags.String("config-dir", config.GetConfigDir(), "directory of the client.yaml and config.yaml files")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	warnings, err := config.ValidateDir(*configDir)
+	for _, warning := range warnings {
+		fmt.Println("WARNING:", warning)
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	fmt.Printf("Configuration in %v is valid\n", *configDir)
+	return 0
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/EOEPCA/uma-user-agent/pkg/server"
+	"github.com/gorilla/mux"
+)
+
+// TestServerLifecycle tests that SIGHUP reloads the configuration, and that SIGTERM begins the
+// graceful shutdown - the readiness flips to not-ready for the shutdown delay, before the
+// listener is closed, and the in-flight requests are completed
+func TestServerLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uma.sock")
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--network.listenPort=0", "--network.tls.enabled=false", "--network.unixSocket.path=" + path,
+		"--network.shutdownDelay=1", "--network.shutdownTimeout=10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloads := make(chan struct{}, 1)
+	config.AddConfigChangeHandler(func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+	})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	router := mux.NewRouter()
+	handler.NewStatusRouter(router.PathPrefix("/status").Subrouter())
+	router.Path("/slow").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	srv := server.NewServer(router)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve() }()
+	signals := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	go func() { stopped <- handleSignals(signals, serveErr, srv, nil) }()
+
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true, DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	get := func(uri string) (int, error) {
+		response, err := client.Get("http://agent" + uri)
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return response.StatusCode, nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for code, _ := get("/status/ready"); code != http.StatusOK; code, _ = get("/status/ready") {
+		if time.Now().After(deadline) {
+			t.Fatal("server not ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// SIGHUP reloads the configuration
+	select {
+	case <-reloads:
+	default:
+	}
+	signals <- syscall.SIGHUP
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration not reloaded on SIGHUP")
+	}
+
+	// An in-flight request
+	slow := make(chan int, 1)
+	go func() {
+		code, err := get("/slow")
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+		}
+		slow <- code
+	}()
+	<-started
+
+	// SIGTERM flips the readiness while the listener still accepts connections...
+	signals <- syscall.SIGTERM
+	deadline = time.Now().Add(5 * time.Second)
+	for code, err := get("/status/ready"); code != http.StatusTooEarly; code, err = get("/status/ready") {
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("readiness not flipped before the listener closed: %v %v", code, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ...until the shutdown delay has elapsed, after which the listener is closed
+	deadline = time.Now().Add(5 * time.Second)
+	for _, err := get("/status/ready"); err == nil; _, err = get("/status/ready") {
+		if time.Now().After(deadline) {
+			t.Fatal("listener not closed after the shutdown delay")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown completed with a request in-flight: %v", err)
+	default:
+	}
+
+	// The in-flight request completes, and then the shutdown
+	close(release)
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("unexpected status %v of the in-flight request", code)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("unexpected error at shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown not completed")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("unix socket not removed at shutdown: %v", err)
+	}
+}
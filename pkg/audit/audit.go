@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+//------------------------------------------------------------------------------
+
+// Record is the audit record of a final authorization decision
+type Record struct {
+	Timestamp           time.Time `json:"timestamp"`
+	RequestId           string    `json:"requestId,omitempty"`
+	Subject             string    `json:"sub,omitempty"`
+	SubjectVerified     bool      `json:"subVerified"`
+	ClientIp            string    `json:"clientIp,omitempty"`
+	Method              string    `json:"method"`
+	Uri                 string    `json:"uri"`
+	Decision            string    `json:"decision"`
+	Reason              string    `json:"reason,omitempty"`
+	StatusCode          int       `json:"statusCode"`
+	Pep                 string    `json:"pep,omitempty"`
+	AuthorizationServer string    `json:"authorizationServer,omitempty"`
+	FromCache           bool      `json:"fromCache"`
+	// Hash chaining (file sink only)
+	PrevHash string `json:"prevHash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Sink is a destination for audit records
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+//------------------------------------------------------------------------------
+
+// Auditor delivers audit records to its sinks. Records are queued and written in the
+// background, so that slow sinks do not delay the authorization decision. When the
+// queue is full, or the auditor is closed, the record is dropped and counted - rather
+// than the caller waiting.
+type Auditor struct {
+	sinks   []Sink
+	queue   chan Record
+	done    chan struct{}
+	logger  *logrus.Entry
+	once    sync.Once
+	rwMutex sync.RWMutex // guards the queue against sends after it is closed
+	closed  bool
+	dropped atomic.Uint64
+}
+
+const queueSize = 1000
+
+//------------------------------------------------------------------------------
+
+func NewAuditor(sinks []Sink, logger *logrus.Entry) *Auditor {
+	auditor := &Auditor{
+		sinks:  sinks,
+		queue:  make(chan Record, queueSize),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	go auditor.run()
+	return auditor
+}
+
+// Record queues the record for delivery to all sinks
+func (auditor *Auditor) Record(record Record) {
+	if len(auditor.sinks) == 0 {
+		return
+	}
+	auditor.rwMutex.RLock()
+	queued := false
+	if !auditor.closed {
+		select {
+		case auditor.queue <- record:
+			queued = true
+		default:
+		}
+	}
+	auditor.rwMutex.RUnlock()
+	if !queued {
+		auditor.drop()
+	}
+}
+
+// Dropped returns the number of records that were dropped
+func (auditor *Auditor) Dropped() uint64 {
+	return auditor.dropped.Load()
+}
+
+// drop counts a record that could not be queued - warning on the first, and then
+// on every thousandth, so that a slow sink does not flood the log
+func (auditor *Auditor) drop() {
+	metrics.AuditDropped.Inc()
+	if n := auditor.dropped.Add(1); n == 1 || n%1000 == 0 {
+		auditor.logger.Warnf("audit record dropped - the queue is full or closed (%d dropped)", n)
+	}
+}
+
+// Close delivers the queued records and closes the sinks
+func (auditor *Auditor) Close() {
+	auditor.once.Do(func() {
+		auditor.rwMutex.Lock()
+		auditor.closed = true
+		close(auditor.queue)
+		auditor.rwMutex.Unlock()
+		<-auditor.done
+		for _, sink := range auditor.sinks {
+			if err := sink.Close(); err != nil {
+				auditor.logger.Warn(fmt.Errorf("error closing audit sink: %w", err))
+			}
+		}
+	})
+}
+
+func (auditor *Auditor) run() {
+	defer close(auditor.done)
+	for record := range auditor.queue {
+		for _, sink := range auditor.sinks {
+			if err := sink.Write(record); err != nil {
+				auditor.logger.Error(fmt.Errorf("error writing audit record: %w", err))
+			}
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// marshalRecord returns the json of the record
+func marshalRecord(record Record) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal audit record: %w", err)
+	}
+	return data, nil
+}
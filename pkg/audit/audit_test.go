@@ -0,0 +1,190 @@
+package audit_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/audit"
+	"github.com/sirupsen/logrus"
+)
+
+func testRecord(uri string) audit.Record {
+	return audit.Record{
+		Timestamp: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Subject:   "eric",
+		ClientIp:  "10.0.0.1",
+		Method:    "GET",
+		Uri:       uri,
+		Decision:  "allow",
+	}
+}
+
+// TestFileSinkHashChain tests that the chain verifies, continues across reopen, and detects tampering
+func TestFileSinkHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.NewFileSink(path, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write(testRecord("/a"))
+	sink.Write(testRecord("/b"))
+	sink.Close()
+
+	// Reopen - the chain continues from the last record
+	sink, err = audit.NewFileSink(path, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write(testRecord("/c"))
+	sink.Close()
+
+	data, _ := os.ReadFile(path)
+	if _, err := audit.VerifyChain(bytes.NewReader(data), ""); err != nil {
+		t.Errorf("chain should verify: %v", err)
+	}
+
+	tampered := strings.Replace(string(data), `"uri":"/b"`, `"uri":"/x"`, 1)
+	if _, err := audit.VerifyChain(strings.NewReader(tampered), ""); err == nil {
+		t.Error("modified record not detected")
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	removed := lines[0] + lines[2]
+	if _, err := audit.VerifyChain(strings.NewReader(removed), ""); err == nil {
+		t.Error("removed record not detected")
+	}
+}
+
+// TestFileSinkRotation tests that the file is rotated by size and the chain spans the files
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.NewFileSink(path, 300, 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := sink.Write(testRecord("/item")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	hash := ""
+	for _, name := range []string{path + ".3", path + ".2", path + ".1", path} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("expected file %v: %v", name, err)
+		}
+		if hash, err = audit.VerifyChain(bytes.NewReader(data), hash); err != nil {
+			t.Errorf("chain should verify across rotated files: %v", err)
+		}
+	}
+}
+
+// TestSyslogSink tests the RFC 5424 message sent over udp
+func TestSyslogSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := audit.NewSyslogSink("udp", conn.LocalAddr().String(), "uma-user-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Write(testRecord("/a")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(buf[:n])
+	if !strings.HasPrefix(message, "<86>1 2023-01-02T03:04:05Z ") {
+		t.Errorf("unexpected syslog header: %v", message)
+	}
+	if !strings.Contains(message, " uma-user-agent ") || !strings.HasSuffix(message, "}") {
+		t.Errorf("unexpected syslog message: %v", message)
+	}
+}
+
+// blockingSink counts the records written, each write waiting until released
+type blockingSink struct {
+	release chan struct{}
+	written atomic.Int64
+}
+
+func (sink *blockingSink) Write(record audit.Record) error {
+	<-sink.release
+	sink.written.Add(1)
+	return nil
+}
+
+func (sink *blockingSink) Close() error {
+	return nil
+}
+
+// TestAuditorQueue tests that records are dropped and counted, rather than the caller
+// waiting, when the queue is full or the auditor is closed - including when the auditor
+// is closed while records are being recorded
+func TestAuditorQueue(t *testing.T) {
+	logger := logrus.NewEntry(logrus.New())
+	sink := &blockingSink{release: make(chan struct{})}
+	auditor := audit.NewAuditor([]audit.Sink{sink}, logger)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1010; i++ {
+			auditor.Record(testRecord("/a"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording blocked on the full queue")
+	}
+	if dropped := auditor.Dropped(); dropped < 9 || dropped > 10 {
+		t.Errorf("expected the records beyond the queue to be dropped, got %d", dropped)
+	}
+	close(sink.release)
+	auditor.Close()
+	if written := sink.written.Load(); written != 1010-int64(auditor.Dropped()) {
+		t.Errorf("expected the queued records to be delivered at close, got %d", written)
+	}
+	dropped := auditor.Dropped()
+	auditor.Record(testRecord("/a"))
+	if auditor.Dropped() != dropped+1 || sink.written.Load() != 1010-int64(dropped) {
+		t.Error("expected a record after close to be dropped")
+	}
+
+	// Close while recording
+	sink = &blockingSink{release: make(chan struct{})}
+	close(sink.release)
+	auditor = audit.NewAuditor([]audit.Sink{sink}, logger)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				auditor.Record(testRecord("/a"))
+			}
+		}()
+	}
+	auditor.Close()
+	wg.Wait()
+	if total := sink.written.Load() + int64(auditor.Dropped()); total != 4000 {
+		t.Errorf("expected each record to be delivered or dropped, got %d", total)
+	}
+}
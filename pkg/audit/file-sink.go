@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+
+// FileSink writes audit records as json lines to a file, which is rotated by size.
+// With hash chaining, each record carries the hash of its predecessor and its own hash
+// (over the predecessor's hash and the record content), so that modification, removal
+// or re-ordering of records is detectable - see VerifyChain.
+type FileSink struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	hashChain  bool
+	file       *os.File
+	size       int64
+	lastHash   string
+}
+
+//------------------------------------------------------------------------------
+
+// NewFileSink opens (appending) the audit file. The file is rotated when it exceeds
+// maxSize bytes (zero means no rotation), retaining maxBackups previous files.
+func NewFileSink(path string, maxSize int64, maxBackups int, hashChain bool) (sink *FileSink, err error) {
+	sink = &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups, hashChain: hashChain}
+	if hashChain {
+		// Continue the chain from the last record written
+		if sink.lastHash, err = lastHashInFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err = sink.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (sink *FileSink) open() (err error) {
+	sink.file, err = os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open audit file %v: %w", sink.path, err)
+	}
+	info, err := sink.file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat audit file %v: %w", sink.path, err)
+	}
+	sink.size = info.Size()
+	return
+}
+
+func (sink *FileSink) Write(record Record) (err error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.hashChain {
+		record.PrevHash = sink.lastHash
+		if record.Hash, err = chainHash(record); err != nil {
+			return
+		}
+	}
+	line, err := marshalRecord(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	if sink.maxSize > 0 && sink.size > 0 && sink.size+int64(len(line)) > sink.maxSize {
+		if err = sink.rotate(); err != nil {
+			return
+		}
+	}
+	n, err := sink.file.Write(line)
+	sink.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write audit file %v: %w", sink.path, err)
+	}
+	sink.lastHash = record.Hash
+	return
+}
+
+// rotate shifts the backups (path.1 -> path.2 etc.) and starts a new file
+func (sink *FileSink) rotate() (err error) {
+	sink.file.Close()
+	if sink.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", sink.path, sink.maxBackups))
+		for i := sink.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", sink.path, i), fmt.Sprintf("%s.%d", sink.path, i+1))
+		}
+		err = os.Rename(sink.path, sink.path+".1")
+	} else {
+		err = os.Remove(sink.path)
+	}
+	if err != nil {
+		return fmt.Errorf("could not rotate audit file %v: %w", sink.path, err)
+	}
+	return sink.open()
+}
+
+func (sink *FileSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.file.Close()
+}
+
+//------------------------------------------------------------------------------
+// Hash chaining
+//------------------------------------------------------------------------------
+
+// chainHash computes the hash of the record, which covers the previous hash and all
+// content of the record (excluding its own hash)
+func chainHash(record Record) (string, error) {
+	record.Hash = ""
+	data, err := marshalRecord(record)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// lastHashInFile returns the hash of the last record in the file (if any)
+func lastHashInFile(path string) (lastHash string, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read audit file %v: %w", path, err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			lastHash = record.Hash
+		}
+	}
+	return lastHash, scanner.Err()
+}
+
+// VerifyChain checks the hash chain of the records read from the supplied audit file
+// content. The expected hash of the record preceding the first (blank if the chain starts
+// with this content) is supplied, and the hash of the last record is returned - so that a
+// chain spanning rotated files can be verified in order, oldest first.
+func VerifyChain(reader io.Reader, prevHash string) (lastHash string, err error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lastHash = prevHash
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		var record Record
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return lastHash, fmt.Errorf("line %d: not an audit record: %w", lineNum, err)
+		}
+		if record.PrevHash != lastHash {
+			return lastHash, fmt.Errorf("line %d: chain broken - previous hash does not match", lineNum)
+		}
+		expected, hashErr := chainHash(record)
+		if hashErr != nil {
+			return lastHash, hashErr
+		}
+		if record.Hash != expected {
+			return lastHash, fmt.Errorf("line %d: record hash does not match its content", lineNum)
+		}
+		lastHash = record.Hash
+	}
+	return lastHash, scanner.Err()
+}
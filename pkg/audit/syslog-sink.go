@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// SyslogSink sends audit records as RFC 5424 syslog messages (with the json record as
+// the message) over udp or tcp. Over tcp the messages are framed by octet counting
+// (RFC 6587).
+type SyslogSink struct {
+	mutex    sync.Mutex
+	network  string
+	address  string
+	appName  string
+	hostname string
+	conn     net.Conn
+}
+
+const (
+	syslogFacilityAuthpriv = 10
+	syslogSeverityInfo     = 6
+	syslogSeverityNotice   = 5
+	syslogDialTimeout      = 5 * time.Second
+)
+
+//------------------------------------------------------------------------------
+
+func NewSyslogSink(network string, address string, appName string) (*SyslogSink, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog network '%v' - expected udp or tcp", network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+	if len(appName) == 0 {
+		appName = "-"
+	}
+	return &SyslogSink{network: network, address: address, appName: appName, hostname: hostname}, nil
+}
+
+func (sink *SyslogSink) Write(record Record) (err error) {
+	message, err := sink.format(record)
+	if err != nil {
+		return
+	}
+	if sink.network == "tcp" {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	// One reconnect attempt, in case the existing connection has gone stale
+	for attempt := 0; attempt < 2; attempt++ {
+		if sink.conn == nil {
+			if sink.conn, err = net.DialTimeout(sink.network, sink.address, syslogDialTimeout); err != nil {
+				sink.conn = nil
+				return fmt.Errorf("could not connect to syslog %v: %w", sink.address, err)
+			}
+		}
+		sink.conn.SetWriteDeadline(time.Now().Add(syslogDialTimeout))
+		if _, err = sink.conn.Write(message); err == nil {
+			return
+		}
+		sink.conn.Close()
+		sink.conn = nil
+	}
+	return fmt.Errorf("could not write to syslog %v: %w", sink.address, err)
+}
+
+// format renders the RFC 5424 message
+func (sink *SyslogSink) format(record Record) ([]byte, error) {
+	data, err := marshalRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	severity := syslogSeverityInfo
+	if record.Decision != "allow" {
+		severity = syslogSeverityNotice
+	}
+	msgId := "-"
+	if len(record.Decision) > 0 {
+		msgId = record.Decision
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ",
+		syslogFacilityAuthpriv*8+severity,
+		record.Timestamp.UTC().Format(time.RFC3339Nano),
+		sink.hostname, sink.appName, os.Getpid(), msgId)
+	return append([]byte(header), data...), nil
+}
+
+func (sink *SyslogSink) Close() (err error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.conn != nil {
+		err = sink.conn.Close()
+		sink.conn = nil
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// WebhookSink POSTs each audit record as json to a URL
+type WebhookSink struct {
+	url           string
+	authorization string
+	client        *http.Client
+}
+
+//------------------------------------------------------------------------------
+
+// NewWebhookSink creates a webhook sink. If authorization is not blank then it is sent as
+// the Authorization header value.
+func NewWebhookSink(url string, authorization string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{url: url, authorization: authorization, client: &http.Client{Timeout: timeout}}
+}
+
+func (sink *WebhookSink) Write(record Record) (err error) {
+	data, err := marshalRecord(record)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("could not create audit webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(sink.authorization) > 0 {
+		req.Header.Set("Authorization", sink.authorization)
+	}
+	response, err := sink.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("audit webhook request to %v failed: %w", sink.url, err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("audit webhook %v responded with status %v", sink.url, response.StatusCode)
+	}
+	return
+}
+
+func (sink *WebhookSink) Close() error {
+	sink.client.CloseIdleConnections()
+	return nil
+}
@@ -1,6 +1,16 @@
 package authcache
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Decisions is the shared cache of authorization decisions
+var Decisions = NewAuthCache()
+
+//------------------------------------------------------------------------------
 
 // AuthCacheEntry provides a cache of authorization decisions keyed upon the unique
 // aspects of the resource access request
@@ -9,13 +19,119 @@ type AuthCacheEntry struct {
 	IDTokenHash   string
 	ResourcePath  string
 	RequestMethod string
+	Rpt           string
 	Expiry        time.Time
 }
 
-// AuthCache is a collection of cached authorization decisions
-type AuthCache map[string]AuthCacheEntry
-
 // Hash generates a hash from the AuthCacheEntry structure elements
 func (ac *AuthCacheEntry) Hash() string {
-	return "zzz"
+	hash := sha256.Sum256([]byte(ac.IDTokenHash + "\n" + ac.RequestMethod + "\n" + ac.ResourcePath))
+	return hex.EncodeToString(hash[:])
+}
+
+// IsExpired reports whether the entry has passed its expiry time
+func (ac *AuthCacheEntry) IsExpired() bool {
+	return time.Now().After(ac.Expiry)
+}
+
+// HashToken provides the hash of the supplied token, as used for the IDTokenHash
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+//------------------------------------------------------------------------------
+
+// AuthCache is a thread-safe collection of cached authorization decisions
+type AuthCache struct {
+	rwMutex   sync.RWMutex
+	entries   map[string]AuthCacheEntry
+	lastPurge time.Time
+}
+
+// Interval at which expired entries are purged from the cache
+const purgeInterval = time.Minute
+
+//------------------------------------------------------------------------------
+
+func NewAuthCache() *AuthCache {
+	return &AuthCache{entries: make(map[string]AuthCacheEntry)}
 }
+
+// Load returns the unexpired entry that matches the key elements of the supplied entry.
+// The ok result indicates whether an entry was found.
+func (cache *AuthCache) Load(key AuthCacheEntry) (value AuthCacheEntry, ok bool) {
+	hash := key.Hash()
+	cache.rwMutex.RLock()
+	value, ok = cache.entries[hash]
+	cache.rwMutex.RUnlock()
+	if ok && value.IsExpired() {
+		cache.rwMutex.Lock()
+		delete(cache.entries, hash)
+		cache.rwMutex.Unlock()
+		value, ok = AuthCacheEntry{}, false
+	}
+	return
+}
+
+// Store sets the entry, keyed upon its key elements
+func (cache *AuthCache) Store(value AuthCacheEntry) {
+	cache.rwMutex.Lock()
+	defer cache.rwMutex.Unlock()
+	cache.entries[value.Hash()] = value
+
+	// Opportunistically remove expired entries that have not been looked-up
+	if time.Since(cache.lastPurge) > purgeInterval {
+		cache.lastPurge = time.Now()
+		for hash, entry := range cache.entries {
+			if entry.IsExpired() {
+				delete(cache.entries, hash)
+			}
+		}
+	}
+}
+
+// DeleteUser deletes all entries for the user, identified by either the UserID
+// or IDTokenHash. The number of entries deleted is returned.
+func (cache *AuthCache) DeleteUser(userId string, idTokenHash string) (count int) {
+	cache.rwMutex.Lock()
+	defer cache.rwMutex.Unlock()
+	for hash, entry := range cache.entries {
+		if (len(userId) > 0 && entry.UserID == userId) || (len(idTokenHash) > 0 && entry.IDTokenHash == idTokenHash) {
+			delete(cache.entries, hash)
+			count++
+		}
+	}
+	return
+}
+
+// Entries returns the unexpired entries in the cache
+func (cache *AuthCache) Entries() (entries []AuthCacheEntry) {
+	cache.rwMutex.RLock()
+	defer cache.rwMutex.RUnlock()
+	entries = make([]AuthCacheEntry, 0, len(cache.entries))
+	for _, entry := range cache.entries {
+		if !entry.IsExpired() {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+// Clear deletes all entries. The number of entries deleted is returned.
+func (cache *AuthCache) Clear() (count int) {
+	cache.rwMutex.Lock()
+	defer cache.rwMutex.Unlock()
+	count = len(cache.entries)
+	cache.entries = make(map[string]AuthCacheEntry)
+	return
+}
+
+// Len returns the number of entries in the cache
+func (cache *AuthCache) Len() int {
+	cache.rwMutex.RLock()
+	defer cache.rwMutex.RUnlock()
+	return len(cache.entries)
+}
+
+//------------------------------------------------------------------------------
@@ -0,0 +1,264 @@
+package breaker
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned when a call is rejected because the circuit is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+//------------------------------------------------------------------------------
+
+// State of a circuit breaker
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (state State) String() string {
+	switch state {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// Outcome of a call allowed by a circuit breaker
+type Outcome int
+
+const (
+	// The call succeeded
+	OutcomeSuccess Outcome = iota
+	// The call failed due to the upstream
+	OutcomeFailure
+	// The call was not completed for reasons unrelated to the upstream (e.g. the caller's
+	// deadline expired) - which counts neither as success nor as failure
+	OutcomeNeutral
+)
+
+//------------------------------------------------------------------------------
+
+// Settings configures the behaviour of a circuit breaker
+type Settings struct {
+	// Consecutive failures that open the circuit. Zero disables the breaker.
+	FailureThreshold int
+	// Duration that the circuit stays open before trial calls are allowed (half-open)
+	OpenTimeout time.Duration
+	// Number of trial calls allowed when half-open - all must succeed to close the circuit
+	HalfOpenMaxRequests int
+}
+
+// StateChangeFunc is notified of the state transitions of a circuit breaker
+type StateChangeFunc func(name string, from State, to State)
+
+//------------------------------------------------------------------------------
+
+// Breaker is a circuit breaker that protects calls to a single upstream.
+// Closed: calls are allowed, and consecutive failures are counted.
+// Open: calls fail fast with ErrOpen, until the open timeout has elapsed.
+// Half-open: a limited number of trial calls are allowed, whose outcome closes or re-opens the circuit.
+type Breaker struct {
+	mutex         sync.Mutex
+	name          string
+	settings      Settings
+	onStateChange StateChangeFunc
+	state         State
+	generation    uint64
+	failures      int
+	openedAt      time.Time
+	trials        int
+	successes     int
+}
+
+//------------------------------------------------------------------------------
+
+func NewBreaker(name string, settings Settings, onStateChange StateChangeFunc) *Breaker {
+	return &Breaker{name: name, settings: settings, onStateChange: onStateChange}
+}
+
+func (breaker *Breaker) GetName() string {
+	return breaker.name
+}
+
+// State returns the current state
+func (breaker *Breaker) State() State {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.checkOpenTimeout(time.Now())
+	return breaker.state
+}
+
+// Allow checks whether a call may proceed. If so, the returned done function must be
+// called with the outcome of the call. If not, ErrOpen is returned.
+func (breaker *Breaker) Allow() (done func(outcome Outcome), err error) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.settings.FailureThreshold <= 0 {
+		return func(Outcome) {}, nil
+	}
+	breaker.checkOpenTimeout(time.Now())
+	switch breaker.state {
+	case StateOpen:
+		return nil, ErrOpen
+	case StateHalfOpen:
+		if breaker.trials >= breaker.halfOpenMaxRequests() {
+			return nil, ErrOpen
+		}
+		breaker.trials++
+	}
+	generation := breaker.generation
+	return func(outcome Outcome) { breaker.done(generation, outcome) }, nil
+}
+
+// Configure updates the settings. A disabled breaker is closed.
+func (breaker *Breaker) Configure(settings Settings) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.settings = settings
+	if settings.FailureThreshold <= 0 && breaker.state != StateClosed {
+		breaker.setState(StateClosed, time.Now())
+	}
+}
+
+// done records the outcome of a call - which is ignored if the state has changed since
+// the call was allowed. A neutral outcome frees its trial slot when half-open.
+func (breaker *Breaker) done(generation uint64, outcome Outcome) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if generation != breaker.generation {
+		return
+	}
+	now := time.Now()
+	switch breaker.state {
+	case StateClosed:
+		switch outcome {
+		case OutcomeFailure:
+			breaker.failures++
+			if breaker.failures >= breaker.settings.FailureThreshold {
+				breaker.setState(StateOpen, now)
+			}
+		case OutcomeSuccess:
+			breaker.failures = 0
+		}
+	case StateHalfOpen:
+		switch outcome {
+		case OutcomeFailure:
+			breaker.setState(StateOpen, now)
+		case OutcomeNeutral:
+			breaker.trials--
+		case OutcomeSuccess:
+			breaker.successes++
+			if breaker.successes >= breaker.halfOpenMaxRequests() {
+				breaker.setState(StateClosed, now)
+			}
+		}
+	}
+}
+
+func (breaker *Breaker) checkOpenTimeout(now time.Time) {
+	if breaker.state == StateOpen && now.Sub(breaker.openedAt) >= breaker.settings.OpenTimeout {
+		breaker.setState(StateHalfOpen, now)
+	}
+}
+
+func (breaker *Breaker) halfOpenMaxRequests() int {
+	if breaker.settings.HalfOpenMaxRequests < 1 {
+		return 1
+	}
+	return breaker.settings.HalfOpenMaxRequests
+}
+
+// setState transitions to the new state, resetting the counters
+func (breaker *Breaker) setState(state State, now time.Time) {
+	from := breaker.state
+	breaker.state = state
+	breaker.generation++
+	breaker.failures, breaker.trials, breaker.successes = 0, 0, 0
+	if state == StateOpen {
+		breaker.openedAt = now
+	}
+	if breaker.onStateChange != nil && from != state {
+		breaker.onStateChange(breaker.name, from, state)
+	}
+}
+
+//------------------------------------------------------------------------------
+// Registry
+//------------------------------------------------------------------------------
+
+// Registry holds a circuit breaker per upstream, created on first use
+type Registry struct {
+	mutex         sync.RWMutex
+	settings      Settings
+	onStateChange StateChangeFunc
+	breakers      map[string]*Breaker
+}
+
+func NewRegistry(settings Settings, onStateChange StateChangeFunc) *Registry {
+	return &Registry{settings: settings, onStateChange: onStateChange, breakers: make(map[string]*Breaker)}
+}
+
+// Get returns the breaker for the named upstream
+func (registry *Registry) Get(name string) *Breaker {
+	registry.mutex.RLock()
+	breaker, ok := registry.breakers[name]
+	registry.mutex.RUnlock()
+	if ok {
+		return breaker
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if breaker, ok = registry.breakers[name]; !ok {
+		breaker = NewBreaker(name, registry.settings, registry.onStateChange)
+		registry.breakers[name] = breaker
+	}
+	return breaker
+}
+
+// Configure updates the settings of all breakers
+func (registry *Registry) Configure(settings Settings) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.settings = settings
+	for _, breaker := range registry.breakers {
+		breaker.Configure(settings)
+	}
+}
+
+// States returns the state of each breaker, keyed by upstream name
+func (registry *Registry) States() map[string]State {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	states := make(map[string]State, len(registry.breakers))
+	for name, breaker := range registry.breakers {
+		states[name] = breaker.State()
+	}
+	return states
+}
+
+// Names returns the (sorted) names of the upstreams with breakers
+func (registry *Registry) Names() []string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	names := make([]string, 0, len(registry.breakers))
+	for name := range registry.breakers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
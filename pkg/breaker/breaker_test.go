@@ -0,0 +1,131 @@
+package breaker_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/breaker"
+)
+
+func call(t *testing.T, b *breaker.Breaker, failed bool) error {
+	t.Helper()
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	if failed {
+		done(breaker.OutcomeFailure)
+	} else {
+		done(breaker.OutcomeSuccess)
+	}
+	return nil
+}
+
+// TestBreakerStates tests the transitions closed -> open -> half-open -> closed/open
+func TestBreakerStates(t *testing.T) {
+	transitions := []string{}
+	b := breaker.NewBreaker("pep", breaker.Settings{FailureThreshold: 3, OpenTimeout: 50 * time.Millisecond, HalfOpenMaxRequests: 1},
+		func(name string, from breaker.State, to breaker.State) {
+			transitions = append(transitions, to.String())
+		})
+
+	// A success resets the consecutive failure count
+	call(t, b, true)
+	call(t, b, true)
+	call(t, b, false)
+	call(t, b, true)
+	call(t, b, true)
+	if b.State() != breaker.StateClosed {
+		t.Fatalf("expected closed, got %v", b.State())
+	}
+	call(t, b, true)
+	if b.State() != breaker.StateOpen {
+		t.Fatalf("expected open, got %v", b.State())
+	}
+	if err := call(t, b, false); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("expected fail fast when open, got %v", err)
+	}
+
+	// Half-open allows a single trial, whose failure re-opens the circuit
+	time.Sleep(60 * time.Millisecond)
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatalf("expected trial call when half-open: %v", err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatal("expected only one trial call when half-open")
+	}
+	done(breaker.OutcomeFailure)
+	if b.State() != breaker.StateOpen {
+		t.Fatalf("expected re-opened, got %v", b.State())
+	}
+
+	// A successful trial closes the circuit
+	time.Sleep(60 * time.Millisecond)
+	call(t, b, false)
+	if b.State() != breaker.StateClosed {
+		t.Fatalf("expected closed, got %v", b.State())
+	}
+
+	expected := []string{"open", "half-open", "open", "half-open", "closed"}
+	if len(transitions) != len(expected) {
+		t.Fatalf("unexpected transitions: %v", transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Errorf("unexpected transitions: %v", transitions)
+		}
+	}
+}
+
+// TestBreakerDisabled tests that a zero threshold never opens the circuit
+func TestBreakerDisabled(t *testing.T) {
+	b := breaker.NewBreaker("as", breaker.Settings{}, nil)
+	for i := 0; i < 10; i++ {
+		if err := call(t, b, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.State() != breaker.StateClosed {
+		t.Errorf("expected closed, got %v", b.State())
+	}
+}
+
+// TestBreakerNeutral tests that a neutral outcome neither counts as a failure, nor resets the
+// failure count, and frees the trial slot when half-open
+func TestBreakerNeutral(t *testing.T) {
+	b := breaker.NewBreaker("pep", breaker.Settings{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond, HalfOpenMaxRequests: 1}, nil)
+	neutral := func() {
+		t.Helper()
+		done, err := b.Allow()
+		if err != nil {
+			t.Fatalf("expected call to be allowed: %v", err)
+		}
+		done(breaker.OutcomeNeutral)
+	}
+
+	for i := 0; i < 5; i++ {
+		neutral()
+	}
+	if b.State() != breaker.StateClosed {
+		t.Fatalf("expected closed after neutral outcomes, got %v", b.State())
+	}
+	call(t, b, true)
+	neutral()
+	call(t, b, true)
+	if b.State() != breaker.StateOpen {
+		t.Fatalf("expected open, got %v", b.State())
+	}
+
+	// A neutral trial leaves the circuit half-open, allowing another trial
+	time.Sleep(60 * time.Millisecond)
+	neutral()
+	if b.State() != breaker.StateHalfOpen {
+		t.Fatalf("expected half-open, got %v", b.State())
+	}
+	call(t, b, false)
+	if b.State() != breaker.StateClosed {
+		t.Fatalf("expected closed, got %v", b.State())
+	}
+}
@@ -0,0 +1,195 @@
+package bulkhead
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrShed is returned when a call is rejected because the upstream is saturated
+var ErrShed = errors.New("upstream saturated - request shed")
+
+// Reasons for shedding a call
+const (
+	ShedQueueFull = "queue_full"
+	ShedTimeout   = "queue_timeout"
+)
+
+//------------------------------------------------------------------------------
+
+// Settings configures the concurrency bound of an upstream
+type Settings struct {
+	// Maximum calls in flight. Zero means unbounded.
+	MaxInFlight int
+	// Maximum calls waiting for a slot - beyond which calls are shed immediately
+	MaxQueue int
+	// Maximum time that a call waits for a slot
+	QueueTimeout time.Duration
+}
+
+// ChangeFunc is notified of the changes in the in-flight and waiting counts, and of shed calls
+type ChangeFunc func(name string, inFlight int, waiting int, shedReason string)
+
+//------------------------------------------------------------------------------
+
+// Bulkhead bounds the number of concurrent calls to an upstream, with a bounded FIFO
+// queue of waiting calls
+type Bulkhead struct {
+	mutex    sync.Mutex
+	name     string
+	settings Settings
+	onChange ChangeFunc
+	inFlight int
+	waiters  []chan struct{}
+}
+
+//------------------------------------------------------------------------------
+
+func NewBulkhead(name string, settings Settings, onChange ChangeFunc) *Bulkhead {
+	return &Bulkhead{name: name, settings: settings, onChange: onChange}
+}
+
+// Configure updates the settings. Any waiters that can now proceed are released.
+func (bulkhead *Bulkhead) Configure(settings Settings) {
+	bulkhead.mutex.Lock()
+	defer bulkhead.mutex.Unlock()
+	bulkhead.settings = settings
+	for len(bulkhead.waiters) > 0 && (settings.MaxInFlight <= 0 || bulkhead.inFlight < settings.MaxInFlight) {
+		bulkhead.grantNext()
+	}
+	bulkhead.notify("")
+}
+
+// Acquire obtains a slot for a call, waiting if necessary. The returned release function
+// must be called when the call completes. If the call is shed then ErrShed is returned.
+func (bulkhead *Bulkhead) Acquire(ctx context.Context) (release func(), err error) {
+	bulkhead.mutex.Lock()
+	settings := bulkhead.settings
+	if settings.MaxInFlight <= 0 || (bulkhead.inFlight < settings.MaxInFlight && len(bulkhead.waiters) == 0) {
+		bulkhead.inFlight++
+		bulkhead.notify("")
+		bulkhead.mutex.Unlock()
+		return bulkhead.release, nil
+	}
+	if len(bulkhead.waiters) >= settings.MaxQueue {
+		bulkhead.notify(ShedQueueFull)
+		bulkhead.mutex.Unlock()
+		return nil, ErrShed
+	}
+	granted := make(chan struct{})
+	bulkhead.waiters = append(bulkhead.waiters, granted)
+	bulkhead.notify("")
+	bulkhead.mutex.Unlock()
+
+	timer := time.NewTimer(settings.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-granted:
+		return bulkhead.release, nil
+	case <-timer.C:
+		err = ErrShed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Give up waiting - unless the slot was granted in the meantime
+	bulkhead.mutex.Lock()
+	defer bulkhead.mutex.Unlock()
+	select {
+	case <-granted:
+		return bulkhead.release, nil
+	default:
+	}
+	bulkhead.removeWaiter(granted)
+	if errors.Is(err, ErrShed) {
+		bulkhead.notify(ShedTimeout)
+	} else {
+		bulkhead.notify("")
+	}
+	return nil, err
+}
+
+// release frees the slot - handing it to the next waiter, if any
+func (bulkhead *Bulkhead) release() {
+	bulkhead.mutex.Lock()
+	defer bulkhead.mutex.Unlock()
+	bulkhead.inFlight--
+	if len(bulkhead.waiters) > 0 && (bulkhead.settings.MaxInFlight <= 0 || bulkhead.inFlight < bulkhead.settings.MaxInFlight) {
+		bulkhead.grantNext()
+	}
+	bulkhead.notify("")
+}
+
+func (bulkhead *Bulkhead) grantNext() {
+	next := bulkhead.waiters[0]
+	bulkhead.waiters = bulkhead.waiters[1:]
+	bulkhead.inFlight++
+	close(next)
+}
+
+func (bulkhead *Bulkhead) removeWaiter(waiter chan struct{}) {
+	for i, w := range bulkhead.waiters {
+		if w == waiter {
+			bulkhead.waiters = append(bulkhead.waiters[:i], bulkhead.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (bulkhead *Bulkhead) notify(shedReason string) {
+	if bulkhead.onChange != nil {
+		bulkhead.onChange(bulkhead.name, bulkhead.inFlight, len(bulkhead.waiters), shedReason)
+	}
+}
+
+// Counts returns the number of calls in flight and waiting
+func (bulkhead *Bulkhead) Counts() (inFlight int, waiting int) {
+	bulkhead.mutex.Lock()
+	defer bulkhead.mutex.Unlock()
+	return bulkhead.inFlight, len(bulkhead.waiters)
+}
+
+//------------------------------------------------------------------------------
+// Registry
+//------------------------------------------------------------------------------
+
+// Registry holds a bulkhead per upstream, created on first use
+type Registry struct {
+	mutex     sync.RWMutex
+	settings  Settings
+	onChange  ChangeFunc
+	bulkheads map[string]*Bulkhead
+}
+
+func NewRegistry(settings Settings, onChange ChangeFunc) *Registry {
+	return &Registry{settings: settings, onChange: onChange, bulkheads: make(map[string]*Bulkhead)}
+}
+
+// Get returns the bulkhead for the named upstream
+func (registry *Registry) Get(name string) *Bulkhead {
+	registry.mutex.RLock()
+	bulkhead, ok := registry.bulkheads[name]
+	registry.mutex.RUnlock()
+	if ok {
+		return bulkhead
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if bulkhead, ok = registry.bulkheads[name]; !ok {
+		bulkhead = NewBulkhead(name, registry.settings, registry.onChange)
+		registry.bulkheads[name] = bulkhead
+	}
+	return bulkhead
+}
+
+// Configure updates the settings of all bulkheads
+func (registry *Registry) Configure(settings Settings) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.settings = settings
+	for _, bulkhead := range registry.bulkheads {
+		bulkhead.Configure(settings)
+	}
+}
@@ -0,0 +1,73 @@
+package bulkhead_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/bulkhead"
+)
+
+// TestBulkhead tests the in-flight bound, the FIFO hand-over and shedding when the queue is full
+func TestBulkhead(t *testing.T) {
+	shed := []string{}
+	b := bulkhead.NewBulkhead("pep", bulkhead.Settings{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Second},
+		func(name string, inFlight int, waiting int, shedReason string) {
+			if len(shedReason) > 0 {
+				shed = append(shed, shedReason)
+			}
+		})
+
+	release, err := b.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Second call waits for the slot
+	acquired := make(chan func())
+	go func() {
+		release2, err := b.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release2
+	}()
+	for _, waiting := b.Counts(); waiting == 0; _, waiting = b.Counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Third call is shed, since the queue is full
+	if _, err := b.Acquire(context.Background()); !errors.Is(err, bulkhead.ErrShed) {
+		t.Fatalf("expected shed, got %v", err)
+	}
+
+	release()
+	release2 := <-acquired
+	if inFlight, waiting := b.Counts(); inFlight != 1 || waiting != 0 {
+		t.Errorf("unexpected counts: %d in flight, %d waiting", inFlight, waiting)
+	}
+	release2()
+
+	if len(shed) != 1 || shed[0] != bulkhead.ShedQueueFull {
+		t.Errorf("unexpected shed notifications: %v", shed)
+	}
+}
+
+// TestBulkheadTimeout tests that a waiting call is shed after the queue timeout
+func TestBulkheadTimeout(t *testing.T) {
+	b := bulkhead.NewBulkhead("as", bulkhead.Settings{MaxInFlight: 1, MaxQueue: 5, QueueTimeout: 20 * time.Millisecond}, nil)
+	release, _ := b.Acquire(context.Background())
+	defer release()
+
+	start := time.Now()
+	if _, err := b.Acquire(context.Background()); !errors.Is(err, bulkhead.ErrShed) {
+		t.Fatalf("expected shed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("shed before the queue timeout: %v", elapsed)
+	}
+	if _, waiting := b.Counts(); waiting != 0 {
+		t.Errorf("expected no waiters, got %d", waiting)
+	}
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// clientSecretFile is the watched file of the client secret
+var clientSecretFile = struct {
+	path    string
+	watcher *fsnotify.Watcher
+}{}
+
+// registeredClient holds the credentials of the client registered at the Authorization
+// Server (RFC 7591), which are used in the absence of a configured client ID
+var registeredClient = struct {
+	id     string
+	secret string
+}{}
+
+// store swaps in the snapshot of the configuration. The client secret is taken from the
+// client secret file, if configured - and the credentials of the registered client are
+// used if there is no configured client ID. When the client secret changes, the replaced
+// secret is retained as the previous secret - to fall back on until the Authorization
+// Server accepts the new secret.
+// Must be called with the loadMutex held.
+func store(cfg *Config) {
+	previous := current.Load()
+
+	if len(cfg.ClientSecretFile) > 0 {
+		secret, err := readClientSecretFile(cfg.ClientSecretFile)
+		if err == nil {
+			cfg.ClientSecret = secret
+		} else {
+			logrus.Error(err)
+			if previous != nil && previous.ClientSecretFile == cfg.ClientSecretFile {
+				// Keep using the last good secret
+				cfg.ClientSecret = previous.ClientSecret
+			} else {
+				cfg.ClientSecret = ""
+			}
+		}
+	}
+	watchClientSecretFile(cfg.ClientSecretFile)
+	if len(cfg.ClientId) == 0 && len(registeredClient.id) > 0 && cfg.RegistrationEnabled {
+		cfg.ClientId, cfg.ClientSecret = registeredClient.id, registeredClient.secret
+		cfg.ClientRegistered = true
+	}
+
+	if previous != nil && previous.ClientId == cfg.ClientId {
+		if cfg.ClientSecret == previous.ClientSecret {
+			cfg.PreviousClientSecret = previous.PreviousClientSecret
+		} else if len(previous.ClientSecret) > 0 && len(cfg.ClientSecret) > 0 {
+			cfg.PreviousClientSecret = previous.ClientSecret
+			logrus.Info("The client secret has changed - the previous secret is retained until the new secret is accepted")
+		}
+	}
+
+	current.Store(cfg)
+}
+
+// readClientSecretFile reads the client secret from the file, ignoring surrounding whitespace
+func readClientSecretFile(path string) (secret string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read client secret file: %w", err)
+	}
+	secret = strings.TrimSpace(string(data))
+	if len(secret) == 0 {
+		return "", fmt.Errorf("client secret file %v is empty", path)
+	}
+	return
+}
+
+// watchClientSecretFile (re)loads the configuration when the client secret file changes - for
+// example, when a mounted Kubernetes Secret is updated.
+// Must be called with the loadMutex held.
+func watchClientSecretFile(path string) {
+	if len(path) > 0 {
+		path = filepath.Clean(path)
+	}
+	if path == clientSecretFile.path {
+		return
+	}
+	if clientSecretFile.watcher != nil {
+		clientSecretFile.watcher.Close()
+		clientSecretFile.watcher = nil
+	}
+	clientSecretFile.path = path
+	if len(path) > 0 {
+		clientSecretFile.watcher = watchConfigFile(path)
+	}
+}
+
+// ClientSecretAccepted records that the client secret was accepted by the Authorization
+// Server. Acceptance of the current secret completes its rotation, so the previous secret
+// is dropped.
+func ClientSecretAccepted(secret string) {
+	for {
+		cfg := current.Load()
+		if cfg == nil || len(cfg.PreviousClientSecret) == 0 || secret != cfg.ClientSecret {
+			return
+		}
+		updated := *cfg
+		updated.PreviousClientSecret = ""
+		if current.CompareAndSwap(cfg, &updated) {
+			logrus.Info("The new client secret has been accepted - the previous secret is dropped")
+			return
+		}
+	}
+}
+
+// SetRegisteredClient supplies the credentials of the client registered at the
+// Authorization Server, and triggers the config change handlers
+func SetRegisteredClient(id string, secret string) {
+	loadMutex.Lock()
+	registeredClient.id, registeredClient.secret = id, secret
+	store(compile(clientConfig, appConfig))
+	loadMutex.Unlock()
+	handleConfigChange()
+}
+
+//------------------------------------------------------------------------------
+
+// Methods of client authentication at the Token Endpoint
+const (
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodClientSecretBasic = "client_secret_basic"
+)
+
+// AuthServerClient is the client, as registered at an Authorization Server
+type AuthServerClient struct {
+	ClientId     string `mapstructure:"client-id"`
+	ClientSecret string `mapstructure:"client-secret"`
+	AuthMethod   string `mapstructure:"auth-method"`
+	// PreviousClientSecret is the secret being rotated-out, if any - only for the client of
+	// the global client credentials
+	PreviousClientSecret string `mapstructure:"-"`
+}
+
+// GetAuthServerClient returns the client for the Authorization Server - as configured for
+// the issuer in authorization-servers, or else the client of the global client credentials
+func (cfg *Config) GetAuthServerClient(authServerUrl string) (client AuthServerClient, specific bool) {
+	if client, specific = cfg.AuthServerClients[NormalizeIssuer(authServerUrl)]; specific {
+		return
+	}
+	return AuthServerClient{
+		ClientId:             cfg.ClientId,
+		ClientSecret:         cfg.ClientSecret,
+		AuthMethod:           AuthMethodClientSecretPost,
+		PreviousClientSecret: cfg.PreviousClientSecret,
+	}, false
+}
+
+// NormalizeIssuer returns the form of the issuer URL by which the clients of the
+// Authorization Servers are keyed - lower-case, without trailing slash
+func NormalizeIssuer(issuer string) string {
+	return strings.ToLower(strings.TrimSuffix(issuer, "/"))
+}
+
+// getAuthServerClients interprets the clients of specific Authorization Servers, keyed by
+// (normalized) issuer
+func getAuthServerClients(v *viper.Viper) (map[string]AuthServerClient, error) {
+	clients := map[string]AuthServerClient{}
+	if err := v.UnmarshalKey(keyAuthorizationServers.key, &clients); err != nil {
+		return nil, err
+	}
+	issuers := make([]string, 0, len(clients))
+	for issuer := range clients {
+		issuers = append(issuers, issuer)
+	}
+	sort.Strings(issuers)
+	normalized := make(map[string]AuthServerClient, len(clients))
+	for _, issuer := range issuers {
+		client := clients[issuer]
+		if err := checkFormat(formatUrl, issuer); err != nil {
+			return nil, err
+		}
+		if len(client.ClientId) == 0 || len(client.ClientSecret) == 0 {
+			return nil, fmt.Errorf("%v: client-id and client-secret are required", issuer)
+		}
+		switch strings.ToLower(client.AuthMethod) {
+		case "", AuthMethodClientSecretPost:
+			client.AuthMethod = AuthMethodClientSecretPost
+		case AuthMethodClientSecretBasic:
+			client.AuthMethod = AuthMethodClientSecretBasic
+		default:
+			return nil, fmt.Errorf("%v: auth-method '%v' is not one of %v, %v", issuer, client.AuthMethod, AuthMethodClientSecretPost, AuthMethodClientSecretBasic)
+		}
+		normalized[NormalizeIssuer(issuer)] = client
+	}
+	return normalized, nil
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Prefix of the environment variables that set config keys
+const EnvPrefix = "UMA_USER_AGENT_"
+
+// EnvVarName returns the name of the environment variable that sets the config key - the
+// prefixed, upper-case, underscore-separated form of the key.
+// e.g. network.listenPort => UMA_USER_AGENT_NETWORK_LISTEN_PORT
+func EnvVarName(key string) string {
+	sb := strings.Builder{}
+	sb.WriteString(EnvPrefix)
+	var prev rune
+	for _, c := range key {
+		switch {
+		case c == '.' || c == '-':
+			sb.WriteRune('_')
+		case unicode.IsUpper(c) && unicode.IsLower(prev):
+			sb.WriteRune('_')
+			sb.WriteRune(c)
+		default:
+			sb.WriteRune(unicode.ToUpper(c))
+		}
+		prev = c
+	}
+	return sb.String()
+}
+
+// ParseValue interprets the string value of an environment variable or flag, according to
+// the type of the default value of the config key. Lists are comma-separated, and maps are
+// json objects.
+func ParseValue(defval interface{}, value string) (parsed interface{}, err error) {
+	switch defval.(type) {
+	case bool:
+		return strconv.ParseBool(value)
+	case int:
+		return strconv.Atoi(value)
+	case float64:
+		return strconv.ParseFloat(value, 64)
+	case []string:
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	case []int:
+		list := []int{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				n, err := strconv.Atoi(item)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, n)
+			}
+		}
+		return list, nil
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		if err = json.Unmarshal([]byte(value), &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		return value, nil
+	}
+}
+
+// configFromEnv sets the config keys for which an environment variable is set. These take
+// precedence over the config files.
+func configFromEnv(v *viper.Viper, configKeys []configKey) {
+	for _, key := range configKeys {
+		name := EnvVarName(key.key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		parsed, err := ParseValue(key.defval, value)
+		if err != nil {
+			logrus.Errorf("Ignoring bad value of environment variable %v: %v", name, err)
+			continue
+		}
+		v.Set(key.key, parsed)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// ParseFlags sets the config keys from the command-line flags - each named after its
+// config key, e.g. --network.listenPort=8080. The flags take precedence over environment
+// variables and the config files. The config change handlers are triggered if any flag is
+// set. The returned error is pflag.ErrHelp if help was requested.
+func ParseFlags(name string, args []string) (err error) {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.SortFlags = false
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %v:\n", name)
+		fmt.Fprintln(os.Stderr, "Each config key can be set by flag, by environment variable (e.g. "+EnvVarName(keyListenPort.key)+
+			") or in the files client.yaml and config.yaml - in that order of precedence.")
+		fmt.Fprint(os.Stderr, flags.FlagUsages())
+	}
+	for _, key := range clientConfigKeys {
+		flags.String(key.key, "", fmt.Sprintf("client config (env %v)", EnvVarName(key.key)))
+	}
+	for _, key := range appConfigKeys {
+		flags.String(key.key, "", fmt.Sprintf("default %v (env %v)", formatDefault(key.defval), EnvVarName(key.key)))
+	}
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	loadMutex.Lock()
+	changed := false
+	set := func(v *viper.Viper, configKeys []configKey) {
+		for _, key := range configKeys {
+			flag := flags.Lookup(key.key)
+			if err != nil || !flag.Changed {
+				continue
+			}
+			var parsed interface{}
+			if parsed, err = ParseValue(key.defval, flag.Value.String()); err != nil {
+				err = fmt.Errorf("bad value of flag --%v: %w", key.key, err)
+				return
+			}
+			v.Set(key.key, parsed)
+			changed = true
+		}
+	}
+	set(clientConfig, clientConfigKeys)
+	set(appConfig, appConfigKeys)
+	if err == nil && changed {
+		store(compile(clientConfig, appConfig))
+	}
+	loadMutex.Unlock()
+	if err == nil && changed {
+		handleConfigChange()
+	}
+	return
+}
+
+// formatDefault returns the default value in the form of its flag value
+func formatDefault(defval interface{}) string {
+	switch value := defval.(type) {
+	case []string:
+		return fmt.Sprintf("%q", strings.Join(value, ","))
+	case []int:
+		items := make([]string, len(value))
+		for i, n := range value {
+			items[i] = strconv.Itoa(n)
+		}
+		return fmt.Sprintf("%q", strings.Join(items, ","))
+	case map[string]interface{}:
+		data, _ := json.Marshal(value)
+		return fmt.Sprintf("%q", data)
+	case string:
+		return fmt.Sprintf("%q", value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -22,71 +25,254 @@ type configKey struct {
 // Config keys with default values
 var keyClientId = configKey{"client-id", ""}
 var keyClientSecret = configKey{"client-secret", ""}
+var keyClientSecretFile = configKey{"client-secret-file", ""}
+var keyAuthorizationServers = configKey{"authorization-servers", map[string]interface{}{}}
 var keyLoggingLevel = configKey{"logging.level", logrus.InfoLevel}
+var keyLoggingFormat = configKey{"logging.format", "text"}
+var keyLoggingFieldNames = configKey{"logging.fieldNames", "default"}
 var keyHttpTimeout = configKey{"network.httpTimeout", 10}
 var keyListenPort = configKey{"network.listenPort", 80}
+var keyReadTimeout = configKey{"network.readTimeout", 30}
+var keyReadHeaderTimeout = configKey{"network.readHeaderTimeout", 10}
+var keyWriteTimeout = configKey{"network.writeTimeout", 60}
+var keyIdleTimeout = configKey{"network.idleTimeout", 120}
+var keyShutdownDelay = configKey{"network.shutdownDelay", 5}
+var keyShutdownTimeout = configKey{"network.shutdownTimeout", 30}
+var keyUnixSocketPath = configKey{"network.unixSocket.path", ""}
+var keyUnixSocketMode = configKey{"network.unixSocket.mode", "0660"}
+var keyTlsEnabled = configKey{"network.tls.enabled", false}
+var keyTlsCertFile = configKey{"network.tls.certFile", "/app/tls/tls.crt"}
+var keyTlsKeyFile = configKey{"network.tls.keyFile", "/app/tls/tls.key"}
+var keyTlsClientCaFile = configKey{"network.tls.clientCaFile", ""}
+var keyTlsClientAuth = configKey{"network.tls.clientAuth", ""}
+var keyTlsMinVersion = configKey{"network.tls.minVersion", "1.2"}
+var keyAdminListenPort = configKey{"admin.listenPort", 0}
+var keyAdminBearerToken = configKey{"admin.bearerToken", ""}
+var keyAdminTlsEnabled = configKey{"admin.tls.enabled", false}
+var keyAdminTlsClientCaFile = configKey{"admin.tls.clientCaFile", ""}
+var keyReadinessCheckUpstreams = configKey{"readiness.checkUpstreams", false}
+var keyReadinessInterval = configKey{"readiness.interval", 15}
+var keyReadinessAuthorizationServers = configKey{"readiness.authorizationServers", []string{}}
+var keyMetricsRoutes = configKey{"metrics.routes", []string{}}
 var keyPepUrl = configKey{"pep.url", "http://pep"}
 var keyUserIdCookieName = configKey{"userIdCookieName", "auth_user_id"}
 var keyAuthRptCookieName = configKey{"authRptCookieName", "auth_rpt"}
 var keyAuthRptCookieMaxAge = configKey{"authRptCookieMaxAge", 300}
+var keyAuthRptCookiePath = configKey{"authRptCookiePath", "/"}
+var keyAuthRptCookieDomain = configKey{"authRptCookieDomain", ""}
 var keyUnauthorizedResponse = configKey{"unauthorizedResponse", "Please login to access the resource"}
 var keyRetriesAuthorizationAttempt = configKey{"retries.authorizationAttempt", 1}
 var keyRetriesHttpRequest = configKey{"retries.httpRequest", 1}
+var keyAuthDecisionTimeout = configKey{"authDecisionTimeout", 0}
+var keyRetriesBackoffInitial = configKey{"retries.backoff.initial", 100}
+var keyRetriesBackoffMax = configKey{"retries.backoff.max", 2000}
+var keyRetriesBackoffMultiplier = configKey{"retries.backoff.multiplier", 2.0}
+var keyRetriesBackoffJitter = configKey{"retries.backoff.jitter", 0.2}
+var keyRetriesBudget = configKey{"retries.budget", 10}
+var keyRetriesRetryableStatuses = configKey{"retries.retryableStatuses", []int{429, 500, 502, 503, 504}}
+var keyRetriesUpstreams = configKey{"retries.upstreams", map[string]interface{}{}}
 var keyOpenAccess = configKey{"openAccess", false}
 var keyInsecureTlsSkipVerify = configKey{"insecureTlsSkipVerify", false}
+var keyOidcIssuer = configKey{"oidc.issuer", ""}
+var keyOidcRedirectUrl = configKey{"oidc.redirectUrl", ""}
+var keyOidcScopes = configKey{"oidc.scopes", "openid"}
+var keyUserIdCookieMaxAge = configKey{"userIdCookieMaxAge", 0}
+var keyUserIdCookieDomain = configKey{"userIdCookieDomain", ""}
+var keyUserIdCookiePath = configKey{"userIdCookiePath", "/"}
+var keyUserIdCookieSecure = configKey{"userIdCookieSecure", true}
+var keyUserIdCookieSameSite = configKey{"userIdCookieSameSite", "Lax"}
+var keyRefreshTokenCookieName = configKey{"refreshTokenCookieName", "auth_refresh_token"}
+var keyOidcEndSessionRedirect = configKey{"oidc.endSessionRedirect", false}
+var keyOidcPostLogoutRedirectUrl = configKey{"oidc.postLogoutRedirectUrl", ""}
+var keyAuthCacheMaxAge = configKey{"authCache.maxAge", 0}
+var keyAuthRptCookieSealed = configKey{"authRptCookieSealed", false}
+var keyAuthRptCookieKeyFile = configKey{"authRptCookieKeyFile", "/app/secrets/rpt-cookie-keys"}
+var keySessionEnabled = configKey{"session.enabled", false}
+var keySessionCookieName = configKey{"session.cookieName", "auth_session"}
+var keySessionMaxAge = configKey{"session.maxAge", 28800}
+var keySessionStore = configKey{"session.store", "memory"}
+var keySessionFileDir = configKey{"session.fileDir", "/app/sessions"}
+var keySessionRedisAddress = configKey{"session.redis.address", "localhost:6379"}
+var keySessionRedisPassword = configKey{"session.redis.password", ""}
+var keySessionRedisDatabase = configKey{"session.redis.database", 0}
+var keySessionRedisKeyPrefix = configKey{"session.redis.keyPrefix", "uma-user-agent:session:"}
+var keyTracingExporter = configKey{"tracing.exporter", "none"}
+var keyTracingServiceName = configKey{"tracing.serviceName", "uma-user-agent"}
+var keyTracingSampleRatio = configKey{"tracing.sampleRatio", 1.0}
+var keyTracingOtlpEndpoint = configKey{"tracing.otlp.endpoint", "localhost:4318"}
+var keyTracingOtlpInsecure = configKey{"tracing.otlp.insecure", false}
+var keyTracingFile = configKey{"tracing.file", ""}
+var keyAuditFilePath = configKey{"audit.file.path", ""}
+var keyAuditFileMaxSizeMb = configKey{"audit.file.maxSizeMb", 100}
+var keyAuditFileMaxBackups = configKey{"audit.file.maxBackups", 5}
+var keyAuditFileHashChain = configKey{"audit.file.hashChain", false}
+var keyAuditSyslogAddress = configKey{"audit.syslog.address", ""}
+var keyAuditSyslogNetwork = configKey{"audit.syslog.network", "udp"}
+var keyAuditSyslogAppName = configKey{"audit.syslog.appName", "uma-user-agent"}
+var keyAuditWebhookUrl = configKey{"audit.webhook.url", ""}
+var keyAuditWebhookAuthorization = configKey{"audit.webhook.authorization", ""}
+var keyTrustedProxies = configKey{"network.trustedProxies", []string{"127.0.0.0/8", "::1/128"}}
+var keyRateLimitPepPerUserRate = configKey{"rateLimit.pep.perUser.rate", 0.0}
+var keyRateLimitPepPerUserBurst = configKey{"rateLimit.pep.perUser.burst", 10}
+var keyRateLimitPepPerClientIpRate = configKey{"rateLimit.pep.perClientIp.rate", 0.0}
+var keyRateLimitPepPerClientIpBurst = configKey{"rateLimit.pep.perClientIp.burst", 10}
+var keyRateLimitAsPerUserRate = configKey{"rateLimit.as.perUser.rate", 0.0}
+var keyRateLimitAsPerUserBurst = configKey{"rateLimit.as.perUser.burst", 10}
+var keyRateLimitAsPerClientIpRate = configKey{"rateLimit.as.perClientIp.rate", 0.0}
+var keyRateLimitAsPerClientIpBurst = configKey{"rateLimit.as.perClientIp.burst", 10}
+var keyLoadSheddingMaxInFlight = configKey{"loadShedding.maxInFlight", 0}
+var keyLoadSheddingMaxQueue = configKey{"loadShedding.maxQueue", 100}
+var keyLoadSheddingQueueTimeout = configKey{"loadShedding.queueTimeout", 1000}
+var keyCircuitBreakerFailureThreshold = configKey{"circuitBreaker.failureThreshold", 5}
+var keyCircuitBreakerOpenTimeout = configKey{"circuitBreaker.openTimeout", 30}
+var keyCircuitBreakerHalfOpenMaxRequests = configKey{"circuitBreaker.halfOpenMaxRequests", 1}
+var keyCircuitBreakerFailMode = configKey{"circuitBreaker.failMode", "closed"}
+var keyRegistrationEnabled = configKey{"registration.enabled", false}
+var keyRegistrationAuthorizationServer = configKey{"registration.authorizationServer", ""}
+var keyRegistrationInitialAccessToken = configKey{"registration.initialAccessToken", ""}
+var keyRegistrationCredentialsFile = configKey{"registration.credentialsFile", "/app/registration/client.json"}
+var keyRegistrationClientName = configKey{"registration.clientName", "uma-user-agent"}
 
 // Client config
-var clientConfigKeys = []configKey{keyClientId, keyClientSecret}
+var clientConfigKeys = []configKey{keyClientId, keyClientSecret, keyClientSecretFile, keyAuthorizationServers}
 
 // App config
 var appConfigKeys = []configKey{
 	keyLoggingLevel,
+	keyLoggingFormat,
+	keyLoggingFieldNames,
 	keyHttpTimeout,
 	keyListenPort,
+	keyReadTimeout,
+	keyReadHeaderTimeout,
+	keyWriteTimeout,
+	keyIdleTimeout,
+	keyShutdownDelay,
+	keyShutdownTimeout,
+	keyUnixSocketPath,
+	keyUnixSocketMode,
+	keyTlsEnabled,
+	keyTlsCertFile,
+	keyTlsKeyFile,
+	keyTlsClientCaFile,
+	keyTlsClientAuth,
+	keyTlsMinVersion,
+	keyAdminListenPort,
+	keyAdminBearerToken,
+	keyAdminTlsEnabled,
+	keyAdminTlsClientCaFile,
+	keyReadinessCheckUpstreams,
+	keyReadinessInterval,
+	keyReadinessAuthorizationServers,
+	keyMetricsRoutes,
 	keyPepUrl,
 	keyUserIdCookieName,
 	keyAuthRptCookieName,
 	keyAuthRptCookieMaxAge,
+	keyAuthRptCookiePath,
+	keyAuthRptCookieDomain,
 	keyUnauthorizedResponse,
 	keyRetriesAuthorizationAttempt,
 	keyRetriesHttpRequest,
+	keyAuthDecisionTimeout,
+	keyRetriesBackoffInitial,
+	keyRetriesBackoffMax,
+	keyRetriesBackoffMultiplier,
+	keyRetriesBackoffJitter,
+	keyRetriesBudget,
+	keyRetriesRetryableStatuses,
+	keyRetriesUpstreams,
 	keyOpenAccess,
 	keyInsecureTlsSkipVerify,
+	keyOidcIssuer,
+	keyOidcRedirectUrl,
+	keyOidcScopes,
+	keyUserIdCookieMaxAge,
+	keyUserIdCookieDomain,
+	keyUserIdCookiePath,
+	keyUserIdCookieSecure,
+	keyUserIdCookieSameSite,
+	keyRefreshTokenCookieName,
+	keyOidcEndSessionRedirect,
+	keyOidcPostLogoutRedirectUrl,
+	keyAuthCacheMaxAge,
+	keyAuthRptCookieSealed,
+	keyAuthRptCookieKeyFile,
+	keySessionEnabled,
+	keySessionCookieName,
+	keySessionMaxAge,
+	keySessionStore,
+	keySessionFileDir,
+	keySessionRedisAddress,
+	keySessionRedisPassword,
+	keySessionRedisDatabase,
+	keySessionRedisKeyPrefix,
+	keyTracingExporter,
+	keyTracingServiceName,
+	keyTracingSampleRatio,
+	keyTracingOtlpEndpoint,
+	keyTracingOtlpInsecure,
+	keyTracingFile,
+	keyAuditFilePath,
+	keyAuditFileMaxSizeMb,
+	keyAuditFileMaxBackups,
+	keyAuditFileHashChain,
+	keyAuditSyslogAddress,
+	keyAuditSyslogNetwork,
+	keyAuditSyslogAppName,
+	keyAuditWebhookUrl,
+	keyAuditWebhookAuthorization,
+	keyTrustedProxies,
+	keyRateLimitPepPerUserRate,
+	keyRateLimitPepPerUserBurst,
+	keyRateLimitPepPerClientIpRate,
+	keyRateLimitPepPerClientIpBurst,
+	keyRateLimitAsPerUserRate,
+	keyRateLimitAsPerUserBurst,
+	keyRateLimitAsPerClientIpRate,
+	keyRateLimitAsPerClientIpBurst,
+	keyLoadSheddingMaxInFlight,
+	keyLoadSheddingMaxQueue,
+	keyLoadSheddingQueueTimeout,
+	keyCircuitBreakerFailureThreshold,
+	keyCircuitBreakerOpenTimeout,
+	keyCircuitBreakerHalfOpenMaxRequests,
+	keyCircuitBreakerFailMode,
+	keyRegistrationEnabled,
+	keyRegistrationAuthorizationServer,
+	keyRegistrationInitialAccessToken,
+	keyRegistrationCredentialsFile,
+	keyRegistrationClientName,
 }
 
+// loadMutex serialises all access to the config sources (viper), which are read only to
+// compile the snapshot of the configuration
+var loadMutex sync.Mutex
+
 // Init
 func configInit() {
-	logrus.Info("Initialising the configuration from file")
-
-	// Get config directory from env
-	configDir := defaultConfigDir
-	val, ok := os.LookupEnv("CONFIG_DIR")
-	if ok {
-		if len(val) > 0 {
-			configDir = val
-		}
-	}
+	logrus.Info("Initialising the configuration")
+	configDir := GetConfigDir()
 
-	// Init config from files
-	clientConfigLoaded := make(chan bool)
-	appConfigLoaded := make(chan bool)
-	go configInitFromFile(clientConfig, "client", configDir, clientConfigKeys, clientConfigLoaded)
-	go configInitFromFile(appConfig, "config", configDir, appConfigKeys, appConfigLoaded)
+	// Init config from defaults, files and env
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+	configInitFromFile(clientConfig, "client", configDir, clientConfigKeys)
+	configInitFromFile(appConfig, "config", configDir, appConfigKeys)
+	store(compile(clientConfig, appConfig))
+}
 
-	// client config aync - no need to wait since the readiness probe reflects the client state
-	go func() {
-		if <-clientConfigLoaded {
-			logrus.Info("Client configuration loaded successfully")
-		}
-	}()
-	// application config is mandatory before progressing
-	if <-appConfigLoaded {
-		logrus.Info("Application configuration loaded successfully")
+// GetConfigDir returns the directory of the config files - from the CONFIG_DIR env
+func GetConfigDir() string {
+	if val, ok := os.LookupEnv("CONFIG_DIR"); ok && len(val) > 0 {
+		return val
 	}
+	return defaultConfigDir
 }
 
-// Init config from files
-func configInitFromFile(v *viper.Viper, configName string, configDir string, configKeys []configKey, loaded chan bool) {
+// Init config from file - which is optional, in which case the config is taken from the
+// defaults and env. A missing file is loaded if it appears later.
+func configInitFromFile(v *viper.Viper, configName string, configDir string, configKeys []configKey) {
 	// File location
 	v.SetConfigName(configName)
 	v.AddConfigPath(configDir)
@@ -96,35 +282,154 @@ func configInitFromFile(v *viper.Viper, configName string, configDir string, con
 		v.SetDefault(key.key, key.defval)
 	}
 
+	// Env - overrides the file
+	configFromEnv(v, configKeys)
+
 	// Load
-	var err error
-	for err = v.ReadInConfig(); err != nil; {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			logrus.Warn(err)
+	err := v.ReadInConfig()
+	if err == nil {
+		logrus.Infof("Configuration loaded successfully from %v", v.ConfigFileUsed())
+		watchConfigFile(v.ConfigFileUsed())
+		return
+	}
+	if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+		logrus.Error(err)
+		return
+	}
+
+	// Poll for the file to appear
+	logrus.Infof("No %v file in %v - using defaults, environment and flags", configName, configDir)
+	go func() {
+		for {
 			time.Sleep(time.Second * 5)
-			err = v.ReadInConfig()
-		} else {
-			logrus.Error(err)
-			break
+			loadMutex.Lock()
+			err := v.ReadInConfig()
+			loadMutex.Unlock()
+			if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+				continue
+			}
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			logrus.Infof("Configuration loaded from %v", v.ConfigFileUsed())
+			applyFileChange()
+			watchConfigFile(v.ConfigFileUsed())
+			return
+		}
+	}()
+}
+
+// watchConfigFile applies changes of the config file - including replacement of a
+// symlinked file, as for a mounted ConfigMap or Secret. The watch ends when the returned
+// watcher is closed.
+func watchConfigFile(configFile string) (watcher *fsnotify.Watcher) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("Could not watch config file %v: %v", configFile, err)
+		return nil
+	}
+	configFile = filepath.Clean(configFile)
+	configDir, _ := filepath.Split(configFile)
+	realConfigFile, _ := filepath.EvalSymlinks(configFile)
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentConfigFile, _ := filepath.EvalSymlinks(configFile)
+				written := filepath.Clean(event.Name) == configFile && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				replaced := len(currentConfigFile) > 0 && currentConfigFile != realConfigFile
+				if written || replaced {
+					realConfigFile = currentConfigFile
+					scheduleFileChange()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Error("Error watching config file: ", err)
+			}
 		}
+	}()
+	if err = watcher.Add(configDir); err != nil {
+		logrus.Errorf("Could not watch config directory %v: %v", configDir, err)
+		watcher.Close()
+		return nil
 	}
+	return watcher
+}
 
-	// Signal the loaded status
-	loaded <- (err == nil)
+// changeThrottle debounces the change events of the config files
+var changeThrottle = struct {
+	mutex sync.Mutex
+	timer *time.Timer
+}{}
 
-	// Watch
-	if err == nil {
-		v.OnConfigChange(func(in fsnotify.Event) {
-			// Need this throttling trick to avoid double load events
-			timeDelay := 100 * time.Millisecond
-			if changeThrottleTimer == nil {
-				changeThrottleTimer = time.AfterFunc(timeDelay, handleConfigChange)
-			} else {
-				changeThrottleTimer.Reset(timeDelay)
-			}
-		})
-		v.WatchConfig()
+// scheduleFileChange applies the change of the config files after a short delay - to avoid
+// applying multiple events of the same change
+func scheduleFileChange() {
+	changeThrottle.mutex.Lock()
+	defer changeThrottle.mutex.Unlock()
+	timeDelay := 100 * time.Millisecond
+	if changeThrottle.timer == nil {
+		changeThrottle.timer = time.AfterFunc(timeDelay, applyFileChange)
+	} else {
+		changeThrottle.timer.Reset(timeDelay)
+	}
+}
+
+// applyFileChange applies the change of the config files - unless invalid, in which case
+// the change is rejected and the previous configuration is kept
+func applyFileChange() {
+	if err := reloadConfig(); err != nil {
+		logrus.Errorf("Rejected the change of configuration, keeping the previous configuration: %v", err)
+		return
+	}
+	handleConfigChange()
+}
+
+// Reload forces the configuration to be re-read from file, and the config change handlers
+// to be triggered. An invalid configuration is rejected, and the previous configuration is
+// kept.
+func Reload() (err error) {
+	logrus.Info("Reloading the configuration from file")
+	if err = reloadConfig(); err != nil {
+		return fmt.Errorf("could not reload configuration: %w", err)
+	}
+	handleConfigChange()
+	return
+}
+
+// reloadConfig re-reads the config files and, if valid, swaps in the new snapshot of the
+// configuration
+func reloadConfig() (err error) {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+	if err = reloadFile(appConfig); err != nil {
+		return
 	}
+	if err = reloadFile(clientConfig); err != nil {
+		return
+	}
+	warnings, err := validate(clientConfig, appConfig)
+	for _, warning := range warnings {
+		logrus.Warn("Configuration: ", warning)
+	}
+	if err != nil {
+		return
+	}
+	store(compile(clientConfig, appConfig))
+	return
 }
 
-var changeThrottleTimer *time.Timer
+// reloadFile re-reads the config file - if there is one
+func reloadFile(v *viper.Viper) (err error) {
+	err = v.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,313 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// rule constrains the value of a config key, beyond the type of its default value
+type rule struct {
+	min, max float64  // range of a number, or of each item of a list of numbers
+	oneOf    []string // allowed values (case-insensitive) of a string
+	format   string   // format of a string, or of each item of a list of strings
+	required bool     // a string must be non-empty
+}
+
+// Formats of string values
+const (
+	formatUrl   = "url"   // absolute http(s) URL
+	formatCidr  = "cidr"  // address range, or single address
+	formatOctal = "octal" // octal permissions
+)
+
+var unbounded = math.Inf(1)
+
+func atLeast(min float64) rule {
+	return rule{min: min, max: unbounded}
+}
+
+func between(min float64, max float64) rule {
+	return rule{min: min, max: max}
+}
+
+// configSchema holds the rules of the config keys. Keys that are not listed are checked
+// only for the type of their default value - and numbers must not be negative.
+var configSchema = map[string]rule{
+	keyLoggingFormat.key:                     {oneOf: []string{"text", "json"}},
+	keyLoggingFieldNames.key:                 {oneOf: []string{"default", "ecs", "gelf"}},
+	keyHttpTimeout.key:                       atLeast(1),
+	keyListenPort.key:                        between(0, 65535),
+	keyUnixSocketMode.key:                    {format: formatOctal},
+	keyTlsClientAuth.key:                     {oneOf: []string{"", "none", "verifyIfGiven", "require"}},
+	keyTlsMinVersion.key:                     {oneOf: []string{"1.2", "1.3"}},
+	keyAdminListenPort.key:                   between(0, 65535),
+	keyReadinessInterval.key:                 atLeast(1),
+	keyReadinessAuthorizationServers.key:     {format: formatUrl},
+	keyPepUrl.key:                            {format: formatUrl, required: true},
+	keyRetriesBackoffMultiplier.key:          atLeast(1),
+	keyRetriesBackoffJitter.key:              between(0, 1),
+	keyRetriesRetryableStatuses.key:          between(100, 599),
+	keyOidcIssuer.key:                        {format: formatUrl},
+	keyOidcRedirectUrl.key:                   {format: formatUrl},
+	keyUserIdCookieSameSite.key:              {oneOf: []string{"Lax", "Strict", "None"}},
+	keyOidcPostLogoutRedirectUrl.key:         {format: formatUrl},
+	keySessionStore.key:                      {oneOf: []string{"memory", "file", "redis"}},
+	keyTracingExporter.key:                   {oneOf: []string{"none", "otlp", "stdout"}},
+	keyTracingSampleRatio.key:                between(0, 1),
+	keyAuditSyslogNetwork.key:                {oneOf: []string{"udp", "tcp"}},
+	keyAuditWebhookUrl.key:                   {format: formatUrl},
+	keyTrustedProxies.key:                    {format: formatCidr},
+	keyCircuitBreakerHalfOpenMaxRequests.key: atLeast(1),
+	keyCircuitBreakerFailMode.key:            {oneOf: []string{"open", "closed"}},
+	keyRegistrationAuthorizationServer.key:   {format: formatUrl},
+}
+
+//------------------------------------------------------------------------------
+
+// ValidationError reports the problems of an invalid configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	sb := strings.Builder{}
+	sb.WriteString("invalid configuration:")
+	for _, problem := range e.Problems {
+		sb.WriteString("\n  - ")
+		sb.WriteString(problem)
+	}
+	return sb.String()
+}
+
+// Validate checks the current configuration against the schema. The returned warnings
+// report unknown keys, which are ignored. The error is a *ValidationError.
+func Validate() (warnings []string, err error) {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+	return validate(clientConfig, appConfig)
+}
+
+// ValidateDir checks the configuration files in the directory against the schema - for
+// checking of configuration ahead of deployment. The error is a *ValidationError, or
+// reports that the files could not be read.
+func ValidateDir(configDir string) (warnings []string, err error) {
+	if info, statErr := os.Stat(configDir); statErr != nil || !info.IsDir() {
+		return nil, fmt.Errorf("config directory %v not found", configDir)
+	}
+	found := 0
+	load := func(configName string, configKeys []configKey) (v *viper.Viper, err error) {
+		v = viper.New()
+		v.SetConfigName(configName)
+		v.AddConfigPath(configDir)
+		for _, key := range configKeys {
+			v.SetDefault(key.key, key.defval)
+		}
+		err = v.ReadInConfig()
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			return v, nil
+		}
+		if err == nil {
+			found++
+		}
+		return
+	}
+	client, err := load("client", clientConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	app, err := load("config", appConfigKeys)
+	if err != nil {
+		return nil, err
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("neither client nor config file found in %v", filepath.Clean(configDir))
+	}
+	return validate(client, app)
+}
+
+// validate checks the client and application configuration against the schema
+func validate(client *viper.Viper, app *viper.Viper) (warnings []string, err error) {
+	problems := []string{}
+	for _, key := range clientConfigKeys {
+		problems = append(problems, validateKey(client, key)...)
+	}
+	for _, key := range appConfigKeys {
+		problems = append(problems, validateKey(app, key)...)
+	}
+	if _, upstreamsErr := getRetriesUpstreams(app); upstreamsErr != nil {
+		problems = append(problems, fmt.Sprintf("%v: %v", keyRetriesUpstreams.key, strings.Join(strings.Fields(upstreamsErr.Error()), " ")))
+	}
+	if _, clientsErr := getAuthServerClients(client); clientsErr != nil {
+		problems = append(problems, fmt.Sprintf("%v: %v", keyAuthorizationServers.key, strings.Join(strings.Fields(clientsErr.Error()), " ")))
+	}
+	if cast.ToBool(app.Get(keyRegistrationEnabled.key)) && len(app.GetString(keyRegistrationAuthorizationServer.key)) == 0 {
+		problems = append(problems, fmt.Sprintf("%v: a value is required for registration", keyRegistrationAuthorizationServer.key))
+	}
+	warnings = append(unknownKeys(client, clientConfigKeys), unknownKeys(app, appConfigKeys)...)
+	if len(problems) > 0 {
+		err = &ValidationError{Problems: problems}
+	}
+	return
+}
+
+// validateKey checks the value of the key against its type and rule
+func validateKey(v *viper.Viper, key configKey) (problems []string) {
+	value := v.Get(key.key)
+	keyRule, hasRule := configSchema[key.key]
+	if !hasRule {
+		keyRule = atLeast(0)
+	}
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%v: ", key.key)+fmt.Sprintf(format, args...))
+	}
+	checkNumber := func(n float64) {
+		if n < keyRule.min || n > keyRule.max {
+			if keyRule.max == unbounded {
+				report("%v is less than the minimum %v", n, keyRule.min)
+			} else {
+				report("%v is outside the range %v to %v", n, keyRule.min, keyRule.max)
+			}
+		}
+	}
+	checkString := func(s string) {
+		if keyRule.required && len(s) == 0 {
+			report("a value is required")
+		}
+		if len(keyRule.oneOf) > 0 && !containsFold(keyRule.oneOf, s) {
+			report("'%v' is not one of %v", s, strings.Join(keyRule.oneOf, ", "))
+		}
+		if len(s) > 0 && len(keyRule.format) > 0 {
+			if formatErr := checkFormat(keyRule.format, s); formatErr != nil {
+				report("%v", formatErr)
+			}
+		}
+	}
+
+	switch key.defval.(type) {
+	case bool:
+		if _, err := cast.ToBoolE(value); err != nil {
+			report("expected true or false, got '%v'", value)
+		}
+	case int:
+		n, err := cast.ToIntE(value)
+		if err != nil {
+			report("expected an integer, got '%v'", value)
+		} else {
+			checkNumber(float64(n))
+		}
+	case float64:
+		n, err := cast.ToFloat64E(value)
+		if err != nil {
+			report("expected a number, got '%v'", value)
+		} else {
+			checkNumber(n)
+		}
+	case []int:
+		list, err := cast.ToIntSliceE(value)
+		if err != nil {
+			report("expected a list of integers, got '%v'", value)
+		}
+		for _, n := range list {
+			checkNumber(float64(n))
+		}
+	case []string:
+		list, err := cast.ToStringSliceE(value)
+		if err != nil {
+			report("expected a list of strings, got '%v'", value)
+		}
+		for _, s := range list {
+			checkString(s)
+		}
+	case map[string]interface{}:
+		if _, err := cast.ToStringMapE(value); err != nil {
+			report("expected a map, got '%v'", value)
+		}
+	case logrus.Level:
+		if _, err := logrus.ParseLevel(cast.ToString(value)); err != nil {
+			report("%v", err)
+		}
+	default:
+		s, err := cast.ToStringE(value)
+		if err != nil {
+			report("expected a string, got '%v'", value)
+		} else {
+			checkString(s)
+		}
+	}
+	return
+}
+
+// checkFormat checks the string value against the format
+func checkFormat(format string, value string) error {
+	switch format {
+	case formatUrl:
+		u, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("'%v' is not a valid URL: %w", value, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("'%v' is not an absolute http(s) URL", value)
+		}
+	case formatCidr:
+		if strings.Contains(value, "/") {
+			if _, _, err := net.ParseCIDR(value); err != nil {
+				return fmt.Errorf("'%v' is not a valid address range", value)
+			}
+		} else if net.ParseIP(value) == nil {
+			return fmt.Errorf("'%v' is not a valid address", value)
+		}
+	case formatOctal:
+		if mode, err := strconv.ParseUint(value, 8, 32); err != nil || mode > 0777 {
+			return fmt.Errorf("'%v' is not valid octal permissions", value)
+		}
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownKeys returns warnings of the keys that are not part of the schema - typically
+// misspelled. The contents of map keys are not checked.
+func unknownKeys(v *viper.Viper, configKeys []configKey) (warnings []string) {
+	known := map[string]bool{}
+	maps := []string{}
+	for _, key := range configKeys {
+		lowerKey := strings.ToLower(key.key)
+		known[lowerKey] = true
+		if _, ok := key.defval.(map[string]interface{}); ok {
+			maps = append(maps, lowerKey+".")
+		}
+	}
+	for _, key := range v.AllKeys() {
+		if known[key] {
+			continue
+		}
+		inMap := false
+		for _, prefix := range maps {
+			inMap = inMap || strings.HasPrefix(key, prefix)
+		}
+		if !inMap {
+			warnings = append(warnings, fmt.Sprintf("%v: unknown key is ignored", key))
+		}
+	}
+	sort.Strings(warnings)
+	return
+}
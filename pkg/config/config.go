@@ -1,89 +1,489 @@
 package config
 
 import (
-	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
-func IsReady() (isReady bool) {
-	isReady = true &&
-		((len(GetClientId()) > 0 &&
-			len(GetClientSecret()) > 0) ||
-			(IsOpenAccess()))
-	return
+func IsReady() bool {
+	return Get().IsReady()
 }
 
 func GetClientId() string {
-	return clientConfig.GetString(keyClientId.key)
+	return Get().ClientId
 }
 
+// GetClientSecret returns the client secret - from the client secret file, if configured
 func GetClientSecret() string {
-	return clientConfig.GetString(keyClientSecret.key)
+	return Get().ClientSecret
+}
+
+// GetPreviousClientSecret returns the client secret being rotated-out, which is used only if
+// the current secret is rejected by the Authorization Server
+func GetPreviousClientSecret() string {
+	return Get().PreviousClientSecret
 }
 
 func GetHttpTimeout() time.Duration {
-	return appConfig.GetDuration(keyHttpTimeout.key)
+	return Get().HttpTimeout
 }
 
 func GetLogLevel() logrus.Level {
-	// default
-	var logLevel logrus.Level
-	var ok bool
-	if logLevel, ok = keyLoggingLevel.defval.(logrus.Level); !ok {
-		logLevel = logrus.InfoLevel
-	}
+	return Get().LogLevel
+}
 
-	// read from config
-	val := appConfig.GetString(keyLoggingLevel.key)
-	l, err := logrus.ParseLevel(val)
-	if err != nil {
-		logrus.Warning(fmt.Sprintf("Bad log level '%v' specified, using default '%v'", val, logLevel.String()))
-	} else {
-		logLevel = l
-	}
+func GetLogFormat() string {
+	return Get().LogFormat
+}
+
+func GetLogFieldNames() string {
+	return Get().LogFieldNames
+}
+
+// GetAdminListenPort returns the port of the admin listener - zero if disabled
+func GetAdminListenPort() int {
+	return Get().AdminListenPort
+}
+
+func GetAdminBearerToken() string {
+	return Get().AdminBearerToken
+}
 
-	logrus.Info("Using log level: ", logLevel.String())
-	return logLevel
+func IsAdminTlsEnabled() bool {
+	return Get().AdminTlsEnabled
+}
+
+func GetAdminTlsClientCaFile() string {
+	return Get().AdminTlsClientCaFile
+}
+
+// IsReadinessCheckUpstreams indicates whether readiness includes the health of the PEP and
+// Authorization Servers
+func IsReadinessCheckUpstreams() bool {
+	return Get().ReadinessCheckUpstreams
+}
+
+// GetReadinessInterval returns the interval between health checks of the upstreams
+func GetReadinessInterval() time.Duration {
+	return Get().ReadinessInterval
+}
+
+func GetReadinessAuthorizationServers() []string {
+	return Get().ReadinessAuthorizationServers
 }
 
 func GetPepUrl() string {
-	return appConfig.GetString(keyPepUrl.key)
+	return Get().PepUrl
 }
 
 func GetPort() int {
-	return appConfig.GetInt(keyListenPort.key)
+	return Get().ListenPort
+}
+
+func GetReadTimeout() time.Duration {
+	return Get().ReadTimeout
+}
+
+func GetReadHeaderTimeout() time.Duration {
+	return Get().ReadHeaderTimeout
+}
+
+func GetWriteTimeout() time.Duration {
+	return Get().WriteTimeout
+}
+
+func GetIdleTimeout() time.Duration {
+	return Get().IdleTimeout
+}
+
+func GetUnixSocketPath() string {
+	return Get().UnixSocketPath
+}
+
+// GetUnixSocketMode returns the permissions of the unix socket file, as an octal string
+func GetUnixSocketMode() string {
+	return Get().UnixSocketMode
+}
+
+func IsTlsEnabled() bool {
+	return Get().TlsEnabled
+}
+
+func GetTlsCertFile() string {
+	return Get().TlsCertFile
+}
+
+func GetTlsKeyFile() string {
+	return Get().TlsKeyFile
+}
+
+func GetTlsClientCaFile() string {
+	return Get().TlsClientCaFile
+}
+
+func GetTlsClientAuth() string {
+	return Get().TlsClientAuth
+}
+
+func GetTlsMinVersion() string {
+	return Get().TlsMinVersion
+}
+
+// GetShutdownDelay returns the time for which the service reports not-ready before it
+// stops accepting connections, so that it can be removed from load-balancing
+func GetShutdownDelay() time.Duration {
+	return Get().ShutdownDelay
+}
+
+// GetShutdownTimeout returns the maximum time allowed for in-flight requests to complete
+func GetShutdownTimeout() time.Duration {
+	return Get().ShutdownTimeout
 }
 
 func GetUserIdCookieName() string {
-	return appConfig.GetString(keyUserIdCookieName.key)
+	return Get().UserIdCookieName
 }
 
 func GetAuthRptCookieName() string {
-	return appConfig.GetString(keyAuthRptCookieName.key)
+	return Get().AuthRptCookieName
 }
 
 func GetAuthRptCookieMaxAge() int {
-	return appConfig.GetInt(keyAuthRptCookieMaxAge.key)
+	return Get().AuthRptCookieMaxAge
+}
+
+func GetAuthRptCookiePath() string {
+	return Get().AuthRptCookiePath
+}
+
+func GetAuthRptCookieDomain() string {
+	return Get().AuthRptCookieDomain
 }
 
 func GetUnauthorizedResponse() string {
-	return appConfig.GetString(keyUnauthorizedResponse.key)
+	return Get().UnauthorizedResponse
 }
 
 func GetRetriesAuthorizationAttempt() int {
-	return appConfig.GetInt(keyRetriesAuthorizationAttempt.key)
+	return Get().RetriesAuthorizationAttempt
 }
 
 func GetRetriesHttpRequest() int {
-	return appConfig.GetInt(keyRetriesHttpRequest.key)
+	return Get().RetriesHttpRequest
+}
+
+// GetAuthDecisionTimeout returns the deadline for an authorization decision, across all
+// retries and authorization attempts. Zero means no deadline.
+func GetAuthDecisionTimeout() time.Duration {
+	return Get().AuthDecisionTimeout
+}
+
+func GetRetriesBackoffInitial() time.Duration {
+	return Get().RetriesBackoffInitial
+}
+
+func GetRetriesBackoffMax() time.Duration {
+	return Get().RetriesBackoffMax
+}
+
+func GetRetriesBackoffMultiplier() float64 {
+	return Get().RetriesBackoffMultiplier
+}
+
+func GetRetriesBackoffJitter() float64 {
+	return Get().RetriesBackoffJitter
+}
+
+// GetRetriesBudget returns the overall time allowed for the retries of a request
+func GetRetriesBudget() time.Duration {
+	return Get().RetriesBudget
+}
+
+func GetRetriesRetryableStatuses() []int {
+	return Get().RetriesRetryableStatuses
+}
+
+// RetryUpstreamConfig overrides the retry behaviour for requests of an upstream operation.
+// Unset values take the global setting.
+type RetryUpstreamConfig struct {
+	MaxRetries         *int  `mapstructure:"maxRetries"`
+	RetryableStatuses  []int `mapstructure:"retryableStatuses"`
+	RetryNonIdempotent *bool `mapstructure:"retryNonIdempotent"`
+}
+
+// GetRetriesUpstreams returns the retry overrides keyed by (lower-case) operation name
+func GetRetriesUpstreams() map[string]RetryUpstreamConfig {
+	return Get().RetriesUpstreams
+}
+
+// getRetriesUpstreams interprets the retry overrides, keyed by (lower-case) operation name
+func getRetriesUpstreams(v *viper.Viper) (map[string]RetryUpstreamConfig, error) {
+	upstreams := map[string]RetryUpstreamConfig{}
+	if err := v.UnmarshalKey(keyRetriesUpstreams.key, &upstreams); err != nil {
+		return nil, err
+	}
+	lowerCased := make(map[string]RetryUpstreamConfig, len(upstreams))
+	for operation, upstream := range upstreams {
+		lowerCased[strings.ToLower(operation)] = upstream
+	}
+	return lowerCased, nil
 }
 
 func IsOpenAccess() bool {
-	return appConfig.GetBool(keyOpenAccess.key)
+	return Get().OpenAccess
 }
 
 func AllowInsecureTlsSkipVerify() bool {
-	return appConfig.GetBool(keyInsecureTlsSkipVerify.key)
+	return Get().AllowInsecureTlsSkipVerify
+}
+
+func GetOidcIssuer() string {
+	return Get().OidcIssuer
+}
+
+func GetOidcRedirectUrl() string {
+	return Get().OidcRedirectUrl
+}
+
+func GetOidcScopes() string {
+	return Get().OidcScopes
+}
+
+func GetUserIdCookieMaxAge() int {
+	return Get().UserIdCookieMaxAge
+}
+
+func GetUserIdCookieDomain() string {
+	return Get().UserIdCookieDomain
+}
+
+func GetUserIdCookiePath() string {
+	return Get().UserIdCookiePath
+}
+
+func IsUserIdCookieSecure() bool {
+	return Get().UserIdCookieSecure
+}
+
+func GetUserIdCookieSameSite() http.SameSite {
+	return Get().UserIdCookieSameSite
+}
+
+func GetRefreshTokenCookieName() string {
+	return Get().RefreshTokenCookieName
+}
+
+func IsOidcEndSessionRedirect() bool {
+	return Get().OidcEndSessionRedirect
+}
+
+func GetOidcPostLogoutRedirectUrl() string {
+	return Get().OidcPostLogoutRedirectUrl
+}
+
+func GetAuthCacheMaxAge() time.Duration {
+	return Get().AuthCacheMaxAge
+}
+
+func IsAuthRptCookieSealed() bool {
+	return Get().AuthRptCookieSealed
+}
+
+func GetAuthRptCookieKeyFile() string {
+	return Get().AuthRptCookieKeyFile
+}
+
+func IsSessionEnabled() bool {
+	return Get().SessionEnabled
+}
+
+func GetSessionCookieName() string {
+	return Get().SessionCookieName
+}
+
+func GetSessionMaxAge() time.Duration {
+	return Get().SessionMaxAge
+}
+
+func GetSessionStore() string {
+	return Get().SessionStore
+}
+
+func GetSessionFileDir() string {
+	return Get().SessionFileDir
+}
+
+func GetSessionRedisAddress() string {
+	return Get().SessionRedisAddress
+}
+
+func GetSessionRedisPassword() string {
+	return Get().SessionRedisPassword
+}
+
+func GetSessionRedisDatabase() int {
+	return Get().SessionRedisDatabase
+}
+
+func GetSessionRedisKeyPrefix() string {
+	return Get().SessionRedisKeyPrefix
+}
+
+func GetTracingExporter() string {
+	return Get().TracingExporter
+}
+
+func GetTracingServiceName() string {
+	return Get().TracingServiceName
+}
+
+func GetTracingSampleRatio() float64 {
+	return Get().TracingSampleRatio
+}
+
+func GetTracingOtlpEndpoint() string {
+	return Get().TracingOtlpEndpoint
+}
+
+func IsTracingOtlpInsecure() bool {
+	return Get().TracingOtlpInsecure
+}
+
+func GetTracingFile() string {
+	return Get().TracingFile
+}
+
+func GetAuditFilePath() string {
+	return Get().AuditFilePath
+}
+
+// GetAuditFileMaxSize returns the size in bytes at which the audit file is rotated
+func GetAuditFileMaxSize() int64 {
+	return Get().AuditFileMaxSize
+}
+
+func GetAuditFileMaxBackups() int {
+	return Get().AuditFileMaxBackups
+}
+
+func IsAuditFileHashChain() bool {
+	return Get().AuditFileHashChain
+}
+
+func GetAuditSyslogAddress() string {
+	return Get().AuditSyslogAddress
+}
+
+func GetAuditSyslogNetwork() string {
+	return Get().AuditSyslogNetwork
+}
+
+func GetAuditSyslogAppName() string {
+	return Get().AuditSyslogAppName
+}
+
+func GetAuditWebhookUrl() string {
+	return Get().AuditWebhookUrl
+}
+
+func GetAuditWebhookAuthorization() string {
+	return Get().AuditWebhookAuthorization
+}
+
+// GetLoadSheddingMaxInFlight returns the maximum calls in flight to each upstream.
+// Zero means unbounded.
+func GetLoadSheddingMaxInFlight() int {
+	return Get().LoadSheddingMaxInFlight
+}
+
+func GetLoadSheddingMaxQueue() int {
+	return Get().LoadSheddingMaxQueue
+}
+
+func GetLoadSheddingQueueTimeout() time.Duration {
+	return Get().LoadSheddingQueueTimeout
+}
+
+func GetCircuitBreakerFailureThreshold() int {
+	return Get().CircuitBreakerFailureThreshold
+}
+
+func GetCircuitBreakerOpenTimeout() time.Duration {
+	return Get().CircuitBreakerOpenTimeout
+}
+
+func GetCircuitBreakerHalfOpenMaxRequests() int {
+	return Get().CircuitBreakerHalfOpenMaxRequests
+}
+
+// IsCircuitBreakerFailOpen indicates whether requests are allowed (rather than denied)
+// while the circuit to an upstream is open
+func IsCircuitBreakerFailOpen() bool {
+	return Get().CircuitBreakerFailOpen
+}
+
+// GetTrustedProxies returns the address ranges (CIDR) of the proxies whose client IP
+// headers (X-Real-IP, X-Forwarded-For) are trusted
+func GetTrustedProxies() []string {
+	return Get().TrustedProxies
+}
+
+func GetRateLimitPepPerUserRate() float64 {
+	return Get().RateLimitPepPerUserRate
+}
+
+func GetRateLimitPepPerUserBurst() int {
+	return Get().RateLimitPepPerUserBurst
+}
+
+func GetRateLimitPepPerClientIpRate() float64 {
+	return Get().RateLimitPepPerClientIpRate
+}
+
+func GetRateLimitPepPerClientIpBurst() int {
+	return Get().RateLimitPepPerClientIpBurst
+}
+
+func GetRateLimitAsPerUserRate() float64 {
+	return Get().RateLimitAsPerUserRate
+}
+
+func GetRateLimitAsPerUserBurst() int {
+	return Get().RateLimitAsPerUserBurst
+}
+
+func GetRateLimitAsPerClientIpRate() float64 {
+	return Get().RateLimitAsPerClientIpRate
+}
+
+func GetRateLimitAsPerClientIpBurst() int {
+	return Get().RateLimitAsPerClientIpBurst
+}
+
+// IsRegistrationEnabled indicates whether the client registers itself at the Authorization
+// Server (RFC 7591), in the absence of configured client credentials
+func IsRegistrationEnabled() bool {
+	return Get().RegistrationEnabled
+}
+
+func GetRegistrationAuthorizationServer() string {
+	return Get().RegistrationAuthorizationServer
+}
+
+func GetRegistrationInitialAccessToken() string {
+	return Get().RegistrationInitialAccessToken
+}
+
+// GetRegistrationCredentialsFile returns the (writable) file in which the credentials of the
+// registered client are persisted
+func GetRegistrationCredentialsFile() string {
+	return Get().RegistrationCredentialsFile
+}
+
+func GetRegistrationClientName() string {
+	return Get().RegistrationClientName
 }
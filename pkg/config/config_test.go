@@ -0,0 +1,213 @@
+package config_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+)
+
+// TestEnvVarName tests the naming of the environment variables of config keys
+func TestEnvVarName(t *testing.T) {
+	tests := map[string]string{
+		"client-id":                      "UMA_USER_AGENT_CLIENT_ID",
+		"network.listenPort":             "UMA_USER_AGENT_NETWORK_LISTEN_PORT",
+		"rateLimit.pep.perClientIp.rate": "UMA_USER_AGENT_RATE_LIMIT_PEP_PER_CLIENT_IP_RATE",
+		"audit.file.maxSizeMb":           "UMA_USER_AGENT_AUDIT_FILE_MAX_SIZE_MB",
+		"openAccess":                     "UMA_USER_AGENT_OPEN_ACCESS",
+	}
+	for key, expected := range tests {
+		if name := config.EnvVarName(key); name != expected {
+			t.Errorf("EnvVarName(%v) = %v, expected %v", key, name, expected)
+		}
+	}
+}
+
+// TestParseValue tests the interpretation of values according to the type of the default
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		defval   interface{}
+		value    string
+		expected interface{}
+	}{
+		{false, "true", true},
+		{0, "42", 42},
+		{0.0, "0.5", 0.5},
+		{"", "http://pep", "http://pep"},
+		{[]string{}, "10.0.0.0/8, ::1/128", []string{"10.0.0.0/8", "::1/128"}},
+		{[]int{}, "503,504", []int{503, 504}},
+		{map[string]interface{}{}, `{"revokeToken":{"maxRetries":2}}`, map[string]interface{}{"revokeToken": map[string]interface{}{"maxRetries": 2.0}}},
+	}
+	for _, test := range tests {
+		parsed, err := config.ParseValue(test.defval, test.value)
+		if err != nil {
+			t.Errorf("ParseValue(%v): %v", test.value, err)
+		} else if !reflect.DeepEqual(parsed, test.expected) {
+			t.Errorf("ParseValue(%v) = %#v, expected %#v", test.value, parsed, test.expected)
+		}
+	}
+	if _, err := config.ParseValue(0, "ten"); err == nil {
+		t.Error("expected error for bad int")
+	}
+}
+
+// TestValidateDir tests the validation of config files against the schema
+func TestValidateDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(content string) {
+		if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile("pep:\n  url: https://pep.example.com\nlogging:\n  level: debug\n")
+	if warnings, err := config.ValidateDir(dir); err != nil || len(warnings) > 0 {
+		t.Fatalf("expected valid config: %v %v", warnings, err)
+	}
+
+	writeFile("pep:\n  url: pep\nlogging:\n  levle: debug\nretries:\n  httpRequest: -1\ncircuitBreaker:\n  failMode: sometimes\n")
+	warnings, err := config.ValidateDir(dir)
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "logging.levle") {
+		t.Errorf("expected warning of unknown key: %v", warnings)
+	}
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 3 {
+		t.Fatalf("expected 3 problems: %v", err)
+	}
+	for i, key := range []string{"pep.url", "retries.httpRequest", "circuitBreaker.failMode"} {
+		if !strings.HasPrefix(validationErr.Problems[i], key) {
+			t.Errorf("unexpected problem: %v", validationErr.Problems[i])
+		}
+	}
+
+	writeFile("registration:\n  enabled: true\n")
+	if _, err = config.ValidateDir(dir); !errors.As(err, &validationErr) || len(validationErr.Problems) != 1 ||
+		!strings.HasPrefix(validationErr.Problems[0], "registration.authorizationServer") {
+		t.Errorf("expected the Authorization Server to be required for registration: %v", err)
+	}
+}
+
+// TestSnapshot tests that each snapshot is internally consistent while the configuration
+// is changed concurrently - for use with the race detector
+func TestSnapshot(t *testing.T) {
+	setConfig := func(i int) {
+		args := []string{fmt.Sprintf("--client-id=client-%d", i), fmt.Sprintf("--pep.url=https://pep-%d", i)}
+		if err := config.ParseFlags("test", args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setConfig(0)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cfg := config.Get()
+				if suffix := strings.TrimPrefix(cfg.PepUrl, "https://pep-"); suffix != strings.TrimPrefix(cfg.ClientId, "client-") {
+					t.Errorf("inconsistent snapshot: %v %v", cfg.PepUrl, cfg.ClientId)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i < 50; i++ {
+		setConfig(i)
+	}
+	close(stop)
+	wg.Wait()
+
+	cfg := config.Get()
+	if config.FromContext(config.NewContext(context.Background(), cfg)) != cfg {
+		t.Error("expected the snapshot from the context")
+	}
+	if config.GetPepUrl() != "https://pep-49" || cfg.ClientId != "client-49" {
+		t.Errorf("unexpected final config: %v %v", cfg.PepUrl, cfg.ClientId)
+	}
+}
+
+// TestClientSecretFile tests the rotation of the client secret read from file
+func TestClientSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client-secret")
+	setSecret := func(secret string) {
+		if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.ParseFlags("test", []string{"--client-id=rotating", "--client-secret-file=" + path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setSecret("old-secret")
+	if cfg := config.Get(); cfg.ClientSecret != "old-secret" || len(cfg.PreviousClientSecret) > 0 {
+		t.Fatalf("unexpected secrets: %v %v", cfg.ClientSecret, cfg.PreviousClientSecret)
+	}
+	setSecret("new-secret")
+	if cfg := config.Get(); cfg.ClientSecret != "new-secret" || cfg.PreviousClientSecret != "old-secret" {
+		t.Fatalf("expected the old secret to be retained: %v %v", cfg.ClientSecret, cfg.PreviousClientSecret)
+	}
+
+	// Acceptance of the old secret does not complete the rotation
+	config.ClientSecretAccepted("old-secret")
+	if config.GetPreviousClientSecret() != "old-secret" {
+		t.Error("expected the old secret to be retained")
+	}
+	config.ClientSecretAccepted("new-secret")
+	if config.GetPreviousClientSecret() != "" || config.GetClientSecret() != "new-secret" {
+		t.Errorf("expected the old secret to be dropped: %v", config.GetPreviousClientSecret())
+	}
+
+	// The last good secret is kept if the file cannot be read
+	os.Remove(path)
+	if err := config.ParseFlags("test", []string{"--client-id=rotating", "--client-secret-file=" + path}); err != nil {
+		t.Fatal(err)
+	}
+	if config.GetClientSecret() != "new-secret" {
+		t.Errorf("expected the last good secret: %v", config.GetClientSecret())
+	}
+}
+
+// TestAuthServerClients tests the selection of the client by Authorization Server
+func TestAuthServerClients(t *testing.T) {
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		`--authorization-servers={"https://AS.example.org/realms/eo/": {"client-id": "federated", "client-secret": "federated-secret", "auth-method": "client_secret_basic"}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Get()
+	if client, specific := cfg.GetAuthServerClient("https://as.example.org/realms/eo"); !specific ||
+		client.ClientId != "federated" || client.ClientSecret != "federated-secret" || client.AuthMethod != config.AuthMethodClientSecretBasic {
+		t.Errorf("unexpected client for the configured Authorization Server: %+v", client)
+	}
+	if client, specific := cfg.GetAuthServerClient("https://other.example.org"); specific ||
+		client.ClientId != "global" || client.ClientSecret != "global-secret" || client.AuthMethod != config.AuthMethodClientSecretPost {
+		t.Errorf("expected the global client for another Authorization Server: %+v", client)
+	}
+	settings := config.GetRedactedSettings()["authorization-servers"].(map[string]interface{})
+	if client := settings["https://as.example.org/realms/eo"].(map[string]interface{}); client["client-secret"] != "[redacted]" {
+		t.Errorf("expected the client secret to be redacted: %v", client)
+	}
+
+	// An unknown auth method is rejected
+	err = config.ParseFlags("test", []string{`--authorization-servers={"https://as.example.org": {"client-id": "a", "client-secret": "b", "auth-method": "private_key_jwt"}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, specific := config.Get().GetAuthServerClient("https://as.example.org"); specific {
+		t.Error("expected the client with an unknown auth method to be ignored")
+	}
+}
@@ -1,6 +1,11 @@
 package config
 
 import (
+	"fmt"
+	"sync"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/EOEPCA/uma-user-agent/pkg/redact"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,10 +26,54 @@ func initLogger() {
 	logFormatter.TimestampFormat = "2006-01-02 15:04:05.000"
 	logrus.SetFormatter(logFormatter)
 	logFormatter.FullTimestamp = true
+	// redact tokens and secrets from all log output
+	logrus.AddHook(redact.NewHook())
 	// config change handler
 	AddConfigChangeHandler(updateLoggerConfig)
 }
 
 func updateLoggerConfig() {
 	logrus.SetLevel(GetLogLevel())
+
+	// log format
+	logFormatter, err := logging.NewFormatter(GetLogFormat(), GetLogFieldNames())
+	if err != nil {
+		logrus.Warning(fmt.Sprintf("Bad log format: %v, using default text format", err))
+		logFormatter, _ = logging.NewFormatter(logging.FormatText, "")
+	}
+	logrus.SetFormatter(logFormatter)
+
+	// secrets from config that must not appear in logs
+	for key, getSecret := range secretSettings {
+		redact.SetSecret(key, getSecret())
+	}
+	authServerSecrets.mutex.Lock()
+	for _, name := range authServerSecrets.names {
+		redact.SetSecret(name, "")
+	}
+	authServerSecrets.names = authServerSecrets.names[:0]
+	for issuer, client := range Get().AuthServerClients {
+		name := keyAuthorizationServers.key + "." + issuer + ".client-secret"
+		redact.SetSecret(name, client.ClientSecret)
+		authServerSecrets.names = append(authServerSecrets.names, name)
+	}
+	authServerSecrets.mutex.Unlock()
+}
+
+// authServerSecrets are the names of the redacted secrets of the clients of specific
+// Authorization Servers
+var authServerSecrets = struct {
+	mutex sync.Mutex
+	names []string
+}{}
+
+// secretSettings are the settings whose values are secret, which are redacted from logs and
+// from the effective config
+var secretSettings = map[string]func() string{
+	keyClientSecret.key:                   GetClientSecret,
+	"client-secret-previous":              GetPreviousClientSecret,
+	keySessionRedisPassword.key:           GetSessionRedisPassword,
+	keyAuditWebhookAuthorization.key:      GetAuditWebhookAuthorization,
+	keyAdminBearerToken.key:               GetAdminBearerToken,
+	keyRegistrationInitialAccessToken.key: GetRegistrationInitialAccessToken,
 }
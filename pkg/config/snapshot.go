@@ -0,0 +1,382 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Config is an immutable snapshot of the configuration, compiled from the config sources
+// (defaults, files, env and flags) - which is swapped atomically on change. Each request
+// should use a single snapshot, so that its decisions are consistent.
+// The snapshot must not be modified.
+type Config struct {
+	ClientId                          string
+	ClientSecret                      string
+	ClientSecretFile                  string
+	PreviousClientSecret              string
+	ClientRegistered                  bool
+	AuthServerClients                 map[string]AuthServerClient
+	HttpTimeout                       time.Duration
+	LogFormat                         string
+	LogFieldNames                     string
+	AdminListenPort                   int
+	AdminBearerToken                  string
+	AdminTlsEnabled                   bool
+	AdminTlsClientCaFile              string
+	ReadinessCheckUpstreams           bool
+	ReadinessInterval                 time.Duration
+	ReadinessAuthorizationServers     []string
+	MetricsRoutes                     []string
+	PepUrl                            string
+	ListenPort                        int
+	ReadTimeout                       time.Duration
+	ReadHeaderTimeout                 time.Duration
+	WriteTimeout                      time.Duration
+	IdleTimeout                       time.Duration
+	UnixSocketPath                    string
+	UnixSocketMode                    string
+	TlsEnabled                        bool
+	TlsCertFile                       string
+	TlsKeyFile                        string
+	TlsClientCaFile                   string
+	TlsClientAuth                     string
+	TlsMinVersion                     string
+	ShutdownDelay                     time.Duration
+	ShutdownTimeout                   time.Duration
+	UserIdCookieName                  string
+	AuthRptCookieName                 string
+	AuthRptCookieMaxAge               int
+	AuthRptCookiePath                 string
+	AuthRptCookieDomain               string
+	UnauthorizedResponse              string
+	RetriesAuthorizationAttempt       int
+	RetriesHttpRequest                int
+	AuthDecisionTimeout               time.Duration
+	RetriesBackoffInitial             time.Duration
+	RetriesBackoffMax                 time.Duration
+	RetriesBackoffMultiplier          float64
+	RetriesBackoffJitter              float64
+	RetriesBudget                     time.Duration
+	RetriesRetryableStatuses          []int
+	OpenAccess                        bool
+	AllowInsecureTlsSkipVerify        bool
+	OidcIssuer                        string
+	OidcRedirectUrl                   string
+	OidcScopes                        string
+	UserIdCookieMaxAge                int
+	UserIdCookieDomain                string
+	UserIdCookiePath                  string
+	UserIdCookieSecure                bool
+	RefreshTokenCookieName            string
+	OidcEndSessionRedirect            bool
+	OidcPostLogoutRedirectUrl         string
+	AuthCacheMaxAge                   time.Duration
+	AuthRptCookieSealed               bool
+	AuthRptCookieKeyFile              string
+	SessionEnabled                    bool
+	SessionCookieName                 string
+	SessionMaxAge                     time.Duration
+	SessionStore                      string
+	SessionFileDir                    string
+	SessionRedisAddress               string
+	SessionRedisPassword              string
+	SessionRedisDatabase              int
+	SessionRedisKeyPrefix             string
+	TracingExporter                   string
+	TracingServiceName                string
+	TracingSampleRatio                float64
+	TracingOtlpEndpoint               string
+	TracingOtlpInsecure               bool
+	TracingFile                       string
+	AuditFilePath                     string
+	AuditFileMaxSize                  int64
+	AuditFileMaxBackups               int
+	AuditFileHashChain                bool
+	AuditSyslogAddress                string
+	AuditSyslogNetwork                string
+	AuditSyslogAppName                string
+	AuditWebhookUrl                   string
+	AuditWebhookAuthorization         string
+	LoadSheddingMaxInFlight           int
+	LoadSheddingMaxQueue              int
+	LoadSheddingQueueTimeout          time.Duration
+	CircuitBreakerFailureThreshold    int
+	CircuitBreakerOpenTimeout         time.Duration
+	CircuitBreakerHalfOpenMaxRequests int
+	CircuitBreakerFailOpen            bool
+	TrustedProxies                    []string
+	RateLimitPepPerUserRate           float64
+	RateLimitPepPerUserBurst          int
+	RateLimitPepPerClientIpRate       float64
+	RateLimitPepPerClientIpBurst      int
+	RateLimitAsPerUserRate            float64
+	RateLimitAsPerUserBurst           int
+	RateLimitAsPerClientIpRate        float64
+	RateLimitAsPerClientIpBurst       int
+	RegistrationEnabled               bool
+	RegistrationAuthorizationServer   string
+	RegistrationInitialAccessToken    string
+	RegistrationCredentialsFile       string
+	RegistrationClientName            string
+	LogLevel                          logrus.Level
+	RetriesUpstreams                  map[string]RetryUpstreamConfig
+	UserIdCookieSameSite              http.SameSite
+
+	checksum         string
+	redactedSettings []byte
+}
+
+// current is the snapshot of the configuration in effect
+var current atomic.Pointer[Config]
+
+// Get returns the snapshot of the configuration in effect
+func Get() *Config {
+	if cfg := current.Load(); cfg != nil {
+		return cfg
+	}
+	// Not yet initialised
+	return &Config{}
+}
+
+// IsReady indicates whether client credentials are configured - either the global client
+// credentials or those of specific Authorization Servers - unless open access
+func (cfg *Config) IsReady() bool {
+	return (len(cfg.ClientId) > 0 && len(cfg.ClientSecret) > 0) || len(cfg.AuthServerClients) > 0 || cfg.OpenAccess
+}
+
+//------------------------------------------------------------------------------
+
+type contextKey struct{}
+
+// NewContext returns a context that carries the config snapshot
+func NewContext(ctx context.Context, cfg *Config) context.Context {
+	return context.WithValue(ctx, contextKey{}, cfg)
+}
+
+// FromContext returns the config snapshot carried by the context - or else the snapshot
+// in effect
+func FromContext(ctx context.Context) *Config {
+	if cfg, ok := ctx.Value(contextKey{}).(*Config); ok {
+		return cfg
+	}
+	return Get()
+}
+
+//------------------------------------------------------------------------------
+
+// compile compiles the snapshot from the client and application config
+func compile(client *viper.Viper, app *viper.Viper) *Config {
+	cfg := &Config{}
+	cfg.ClientId = client.GetString(keyClientId.key)
+	cfg.ClientSecret = client.GetString(keyClientSecret.key)
+	cfg.ClientSecretFile = client.GetString(keyClientSecretFile.key)
+	authServerClients, err := getAuthServerClients(client)
+	if err != nil {
+		logrus.Warn(fmt.Sprintf("Bad authorization-servers config: %v, using the client credentials for all", err))
+		authServerClients = map[string]AuthServerClient{}
+	}
+	cfg.AuthServerClients = authServerClients
+	cfg.HttpTimeout = time.Second * time.Duration(app.GetInt(keyHttpTimeout.key))
+	cfg.LogFormat = app.GetString(keyLoggingFormat.key)
+	cfg.LogFieldNames = app.GetString(keyLoggingFieldNames.key)
+	cfg.AdminListenPort = app.GetInt(keyAdminListenPort.key)
+	cfg.AdminBearerToken = app.GetString(keyAdminBearerToken.key)
+	cfg.AdminTlsEnabled = app.GetBool(keyAdminTlsEnabled.key)
+	cfg.AdminTlsClientCaFile = app.GetString(keyAdminTlsClientCaFile.key)
+	cfg.ReadinessCheckUpstreams = app.GetBool(keyReadinessCheckUpstreams.key)
+	cfg.ReadinessInterval = time.Second * time.Duration(app.GetInt(keyReadinessInterval.key))
+	cfg.ReadinessAuthorizationServers = app.GetStringSlice(keyReadinessAuthorizationServers.key)
+	cfg.MetricsRoutes = app.GetStringSlice(keyMetricsRoutes.key)
+	cfg.PepUrl = app.GetString(keyPepUrl.key)
+	cfg.ListenPort = app.GetInt(keyListenPort.key)
+	cfg.ReadTimeout = time.Second * time.Duration(app.GetInt(keyReadTimeout.key))
+	cfg.ReadHeaderTimeout = time.Second * time.Duration(app.GetInt(keyReadHeaderTimeout.key))
+	cfg.WriteTimeout = time.Second * time.Duration(app.GetInt(keyWriteTimeout.key))
+	cfg.IdleTimeout = time.Second * time.Duration(app.GetInt(keyIdleTimeout.key))
+	cfg.UnixSocketPath = app.GetString(keyUnixSocketPath.key)
+	cfg.UnixSocketMode = app.GetString(keyUnixSocketMode.key)
+	cfg.TlsEnabled = app.GetBool(keyTlsEnabled.key)
+	cfg.TlsCertFile = app.GetString(keyTlsCertFile.key)
+	cfg.TlsKeyFile = app.GetString(keyTlsKeyFile.key)
+	cfg.TlsClientCaFile = app.GetString(keyTlsClientCaFile.key)
+	cfg.TlsClientAuth = app.GetString(keyTlsClientAuth.key)
+	cfg.TlsMinVersion = app.GetString(keyTlsMinVersion.key)
+	cfg.ShutdownDelay = time.Second * time.Duration(app.GetInt(keyShutdownDelay.key))
+	cfg.ShutdownTimeout = time.Second * time.Duration(app.GetInt(keyShutdownTimeout.key))
+	cfg.UserIdCookieName = app.GetString(keyUserIdCookieName.key)
+	cfg.AuthRptCookieName = app.GetString(keyAuthRptCookieName.key)
+	cfg.AuthRptCookieMaxAge = app.GetInt(keyAuthRptCookieMaxAge.key)
+	cfg.AuthRptCookiePath = app.GetString(keyAuthRptCookiePath.key)
+	cfg.AuthRptCookieDomain = app.GetString(keyAuthRptCookieDomain.key)
+	cfg.UnauthorizedResponse = app.GetString(keyUnauthorizedResponse.key)
+	cfg.RetriesAuthorizationAttempt = app.GetInt(keyRetriesAuthorizationAttempt.key)
+	cfg.RetriesHttpRequest = app.GetInt(keyRetriesHttpRequest.key)
+	cfg.AuthDecisionTimeout = time.Second * time.Duration(app.GetInt(keyAuthDecisionTimeout.key))
+	cfg.RetriesBackoffInitial = time.Millisecond * time.Duration(app.GetInt(keyRetriesBackoffInitial.key))
+	cfg.RetriesBackoffMax = time.Millisecond * time.Duration(app.GetInt(keyRetriesBackoffMax.key))
+	cfg.RetriesBackoffMultiplier = app.GetFloat64(keyRetriesBackoffMultiplier.key)
+	cfg.RetriesBackoffJitter = app.GetFloat64(keyRetriesBackoffJitter.key)
+	cfg.RetriesBudget = time.Second * time.Duration(app.GetInt(keyRetriesBudget.key))
+	cfg.RetriesRetryableStatuses = app.GetIntSlice(keyRetriesRetryableStatuses.key)
+	cfg.OpenAccess = app.GetBool(keyOpenAccess.key)
+	cfg.AllowInsecureTlsSkipVerify = app.GetBool(keyInsecureTlsSkipVerify.key)
+	cfg.OidcIssuer = app.GetString(keyOidcIssuer.key)
+	cfg.OidcRedirectUrl = app.GetString(keyOidcRedirectUrl.key)
+	cfg.OidcScopes = app.GetString(keyOidcScopes.key)
+	cfg.UserIdCookieMaxAge = app.GetInt(keyUserIdCookieMaxAge.key)
+	cfg.UserIdCookieDomain = app.GetString(keyUserIdCookieDomain.key)
+	cfg.UserIdCookiePath = app.GetString(keyUserIdCookiePath.key)
+	cfg.UserIdCookieSecure = app.GetBool(keyUserIdCookieSecure.key)
+	cfg.RefreshTokenCookieName = app.GetString(keyRefreshTokenCookieName.key)
+	cfg.OidcEndSessionRedirect = app.GetBool(keyOidcEndSessionRedirect.key)
+	cfg.OidcPostLogoutRedirectUrl = app.GetString(keyOidcPostLogoutRedirectUrl.key)
+	cfg.AuthCacheMaxAge = time.Second * time.Duration(app.GetInt(keyAuthCacheMaxAge.key))
+	cfg.AuthRptCookieSealed = app.GetBool(keyAuthRptCookieSealed.key)
+	cfg.AuthRptCookieKeyFile = app.GetString(keyAuthRptCookieKeyFile.key)
+	cfg.SessionEnabled = app.GetBool(keySessionEnabled.key)
+	cfg.SessionCookieName = app.GetString(keySessionCookieName.key)
+	cfg.SessionMaxAge = time.Second * time.Duration(app.GetInt(keySessionMaxAge.key))
+	cfg.SessionStore = strings.ToLower(app.GetString(keySessionStore.key))
+	cfg.SessionFileDir = app.GetString(keySessionFileDir.key)
+	cfg.SessionRedisAddress = app.GetString(keySessionRedisAddress.key)
+	cfg.SessionRedisPassword = app.GetString(keySessionRedisPassword.key)
+	cfg.SessionRedisDatabase = app.GetInt(keySessionRedisDatabase.key)
+	cfg.SessionRedisKeyPrefix = app.GetString(keySessionRedisKeyPrefix.key)
+	cfg.TracingExporter = strings.ToLower(app.GetString(keyTracingExporter.key))
+	cfg.TracingServiceName = app.GetString(keyTracingServiceName.key)
+	cfg.TracingSampleRatio = app.GetFloat64(keyTracingSampleRatio.key)
+	cfg.TracingOtlpEndpoint = app.GetString(keyTracingOtlpEndpoint.key)
+	cfg.TracingOtlpInsecure = app.GetBool(keyTracingOtlpInsecure.key)
+	cfg.TracingFile = app.GetString(keyTracingFile.key)
+	cfg.AuditFilePath = app.GetString(keyAuditFilePath.key)
+	cfg.AuditFileMaxSize = int64(app.GetInt(keyAuditFileMaxSizeMb.key)) * 1024 * 1024
+	cfg.AuditFileMaxBackups = app.GetInt(keyAuditFileMaxBackups.key)
+	cfg.AuditFileHashChain = app.GetBool(keyAuditFileHashChain.key)
+	cfg.AuditSyslogAddress = app.GetString(keyAuditSyslogAddress.key)
+	cfg.AuditSyslogNetwork = strings.ToLower(app.GetString(keyAuditSyslogNetwork.key))
+	cfg.AuditSyslogAppName = app.GetString(keyAuditSyslogAppName.key)
+	cfg.AuditWebhookUrl = app.GetString(keyAuditWebhookUrl.key)
+	cfg.AuditWebhookAuthorization = app.GetString(keyAuditWebhookAuthorization.key)
+	cfg.LoadSheddingMaxInFlight = app.GetInt(keyLoadSheddingMaxInFlight.key)
+	cfg.LoadSheddingMaxQueue = app.GetInt(keyLoadSheddingMaxQueue.key)
+	cfg.LoadSheddingQueueTimeout = time.Millisecond * time.Duration(app.GetInt(keyLoadSheddingQueueTimeout.key))
+	cfg.CircuitBreakerFailureThreshold = app.GetInt(keyCircuitBreakerFailureThreshold.key)
+	cfg.CircuitBreakerOpenTimeout = time.Second * time.Duration(app.GetInt(keyCircuitBreakerOpenTimeout.key))
+	cfg.CircuitBreakerHalfOpenMaxRequests = app.GetInt(keyCircuitBreakerHalfOpenMaxRequests.key)
+	cfg.CircuitBreakerFailOpen = strings.ToLower(app.GetString(keyCircuitBreakerFailMode.key)) == "open"
+	cfg.TrustedProxies = app.GetStringSlice(keyTrustedProxies.key)
+	cfg.RateLimitPepPerUserRate = app.GetFloat64(keyRateLimitPepPerUserRate.key)
+	cfg.RateLimitPepPerUserBurst = app.GetInt(keyRateLimitPepPerUserBurst.key)
+	cfg.RateLimitPepPerClientIpRate = app.GetFloat64(keyRateLimitPepPerClientIpRate.key)
+	cfg.RateLimitPepPerClientIpBurst = app.GetInt(keyRateLimitPepPerClientIpBurst.key)
+	cfg.RateLimitAsPerUserRate = app.GetFloat64(keyRateLimitAsPerUserRate.key)
+	cfg.RateLimitAsPerUserBurst = app.GetInt(keyRateLimitAsPerUserBurst.key)
+	cfg.RateLimitAsPerClientIpRate = app.GetFloat64(keyRateLimitAsPerClientIpRate.key)
+	cfg.RateLimitAsPerClientIpBurst = app.GetInt(keyRateLimitAsPerClientIpBurst.key)
+	cfg.RegistrationEnabled = app.GetBool(keyRegistrationEnabled.key)
+	cfg.RegistrationAuthorizationServer = app.GetString(keyRegistrationAuthorizationServer.key)
+	cfg.RegistrationInitialAccessToken = app.GetString(keyRegistrationInitialAccessToken.key)
+	cfg.RegistrationCredentialsFile = app.GetString(keyRegistrationCredentialsFile.key)
+	cfg.RegistrationClientName = app.GetString(keyRegistrationClientName.key)
+
+	// Log level
+	cfg.LogLevel = logrus.InfoLevel
+	if level, ok := keyLoggingLevel.defval.(logrus.Level); ok {
+		cfg.LogLevel = level
+	}
+	if level, err := logrus.ParseLevel(app.GetString(keyLoggingLevel.key)); err != nil {
+		logrus.Warning(fmt.Sprintf("Bad log level '%v' specified, using default '%v'", app.GetString(keyLoggingLevel.key), cfg.LogLevel.String()))
+	} else {
+		cfg.LogLevel = level
+	}
+
+	// Retry overrides
+	upstreams, err := getRetriesUpstreams(app)
+	if err != nil {
+		logrus.Warn(fmt.Sprintf("Bad retries.upstreams config: %v, using defaults", err))
+		upstreams = map[string]RetryUpstreamConfig{}
+	}
+	cfg.RetriesUpstreams = upstreams
+
+	// Cookie SameSite
+	switch strings.ToLower(app.GetString(keyUserIdCookieSameSite.key)) {
+	case "strict":
+		cfg.UserIdCookieSameSite = http.SameSiteStrictMode
+	case "none":
+		cfg.UserIdCookieSameSite = http.SameSiteNoneMode
+	default:
+		cfg.UserIdCookieSameSite = http.SameSiteLaxMode
+	}
+
+	// Checksum - excluding the client credentials, other than the client IDs
+	authServerClientIds := map[string]string{}
+	for issuer, authServerClient := range cfg.AuthServerClients {
+		authServerClientIds[issuer] = authServerClient.ClientId
+	}
+	if data, err := json.Marshal(map[string]interface{}{"app": app.AllSettings(), "clientId": cfg.ClientId, "authServerClientIds": authServerClientIds}); err == nil {
+		hash := sha256.Sum256(data)
+		cfg.checksum = hex.EncodeToString(hash[:])
+	}
+
+	// Effective settings, with secrets redacted
+	settings := app.AllSettings()
+	for key, value := range client.AllSettings() {
+		settings[key] = value
+	}
+	for key := range secretSettings {
+		redactSetting(settings, strings.Split(strings.ToLower(key), "."))
+	}
+	// The issuers are not split into nested settings at their dots
+	authServerSettings := map[string]interface{}{}
+	for issuer, authServerClient := range cfg.AuthServerClients {
+		authServerSettings[issuer] = map[string]interface{}{
+			"client-id":     authServerClient.ClientId,
+			"client-secret": "[redacted]",
+			"auth-method":   authServerClient.AuthMethod,
+		}
+	}
+	settings[keyAuthorizationServers.key] = authServerSettings
+	cfg.redactedSettings, _ = json.Marshal(settings)
+
+	return cfg
+}
+
+// GetChecksum returns a checksum of the configuration in effect, to identify it
+func GetChecksum() string {
+	return Get().checksum
+}
+
+// GetRedactedSettings returns the configuration in effect (client and application) with
+// the values of secret settings redacted
+func GetRedactedSettings() map[string]interface{} {
+	settings := map[string]interface{}{}
+	json.Unmarshal(Get().redactedSettings, &settings)
+	return settings
+}
+
+// redactSetting replaces the (non-empty) value at the path within the nested settings
+func redactSetting(settings map[string]interface{}, path []string) {
+	value, ok := settings[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) > 1 {
+		if nested, ok := value.(map[string]interface{}); ok {
+			redactSetting(nested, path[1:])
+		}
+		return
+	}
+	if value != nil && fmt.Sprint(value) != "" {
+		settings[path[0]] = "[redacted]"
+	}
+}
@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/authcache"
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/oidc"
+	"github.com/EOEPCA/uma-user-agent/pkg/redact"
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// NewAdminRouter registers the handlers of the admin API, for operators. The router must be
+// served only on the admin listener - never exposed via nginx.
+func NewAdminRouter(router *mux.Router) *mux.Router {
+	router.Use(adminAuthMiddleware)
+
+	// Decision cache (with RPTs)
+	router.Path("/cache/decisions").Methods(http.MethodGet).HandlerFunc(adminListDecisions)
+	router.Path("/cache/decisions").Methods(http.MethodDelete).HandlerFunc(adminFlushDecisions)
+
+	// RPTs held in sessions
+	router.Path("/cache/rpts").Methods(http.MethodGet).HandlerFunc(adminListSessionRpts)
+	router.Path("/cache/rpts").Methods(http.MethodDelete).HandlerFunc(adminFlushSessionRpts)
+
+	// Authorization Servers
+	router.Path("/authorization-servers").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJson(w, uma.AuthorizationServers.Urls())
+	})
+	router.Path("/authorization-servers").Methods(http.MethodDelete).HandlerFunc(adminEvictAuthorizationServers)
+
+	// Detailed status
+	router.Path("/status").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJson(w, getStatus())
+	})
+	router.Path("/status/breakers").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJson(w, getBreakerStates())
+	})
+
+	// Effective config
+	router.Path("/config").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJson(w, config.GetRedactedSettings())
+	})
+
+	// Log level
+	router.Path("/log-level").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJson(w, map[string]string{"level": logrus.GetLevel().String()})
+	})
+	router.Path("/log-level").Methods(http.MethodPut).HandlerFunc(adminSetLogLevel)
+
+	// Metrics
+	router.Path("/metrics").Methods(http.MethodGet).Handler(metrics.Handler())
+
+	// Profiling
+	router.Path("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
+	router.Path("/debug/pprof/profile").HandlerFunc(pprof.Profile)
+	router.Path("/debug/pprof/symbol").HandlerFunc(pprof.Symbol)
+	router.Path("/debug/pprof/trace").HandlerFunc(pprof.Trace)
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	return router
+}
+
+// adminAuthMiddleware requires the configured bearer token - or else, in its absence, a
+// verified client certificate
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := config.GetAdminBearerToken(); len(token) > 0 {
+			// The scheme is required - a raw token is not accepted
+			authorization := r.Header.Get("Authorization")
+			presented := strings.TrimPrefix(authorization, "Bearer ")
+			if presented == authorization || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				logrus.Warnf("Admin API: rejected unauthorized request from %v: %v %v", r.RemoteAddr, r.Method, r.URL.Path)
+				w.Header().Set("Www-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, "ERROR: valid bearer token required")
+				return
+			}
+		} else if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			logrus.Warnf("Admin API: rejected request without credentials from %v: %v %v", r.RemoteAddr, r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "ERROR: the admin API requires a bearer token or client certificate to be configured")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// adminDecision is the representation of a cached decision, without the tokens
+type adminDecision struct {
+	UserId        string    `json:"userId"`
+	IdToken       string    `json:"idToken"`
+	ResourcePath  string    `json:"resourcePath"`
+	RequestMethod string    `json:"requestMethod"`
+	Rpt           string    `json:"rpt"`
+	Expiry        time.Time `json:"expiry"`
+}
+
+// adminListDecisions lists the cached decisions - of the user, if specified
+func adminListDecisions(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	decisions := []adminDecision{}
+	for _, entry := range authcache.Decisions.Entries() {
+		if len(user) > 0 && entry.UserID != user {
+			continue
+		}
+		idTokenHash := entry.IDTokenHash
+		if len(idTokenHash) > 12 {
+			idTokenHash = idTokenHash[:12]
+		}
+		decisions = append(decisions, adminDecision{
+			UserId:        entry.UserID,
+			IdToken:       "sha256:" + idTokenHash,
+			ResourcePath:  entry.ResourcePath,
+			RequestMethod: entry.RequestMethod,
+			Rpt:           redact.Token(entry.Rpt),
+			Expiry:        entry.Expiry,
+		})
+	}
+	sort.Slice(decisions, func(i, j int) bool {
+		if decisions[i].UserId != decisions[j].UserId {
+			return decisions[i].UserId < decisions[j].UserId
+		}
+		return decisions[i].ResourcePath < decisions[j].ResourcePath
+	})
+	writeAdminJson(w, decisions)
+}
+
+// adminFlushDecisions flushes the cached decisions - of the user, if specified, else all
+func adminFlushDecisions(w http.ResponseWriter, r *http.Request) {
+	var count int
+	if user := r.URL.Query().Get("user"); len(user) > 0 {
+		count = authcache.Decisions.DeleteUser(user, "")
+		logrus.Infof("Admin API: flushed %d cached decisions of user %v", count, user)
+	} else {
+		count = authcache.Decisions.Clear()
+		logrus.Infof("Admin API: flushed all %d cached decisions", count)
+	}
+	writeAdminJson(w, map[string]int{"deleted": count})
+}
+
+// adminSessionRpt is the representation of an RPT held in a session, without the token
+type adminSessionRpt struct {
+	UserId     string    `json:"userId"`
+	AuthServer string    `json:"authServer"`
+	Resource   string    `json:"resource"`
+	Rpt        string    `json:"rpt"`
+	Updated    time.Time `json:"updated"`
+}
+
+// getAdminSessionStore returns the session store - which is nil if sessions are not enabled
+func getAdminSessionStore(w http.ResponseWriter) (store session.Store, ok bool) {
+	cfg := config.Get()
+	if !cfg.SessionEnabled {
+		return nil, true
+	}
+	store, err := getSessionStore(cfg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "ERROR: could not access the session store: %v", err)
+		return nil, false
+	}
+	return store, true
+}
+
+// getSessionUser returns the `sub` of the User ID Token of the session, which was validated
+// at login
+func getSessionUser(s session.Session) string {
+	claims, _ := oidc.ParseIdTokenClaims(s.IdToken)
+	return claims.Subject
+}
+
+// adminListSessionRpts lists the RPTs held in sessions - of the user, if specified
+func adminListSessionRpts(w http.ResponseWriter, r *http.Request) {
+	store, ok := getAdminSessionStore(w)
+	if !ok {
+		return
+	}
+	user := r.URL.Query().Get("user")
+	rpts := []adminSessionRpt{}
+	if store != nil {
+		err := store.Range(func(s session.Session) {
+			userId := getSessionUser(s)
+			if len(user) > 0 && userId != user {
+				return
+			}
+			for _, rpt := range s.Rpts {
+				rpts = append(rpts, adminSessionRpt{
+					UserId:     userId,
+					AuthServer: rpt.AuthServer,
+					Resource:   rpt.Resource,
+					Rpt:        redact.Token(rpt.Value),
+					Updated:    rpt.Updated,
+				})
+			}
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "ERROR: could not list the sessions: %v", err)
+			return
+		}
+	}
+	sort.Slice(rpts, func(i, j int) bool {
+		if rpts[i].UserId != rpts[j].UserId {
+			return rpts[i].UserId < rpts[j].UserId
+		}
+		return rpts[i].Resource < rpts[j].Resource
+	})
+	writeAdminJson(w, rpts)
+}
+
+// adminFlushSessionRpts removes the RPTs held in sessions - of the user, if specified, else
+// all - so that fresh RPTs are obtained. The sessions themselves remain.
+func adminFlushSessionRpts(w http.ResponseWriter, r *http.Request) {
+	store, ok := getAdminSessionStore(w)
+	if !ok {
+		return
+	}
+	count := 0
+	if store != nil {
+		user := r.URL.Query().Get("user")
+		var err error
+		count, err = store.ClearRpts(func(s session.Session) bool {
+			return len(user) == 0 || getSessionUser(s) == user
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "ERROR: could not flush the RPTs: %v", err)
+			return
+		}
+		if len(user) > 0 {
+			logrus.Infof("Admin API: flushed %d session RPTs of user %v", count, user)
+		} else {
+			logrus.Infof("Admin API: flushed all %d session RPTs", count)
+		}
+	}
+	writeAdminJson(w, map[string]int{"deleted": count})
+}
+
+// adminEvictAuthorizationServers evicts the Authorization Server, if specified, else all -
+// so that their UMA configuration is re-discovered on next use
+func adminEvictAuthorizationServers(w http.ResponseWriter, r *http.Request) {
+	urls := uma.AuthorizationServers.Urls()
+	if url := r.URL.Query().Get("url"); len(url) > 0 {
+		urls = []string{url}
+	}
+	count := 0
+	for _, url := range urls {
+		if _, loaded := uma.AuthorizationServers.LoadAndDelete(url); loaded {
+			logrus.Infof("Admin API: evicted Authorization Server %v", url)
+			count++
+		}
+	}
+	writeAdminJson(w, map[string]int{"deleted": count})
+}
+
+// adminSetLogLevel changes the log level - until the next change of configuration
+func adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Level string `json:"level"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "ERROR: could not interpret request body: %v", err)
+		return
+	}
+	level, err := logrus.ParseLevel(body.Level)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "ERROR: %v", err)
+		return
+	}
+	logrus.SetLevel(level)
+	logrus.Warnf("Admin API: log level changed to %v", level)
+	writeAdminJson(w, map[string]string{"level": level.String()})
+}
@@ -0,0 +1,147 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+	"github.com/gorilla/mux"
+)
+
+// TestAdminAuth tests that the admin API requires the configured bearer token, presented
+// with the `Bearer` scheme - and refuses all requests if no credentials are configured
+func TestAdminAuth(t *testing.T) {
+	router := handler.NewAdminRouter(mux.NewRouter())
+	status := func(authorization string) int {
+		r := httptest.NewRequest(http.MethodGet, "/log-level", nil)
+		if len(authorization) > 0 {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if err := config.ParseFlags("test", []string{"--admin.bearerToken="}); err != nil {
+		t.Fatal(err)
+	}
+	if code := status("Bearer anything"); code != http.StatusForbidden {
+		t.Errorf("no credentials configured: unexpected status %v", code)
+	}
+
+	if err := config.ParseFlags("test", []string{"--admin.bearerToken=admin-token"}); err != nil {
+		t.Fatal(err)
+	}
+	for authorization, expected := range map[string]int{
+		"":                        http.StatusUnauthorized,
+		"Bearer wrong-token":      http.StatusUnauthorized,
+		"Bearer admin-token-more": http.StatusUnauthorized,
+		"admin-token":             http.StatusUnauthorized,
+		"Basic admin-token":       http.StatusUnauthorized,
+		"Bearer admin-token":      http.StatusOK,
+	} {
+		if code := status(authorization); code != expected {
+			t.Errorf("%q: expected status %v, got %v", authorization, expected, code)
+		}
+	}
+}
+
+// TestAdminCache tests the inspection and flushing of the cached decisions and of the RPTs
+// held in sessions - per user, and globally - without exposing the tokens
+func TestAdminCache(t *testing.T) {
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pep.Close()
+	dir := t.TempDir()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--pep.url=" + pep.URL, "--authCache.maxAge=60", "--admin.bearerToken=admin-token",
+		"--session.enabled=true", "--session.store=file", "--session.fileDir=" + dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--authCache.maxAge=0", "--session.enabled=false"})
+	router := handler.NewAdminRouter(mux.NewRouter())
+	admin := func(method string, path string, v interface{}) {
+		t.Helper()
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), v) != nil {
+			t.Fatalf("%v %v: unexpected response %v: %v", method, path, w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "rpt-of-") {
+			t.Errorf("%v %v: RPT exposed: %v", method, path, w.Body.String())
+		}
+	}
+
+	// Decisions and session RPTs of two users
+	store, err := session.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"admin-alice", "admin-bob"} {
+		idToken := unsignedJwt(t, map[string]interface{}{"sub": user, "exp": time.Now().Add(time.Hour).Unix()})
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", "/ades/jobs")
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		r.Header.Set("X-User-Id", idToken)
+		handler.NginxAuthRequestHandler(httptest.NewRecorder(), r)
+
+		id, _ := session.NewSessionId()
+		s := session.Session{IdToken: idToken, Expiry: time.Now().Add(time.Hour)}
+		s.SetRpt(session.Rpt{Value: "rpt-of-" + user, AuthServer: "https://as.example.org", Resource: "/ades", Updated: time.Now()})
+		if err = store.Save(id, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Inspect per user
+	var entries []map[string]interface{}
+	admin(http.MethodGet, "/cache/decisions?user=admin-alice", &entries)
+	if len(entries) != 1 || entries[0]["resourcePath"] != "/ades/jobs" {
+		t.Errorf("unexpected decisions of the user: %v", entries)
+	}
+	admin(http.MethodGet, "/cache/rpts?user=admin-alice", &entries)
+	if len(entries) != 1 || entries[0]["resource"] != "/ades" || entries[0]["authServer"] != "https://as.example.org" {
+		t.Errorf("unexpected session RPTs of the user: %v", entries)
+	}
+
+	// Flush per user
+	var deleted map[string]int
+	admin(http.MethodDelete, "/cache/decisions?user=admin-alice", &deleted)
+	if deleted["deleted"] != 1 {
+		t.Errorf("unexpected decisions flushed: %v", deleted)
+	}
+	admin(http.MethodDelete, "/cache/rpts?user=admin-alice", &deleted)
+	if deleted["deleted"] != 1 {
+		t.Errorf("unexpected session RPTs flushed: %v", deleted)
+	}
+	for _, path := range []string{"/cache/decisions?user=", "/cache/rpts?user="} {
+		admin(http.MethodGet, path+"admin-alice", &entries)
+		if len(entries) != 0 {
+			t.Errorf("%v: expected the user's entries to be flushed: %v", path, entries)
+		}
+		admin(http.MethodGet, path+"admin-bob", &entries)
+		if len(entries) != 1 {
+			t.Errorf("%v: expected the entries of another user to remain: %v", path, entries)
+		}
+	}
+
+	// Flush all
+	for _, path := range []string{"/cache/decisions", "/cache/rpts"} {
+		admin(http.MethodDelete, path, &deleted)
+		if deleted["deleted"] < 1 {
+			t.Errorf("%v: unexpected entries flushed: %v", path, deleted)
+		}
+		admin(http.MethodGet, path, &entries)
+		if len(entries) != 0 {
+			t.Errorf("%v: expected all entries to be flushed: %v", path, entries)
+		}
+	}
+}
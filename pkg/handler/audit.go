@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/audit"
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// auditorEntry is the auditor for the sinks identified by the signature
+type auditorEntry struct {
+	auditor   *audit.Auditor
+	signature string
+}
+
+// auditor delivers the audit records to the configured sinks, and is (re)created
+// according to the configuration. The current auditor is swapped atomically, so that
+// records are not delayed while a replaced auditor drains in the background.
+var auditor = struct {
+	mutex   sync.Mutex // serialises the creation of the auditor
+	current atomic.Pointer[auditorEntry]
+}{}
+
+// getAuditor returns the auditor for the sinks of the supplied configuration
+func getAuditor(cfg *config.Config) (*audit.Auditor, error) {
+	signature := fmt.Sprintf("%s|%d|%d|%t|%s|%s|%s|%s|%s",
+		cfg.AuditFilePath, cfg.AuditFileMaxSize, cfg.AuditFileMaxBackups, cfg.AuditFileHashChain,
+		cfg.AuditSyslogAddress, cfg.AuditSyslogNetwork, cfg.AuditSyslogAppName,
+		cfg.AuditWebhookUrl, cfg.AuditWebhookAuthorization)
+	if current := auditor.current.Load(); current != nil && current.signature == signature {
+		return current.auditor, nil
+	}
+
+	auditor.mutex.Lock()
+	defer auditor.mutex.Unlock()
+	if current := auditor.current.Load(); current != nil && current.signature == signature {
+		return current.auditor, nil
+	}
+
+	// (Re)create the sinks
+	sinks := []audit.Sink{}
+	if path := cfg.AuditFilePath; len(path) > 0 {
+		sink, err := audit.NewFileSink(path, cfg.AuditFileMaxSize, cfg.AuditFileMaxBackups, cfg.AuditFileHashChain)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if address := cfg.AuditSyslogAddress; len(address) > 0 {
+		sink, err := audit.NewSyslogSink(cfg.AuditSyslogNetwork, address, cfg.AuditSyslogAppName)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if url := cfg.AuditWebhookUrl; len(url) > 0 {
+		sinks = append(sinks, audit.NewWebhookSink(url, cfg.AuditWebhookAuthorization, cfg.HttpTimeout))
+	}
+
+	entry := &auditorEntry{audit.NewAuditor(sinks, logrus.WithField("component", "audit")), signature}
+	if previous := auditor.current.Swap(entry); previous != nil {
+		// Deliver the records queued for the previous sinks in the background
+		go previous.auditor.Close()
+	}
+	if len(sinks) > 0 {
+		logrus.Infof("Initialised audit log with %d sink(s)", len(sinks))
+	}
+	return entry.auditor, nil
+}
+
+// closeAuditor delivers the queued audit records and closes the sinks
+func closeAuditor() {
+	auditor.mutex.Lock()
+	defer auditor.mutex.Unlock()
+	if previous := auditor.current.Swap(nil); previous != nil {
+		previous.auditor.Close()
+	}
+}
+
+func closeSinks(sinks []audit.Sink) {
+	for _, sink := range sinks {
+		sink.Close()
+	}
+}
+
+// auditDecision writes the audit record of the final decision for the request
+func auditDecision(clientRequestDetails *ClientRequestDetails, w *wrappedResponseWriter) {
+	auditor, err := getAuditor(clientRequestDetails.Config)
+	if err != nil {
+		GetRequestLogger(clientRequestDetails).Error(fmt.Errorf("audit record not written - error initialising audit log: %w", err))
+		return
+	}
+	subject, subjectVerified := getAuditSubject(clientRequestDetails)
+	auditor.Record(audit.Record{
+		Timestamp:           time.Now(),
+		RequestId:           clientRequestDetails.RequestId,
+		Subject:             subject,
+		SubjectVerified:     subjectVerified,
+		ClientIp:            clientRequestDetails.ClientIp,
+		Method:              clientRequestDetails.OrigMethod,
+		Uri:                 clientRequestDetails.OrigUri,
+		Decision:            getDecision(clientRequestDetails, w.StatusCode),
+		Reason:              strings.TrimSpace(w.Body.String()),
+		StatusCode:          w.StatusCode,
+		Pep:                 clientRequestDetails.Config.PepUrl,
+		AuthorizationServer: clientRequestDetails.AuthServerUrl,
+		FromCache:           clientRequestDetails.FromCache,
+	})
+}
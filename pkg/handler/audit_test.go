@@ -0,0 +1,128 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/audit"
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+)
+
+// TestAuditSubject tests that the audit record carries the `sub` of a User ID Token that
+// is verified against the keys of the OIDC provider - and not of a token that is not - even
+// if the decision deadline passes. Without an OIDC provider, the `sub` is recorded as
+// unverified.
+func TestAuditSubject(t *testing.T) {
+	provider := newFakeProvider(t)
+	// The PEP stalls beyond the decision deadline for the /stalled resource
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Original-Uri") == "/stalled" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}))
+	defer pep.Close()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	configure := func(issuer string) {
+		t.Helper()
+		err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+			"--oidc.issuer=" + issuer, "--session.enabled=false", "--pep.url=" + pep.URL, "--audit.file.path=" + path,
+			"--authDecisionTimeout=1", "--retries.httpRequest=0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer config.ParseFlags("test", []string{"--oidc.issuer=", "--audit.file.path=", "--authDecisionTimeout=0", "--retries.httpRequest=1"})
+	authorize := func(uri string, idToken string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", uri)
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		r.Header.Set("X-User-Id", idToken)
+		handler.NginxAuthRequestHandler(httptest.NewRecorder(), r)
+	}
+
+	expiry := time.Now().Add(time.Hour).Unix()
+	configure(provider.URL)
+	authorize("/verified", provider.sign(t, map[string]interface{}{"iss": provider.URL, "sub": "eric", "exp": expiry}))
+	authorize("/unverified", unsignedJwt(t, map[string]interface{}{"iss": provider.URL, "sub": "mallory", "exp": expiry}))
+	authorize("/stalled", provider.sign(t, map[string]interface{}{"iss": provider.URL, "sub": "eric", "exp": expiry}))
+	configure("")
+	authorize("/no-provider", unsignedJwt(t, map[string]interface{}{"sub": "alice", "exp": expiry}))
+
+	records := map[string]audit.Record{}
+	for _, record := range readAuditRecords(t, path, 4) {
+		records[record.Uri] = record
+	}
+	for uri, expected := range map[string]struct {
+		subject  string
+		verified bool
+	}{
+		"/verified":    {"eric", true},
+		"/unverified":  {"", false},
+		"/stalled":     {"eric", true},
+		"/no-provider": {"alice", false},
+	} {
+		if record, ok := records[uri]; !ok || record.Subject != expected.subject || record.SubjectVerified != expected.verified {
+			t.Errorf("%v: expected sub %q (verified %v), got %+v", uri, expected.subject, expected.verified, record)
+		}
+	}
+	if records["/stalled"].Decision != "error" {
+		t.Errorf("expected the stalled decision to fail: %+v", records["/stalled"])
+	}
+}
+
+// readAuditRecords waits for the expected number of audit records to be written to the file
+func readAuditRecords(t *testing.T, path string, expected int) (records []audit.Record) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		records = nil
+		data, _ := os.ReadFile(path)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record audit.Record
+			if json.Unmarshal([]byte(line), &record) == nil {
+				records = append(records, record)
+			}
+		}
+		if len(records) >= expected {
+			return
+		}
+	}
+	t.Fatalf("expected %d audit records, got %d", expected, len(records))
+	return
+}
+
+// TestAuditFromCache tests that the audit record shows whether the decision came from the
+// decision cache
+func TestAuditFromCache(t *testing.T) {
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pep.Close()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--pep.url=" + pep.URL, "--audit.file.path=" + path, "--authCache.maxAge=60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--audit.file.path=", "--authCache.maxAge=0"})
+
+	idToken := unsignedJwt(t, map[string]interface{}{"sub": "audited-user", "exp": time.Now().Add(time.Hour).Unix()})
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", "/ades/audited")
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		r.Header.Set("X-User-Id", idToken)
+		handler.NginxAuthRequestHandler(httptest.NewRecorder(), r)
+	}
+	records := readAuditRecords(t, path, 2)
+	if records[0].FromCache || !records[1].FromCache {
+		t.Errorf("expected only the second decision from the cache: %+v", records)
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// trustedProxies are the address ranges of the proxies whose client IP headers are trusted
+var trustedProxies = struct {
+	rwMutex  sync.RWMutex
+	networks []*net.IPNet
+}{}
+
+// configureTrustedProxies parses the configured trusted proxy ranges
+func configureTrustedProxies() {
+	networks := []*net.IPNet{}
+	for _, cidr := range config.GetTrustedProxies() {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logrus.Warnf("Ignoring bad trusted proxy '%v': %v", cidr, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	trustedProxies.rwMutex.Lock()
+	defer trustedProxies.rwMutex.Unlock()
+	trustedProxies.networks = networks
+}
+
+// isTrustedProxy indicates whether the address is that of a trusted proxy
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	trustedProxies.rwMutex.RLock()
+	defer trustedProxies.rwMutex.RUnlock()
+	for _, network := range trustedProxies.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRemoteIp returns the address of the peer of the request
+func getRemoteIp(r *http.Request) string {
+	remoteIp, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIp = r.RemoteAddr
+	}
+	return remoteIp
+}
+
+// isFromTrustedProxy indicates whether the request comes from a trusted proxy - by its
+// address, or by its receipt on the unix socket
+func isFromTrustedProxy(r *http.Request) bool {
+	return server.FromUnixSocket(r.Context()) || isTrustedProxy(getRemoteIp(r))
+}
+
+// getClientIp returns the address of the originating client. The client IP headers are
+// only believed if the request comes from a trusted proxy (e.g. nginx)...
+// * X-Real-IP
+// * X-Forwarded-For - the right-most address that is not a trusted proxy
+func getClientIp(r *http.Request) string {
+	remoteIp := getRemoteIp(r)
+	if !isFromTrustedProxy(r) {
+		return remoteIp
+	}
+
+	if realIp := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIp) != nil {
+		return realIp
+	}
+	forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	clientIp := remoteIp
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwardedFor[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		clientIp = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return clientIp
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/server"
+)
+
+// TestGetClientIp tests that the client IP headers are believed only from a trusted proxy
+func TestGetClientIp(t *testing.T) {
+	if err := config.ParseFlags("test", []string{"--network.trustedProxies=127.0.0.0/8,::1,10.1.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--network.trustedProxies=127.0.0.0/8,::1/128"})
+	configureTrustedProxies()
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		realIp       string
+		forwardedFor []string
+		expectedIp   string
+	}{
+		{"untrusted peer", "203.0.113.9:1234", "", nil, "203.0.113.9"},
+		{"untrusted peer with X-Real-IP", "203.0.113.9:1234", "198.51.100.1", nil, "203.0.113.9"},
+		{"untrusted peer with X-Forwarded-For", "203.0.113.9:1234", "", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"private peer is not trusted by default", "192.168.1.1:1234", "198.51.100.1", nil, "192.168.1.1"},
+		{"trusted peer without headers", "127.0.0.1:1234", "", nil, "127.0.0.1"},
+		{"trusted peer with X-Real-IP", "127.0.0.1:1234", "198.51.100.1", nil, "198.51.100.1"},
+		{"trusted ipv6 peer with X-Real-IP", "[::1]:1234", "2001:db8::1", nil, "2001:db8::1"},
+		{"trusted peer with bad X-Real-IP", "127.0.0.1:1234", "not-an-ip", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"X-Real-IP takes precedence", "127.0.0.1:1234", "198.51.100.1", []string{"198.51.100.2"}, "198.51.100.1"},
+		{"right-most untrusted of X-Forwarded-For", "127.0.0.1:1234", "", []string{"198.51.100.1, 198.51.100.2, 10.1.2.3"}, "198.51.100.2"},
+		{"X-Forwarded-For across headers", "127.0.0.1:1234", "", []string{"198.51.100.1", "198.51.100.2, 10.1.2.3"}, "198.51.100.2"},
+		{"spoofed left-most X-Forwarded-For is ignored", "10.1.0.1:1234", "", []string{"127.0.0.1, 198.51.100.2"}, "198.51.100.2"},
+		{"all of X-Forwarded-For trusted", "127.0.0.1:1234", "", []string{"10.1.2.3, 10.1.2.4"}, "10.1.2.3"},
+		{"bad entry stops X-Forwarded-For", "127.0.0.1:1234", "", []string{"198.51.100.1, garbage, 10.1.2.3"}, "10.1.2.3"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if len(test.realIp) > 0 {
+			r.Header.Set("X-Real-IP", test.realIp)
+		}
+		for _, value := range test.forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := getClientIp(r); ip != test.expectedIp {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expectedIp, ip)
+		}
+	}
+}
+
+// TestClientIpOverUnixSocket tests that the client IP headers are believed from the peer of
+// the unix socket - which has no address by which it could be trusted
+func TestClientIpOverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uma.sock")
+	if err := config.ParseFlags("test", []string{"--network.listenPort=0", "--network.tls.enabled=false", "--network.unixSocket.path=" + path}); err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--network.listenPort=80", "--network.unixSocket.path="})
+	configureTrustedProxies()
+	socketServer := server.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, getClientIp(r))
+	}))
+	go socketServer.Serve()
+	defer socketServer.Shutdown(context.Background())
+
+	client := http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	getClientIpOverSocket := func(header string, value string) (clientIp string) {
+		t.Helper()
+		r, _ := http.NewRequest(http.MethodGet, "http://unix/", nil)
+		r.Header.Set(header, value)
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			var response *http.Response
+			if response, err = client.Do(r); err == nil {
+				body, _ := io.ReadAll(response.Body)
+				response.Body.Close()
+				return string(body)
+			}
+		}
+		t.Fatalf("request over the unix socket failed: %v", err)
+		return
+	}
+
+	if ip := getClientIpOverSocket("X-Real-IP", "198.51.100.1"); ip != "198.51.100.1" {
+		t.Errorf("expected the X-Real-IP, got %v", ip)
+	}
+	if ip := getClientIpOverSocket("X-Forwarded-For", "198.51.100.1, 198.51.100.2"); ip != "198.51.100.2" {
+		t.Errorf("expected the right-most X-Forwarded-For, got %v", ip)
+	}
+}
@@ -0,0 +1,16 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+)
+
+// ConfigSnapshotMiddleware takes the configuration snapshot at the start of the request, and
+// carries it in the request context - so that the request is handled with a consistent
+// configuration, unaffected by any reload while it is in progress.
+func ConfigSnapshotMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(config.NewContext(r.Context(), config.Get())))
+	})
+}
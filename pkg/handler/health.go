@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/health"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+)
+
+// healthChecker performs the periodic health checks of the upstreams, whose cached results
+// contribute to readiness
+var healthChecker = health.NewChecker()
+
+// configureHealthChecks (re)configures the checks of the PEP and of the configured
+// Authorization Servers
+func configureHealthChecks() {
+	if !config.IsReadinessCheckUpstreams() {
+		healthChecker.Configure(map[string]health.CheckFunc{}, 0, 0)
+		return
+	}
+	checks := map[string]health.CheckFunc{}
+	pepUrl := config.GetPepUrl()
+	checks["pep:"+pepUrl] = func(ctx context.Context) error {
+		return checkPep(ctx, pepUrl)
+	}
+	for _, authServerUrl := range config.GetReadinessAuthorizationServers() {
+		authServerUrl := strings.TrimSuffix(authServerUrl, "/")
+		checks["as:"+authServerUrl] = func(ctx context.Context) error {
+			return checkAuthorizationServer(ctx, authServerUrl)
+		}
+	}
+	healthChecker.Configure(checks, config.GetReadinessInterval(), config.GetHttpTimeout())
+}
+
+// checkPep checks that the PEP is reachable - any response other than a server error
+func checkPep(ctx context.Context, pepUrl string) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", pepUrl, nil)
+	if err != nil {
+		return err
+	}
+	response, err := uma.GetHttpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("unexpected response code from PEP: %d", response.StatusCode)
+	}
+	return nil
+}
+
+// checkAuthorizationServer checks that the UMA configuration (discovery document) of the
+// Authorization Server can be fetched
+func checkAuthorizationServer(ctx context.Context, authServerUrl string) error {
+	umaConfigUrl := authServerUrl + "/.well-known/uma2-configuration"
+	request, err := http.NewRequestWithContext(ctx, "GET", umaConfigUrl, nil)
+	if err != nil {
+		return err
+	}
+	response, err := uma.GetHttpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response code from %v: %d", umaConfigUrl, response.StatusCode)
+	}
+	bodyJson := struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}{}
+	if err = json.NewDecoder(io.LimitReader(response.Body, 1024*1024)).Decode(&bodyJson); err != nil {
+		return fmt.Errorf("could not interpret json response from %v: %w", umaConfigUrl, err)
+	}
+	if len(bodyJson.TokenEndpoint) == 0 {
+		return fmt.Errorf("blank Token Endpoint retrieved from %v", umaConfigUrl)
+	}
+	return nil
+}
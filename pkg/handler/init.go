@@ -0,0 +1,17 @@
+package handler
+
+import (
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+)
+
+func init() {
+	configChangeHandler()
+	config.AddConfigChangeHandler(configChangeHandler)
+}
+
+func configChangeHandler() {
+	configureTrustedProxies()
+	configureRateLimiters()
+	configureHealthChecks()
+	configureRegistration()
+}
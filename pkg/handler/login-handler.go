@@ -0,0 +1,489 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/authcache"
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/EOEPCA/uma-user-agent/pkg/oidc"
+	"github.com/EOEPCA/uma-user-agent/pkg/redact"
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Name of the short-lived cookie that carries the login state between /login and /callback
+const loginStateCookieName = "auth_login_state"
+const loginStateMaxAge = 600
+
+// Name of the query parameter that carries the URI to which the user is returned after login/logout
+const queryParamRedirect = "redirect"
+
+// loginState is the state that must survive the round-trip to the OpenID Provider
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"returnTo"`
+}
+
+// NewLoginRouter registers the handlers that implement the OIDC authorization code flow
+// (with PKCE) to establish the User ID Token cookie
+func NewLoginRouter(router *mux.Router) *mux.Router {
+	router.Path("/login").HandlerFunc(LoginHandler)
+	router.Path("/callback").HandlerFunc(CallbackHandler)
+	router.Path("/logout").Methods(http.MethodPost).HandlerFunc(LogoutHandler)
+	return router
+}
+
+// getLoginLogger returns a logger with fields set from the supplied login request
+func getLoginLogger(r *http.Request) *logrus.Entry {
+	return logrus.StandardLogger().WithFields(logrus.Fields{
+		logging.FieldRequestId: logging.RequestIdFromContext(r.Context()),
+		"path":                 r.URL.Path,
+	})
+}
+
+// LoginHandler begins the authorization code flow by redirecting the user to the
+// Authorization Endpoint of the OpenID Provider
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := getLoginLogger(r)
+	cfg := config.FromContext(r.Context())
+
+	provider, oidcClient, ok := getOidcClient(cfg, w)
+	if !ok {
+		return
+	}
+
+	// Generate the values that must be checked on return
+	state := loginState{ReturnTo: getReturnUri(r)}
+	var err error
+	if state.State, err = oidc.RandomString(16); err == nil {
+		if state.Nonce, err = oidc.RandomString(16); err == nil {
+			state.Verifier, err = oidc.NewCodeVerifier()
+		}
+	}
+	if err != nil {
+		msg := "error generating login state"
+		requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, msg)
+		return
+	}
+
+	// Build the redirect to the Authorization Endpoint
+	authUrl, err := oidcClient.AuthCodeUrl(r.Context(), provider, getOidcRedirectUrl(cfg, r), cfg.OidcScopes, state.State, state.Nonce, state.Verifier)
+	if err != nil {
+		msg := "error preparing request to the OpenID Provider"
+		requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, msg)
+		return
+	}
+
+	// Retain the state in a cookie and redirect
+	stateBytes, _ := json.Marshal(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginStateCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(stateBytes),
+		Path:     "/",
+		MaxAge:   loginStateMaxAge,
+		Secure:   cfg.UserIdCookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	requestLogger.Debug("Redirecting to Authorization Endpoint for login")
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+// CallbackHandler completes the authorization code flow, by exchanging the code for
+// tokens and setting the User ID Token cookie
+func CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := getLoginLogger(r)
+	cfg := config.FromContext(r.Context())
+
+	provider, oidcClient, ok := getOidcClient(cfg, w)
+	if !ok {
+		return
+	}
+
+	// The login state is single-use
+	state, err := getLoginState(r)
+	clearCookie(w, loginStateCookieName, "/", "")
+	if err != nil {
+		msg := "missing or invalid login state"
+		requestLogger.Warn(fmt.Errorf("%s: %w", msg, err))
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, msg)
+		return
+	}
+
+	// Check the response from the Authorization Endpoint
+	query := r.URL.Query()
+	if errCode := query.Get("error"); len(errCode) > 0 {
+		msg := fmt.Sprintf("login failed at OpenID Provider: %s", errCode)
+		requestLogger.Warn(msg, ": ", query.Get("error_description"))
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, msg)
+		return
+	}
+	if query.Get("state") != state.State {
+		msg := "login state does not match"
+		requestLogger.Warn(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, msg)
+		return
+	}
+	code := query.Get("code")
+	if len(code) == 0 {
+		msg := "no authorization code in callback"
+		requestLogger.Warn(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, msg)
+		return
+	}
+
+	// Exchange the code for tokens
+	tokens, err := oidcClient.ExchangeCode(r.Context(), requestLogger, provider, code, state.Verifier, getOidcRedirectUrl(cfg, r))
+	if err != nil {
+		msg := "error exchanging authorization code at the OpenID Provider"
+		requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, msg)
+		return
+	}
+
+	// Validate the ID Token
+	claims, err := oidcClient.ValidateIdToken(r.Context(), provider, tokens.IdToken, state.Nonce)
+	if err != nil {
+		msg := "invalid ID Token received from the OpenID Provider"
+		requestLogger.Warn(fmt.Errorf("%s: %w", msg, err))
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, msg)
+		return
+	}
+	requestLogger.Debugf("Login successful for user: %s", claims.Subject)
+
+	// Establish the session (or User ID Token cookie) and return the user to where they started
+	if cfg.SessionEnabled {
+		if err = createSession(cfg, w, tokens.IdToken, tokens.RefreshToken); err != nil {
+			msg := "error creating session"
+			requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, msg)
+			return
+		}
+	} else {
+		setUserIdCookie(cfg, w, tokens.IdToken, claims.ExpiryTime())
+		if len(tokens.RefreshToken) > 0 {
+			setRefreshTokenCookie(cfg, w, tokens.RefreshToken)
+		}
+	}
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+// LogoutHandler ends the user's session. The User ID Token, refresh token and RPT cookies
+// (or server-side session) are cleared, the refresh token is revoked at the OpenID Provider
+// and the RPTs at the Authorization Servers that issued them, and cached decisions for the
+// user are dropped. The user is then returned to
+// the (optionally) specified URI, or to the End Session Endpoint of the OpenID Provider if
+// so configured. Logout is accepted only by POST from the same origin, so that it cannot be
+// triggered cross-site.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	requestLogger := getLoginLogger(r)
+	cfg := config.FromContext(r.Context())
+
+	if !isSameOrigin(r) {
+		requestLogger.Warnf("Rejected cross-site logout from origin: %s", r.Header.Get("Origin"))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "cross-site logout is not permitted")
+		return
+	}
+
+	// Gather the tokens before clearing their cookies
+	idToken := ""
+	if c, err := r.Cookie(cfg.UserIdCookieName); err == nil {
+		idToken = c.Value
+	}
+	refreshToken := ""
+	if c, err := r.Cookie(cfg.RefreshTokenCookieName); err == nil {
+		refreshToken = c.Value
+	}
+	rpts := []session.Rpt{}
+	rptCookieName := cfg.AuthRptCookieName
+	for _, c := range r.Cookies() {
+		if c.Name == rptCookieName || strings.HasPrefix(c.Name, rptCookieName+"-") {
+			if rpt, err := unsealRpt(cfg, c.Value); err == nil {
+				rpts = append(rpts, session.Rpt{Value: rpt})
+			}
+			clearCookie(w, c.Name, cfg.AuthRptCookiePath, cfg.AuthRptCookieDomain)
+		}
+	}
+	clearCookie(w, cfg.UserIdCookieName, cfg.UserIdCookiePath, cfg.UserIdCookieDomain)
+	clearCookie(w, cfg.RefreshTokenCookieName, cfg.UserIdCookiePath, cfg.UserIdCookieDomain)
+
+	// The tokens may instead be held in a server-side session
+	if cfg.SessionEnabled {
+		clearCookie(w, cfg.SessionCookieName, cfg.UserIdCookiePath, cfg.UserIdCookieDomain)
+	}
+	if id, s, ok, err := loadSession(r); err != nil {
+		requestLogger.Error(fmt.Errorf("error loading session: %w", err))
+	} else if ok {
+		idToken, refreshToken = s.IdToken, s.RefreshToken
+		for _, rpt := range s.Rpts {
+			rpts = append(rpts, rpt)
+		}
+		if err = deleteSession(cfg, id); err != nil {
+			requestLogger.Error(fmt.Errorf("error deleting session: %w", err))
+		}
+	}
+
+	// Drop the cached decisions for the user
+	if len(idToken) > 0 {
+		claims, _ := oidc.ParseIdTokenClaims(idToken)
+		count := authcache.Decisions.DeleteUser(claims.Subject, authcache.HashToken(idToken))
+		requestLogger.Debugf("Dropped %d cached decisions for user: %s", count, claims.Subject)
+	}
+
+	// Revoke the RPTs at their Authorization Servers
+	revokeRpts(r.Context(), cfg, requestLogger, rpts)
+
+	// Revoke the refresh token at the OpenID Provider, and determine where to send the user
+	returnUri := getReturnUri(r)
+	redirectUrl := returnUri
+	if issuer := cfg.OidcIssuer; len(issuer) > 0 {
+		provider := oidc.GetProvider(issuer)
+		oidcClient := &oidc.OidcClient{Id: cfg.ClientId, Secret: cfg.ClientSecret, PreviousSecret: cfg.PreviousClientSecret}
+		if len(refreshToken) > 0 {
+			if err := oidcClient.RevokeToken(r.Context(), requestLogger, provider, refreshToken, "refresh_token"); err != nil {
+				requestLogger.Warn(fmt.Errorf("error revoking refresh token: %w", err))
+			}
+		}
+		if cfg.OidcEndSessionRedirect {
+			if endSessionUrl, err := getEndSessionUrl(cfg, r, provider, idToken, returnUri); err != nil {
+				requestLogger.Warn(fmt.Errorf("error getting end session endpoint: %w", err))
+			} else if len(endSessionUrl) > 0 {
+				redirectUrl = endSessionUrl
+			}
+		}
+	}
+
+	requestLogger.Debug("Logout complete")
+	http.Redirect(w, r, redirectUrl, http.StatusSeeOther)
+}
+
+// isSameOrigin reports whether the request was not made cross-site - according to the
+// Origin header (if present) and the Fetch Metadata of the browser
+func isSameOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); len(origin) > 0 && origin != getExternalBaseUrl(r) {
+		return false
+	}
+	return r.Header.Get("Sec-Fetch-Site") != "cross-site"
+}
+
+// revokeRpts revokes each RPT at the Authorization Server that issued it - with the client
+// of that Authorization Server. The Authorization Server of an RPT held in the session was
+// recorded when it was obtained. Otherwise it is identified by the `iss` claim of the RPT,
+// and must be a known Authorization Server - so that the client credentials are never
+// presented to an endpoint named by the token. RPTs that cannot be attributed are left to
+// expire.
+func revokeRpts(ctx context.Context, cfg *config.Config, requestLogger *logrus.Entry, rpts []session.Rpt) {
+	for _, rpt := range rpts {
+		var authServer uma.AuthorizationServer
+		if len(rpt.AuthServer) > 0 {
+			var ok bool
+			if authServer, ok = uma.AuthorizationServers.Load(rpt.AuthServer); !ok {
+				authServer = *uma.NewAuthorizationServer(rpt.AuthServer)
+			}
+		} else {
+			claims, err := oidc.ParseIdTokenClaims(rpt.Value)
+			if err != nil || len(claims.Issuer) == 0 {
+				requestLogger.Debug("Not revoking RPT without an issuer: ", redact.Token(rpt.Value))
+				continue
+			}
+			var ok bool
+			if authServer, ok = getKnownAuthorizationServer(cfg, claims.Issuer); !ok {
+				requestLogger.Debugf("Not revoking RPT of unknown Authorization Server: %s", claims.Issuer)
+				continue
+			}
+		}
+		client, _ := cfg.GetAuthServerClient(authServer.GetUrl())
+		umaClient := &uma.UmaClient{Id: client.ClientId, Secret: client.ClientSecret, PreviousSecret: client.PreviousClientSecret, AuthMethod: client.AuthMethod}
+		if err := umaClient.RevokeRpt(ctx, requestLogger, authServer, rpt.Value); err != nil {
+			requestLogger.Warn(fmt.Errorf("error revoking RPT: %w", err))
+		}
+	}
+}
+
+// getKnownAuthorizationServer returns the Authorization Server of the issuer - if it has
+// been used for a ticket exchange, or has a configured client
+func getKnownAuthorizationServer(cfg *config.Config, issuer string) (authServer uma.AuthorizationServer, ok bool) {
+	for _, url := range uma.AuthorizationServers.Urls() {
+		if config.NormalizeIssuer(url) == config.NormalizeIssuer(issuer) {
+			return uma.AuthorizationServers.Load(url)
+		}
+	}
+	if _, specific := cfg.GetAuthServerClient(issuer); specific {
+		return *uma.NewAuthorizationServer(strings.TrimSuffix(issuer, "/")), true
+	}
+	return
+}
+
+// getEndSessionUrl returns the URL of the End Session Endpoint, with the parameters that
+// return the user to the supplied URI after logout. A blank URL is returned if the
+// provider does not support RP-initiated logout.
+func getEndSessionUrl(cfg *config.Config, r *http.Request, provider *oidc.Provider, idToken string, returnUri string) (endSessionUrl string, err error) {
+	endpoint, err := provider.GetEndSessionEndpoint(r.Context())
+	if err != nil || len(endpoint) == 0 {
+		return
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	postLogoutRedirectUrl := cfg.OidcPostLogoutRedirectUrl
+	if len(postLogoutRedirectUrl) == 0 {
+		postLogoutRedirectUrl = getExternalBaseUrl(r) + returnUri
+	}
+	query := u.Query()
+	if len(idToken) > 0 {
+		query.Set("id_token_hint", idToken)
+	}
+	query.Set("post_logout_redirect_uri", postLogoutRedirectUrl)
+	u.RawQuery = query.Encode()
+	endSessionUrl = u.String()
+	return
+}
+
+// getOidcClient returns the configured OpenID Provider and client, or writes an error
+// response if login is not configured
+func getOidcClient(cfg *config.Config, w http.ResponseWriter) (provider *oidc.Provider, oidcClient *oidc.OidcClient, ok bool) {
+	issuer := cfg.OidcIssuer
+	ok = len(issuer) > 0
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "login is not configured")
+		return
+	}
+	provider = oidc.GetProvider(issuer)
+	oidcClient = &oidc.OidcClient{Id: cfg.ClientId, Secret: cfg.ClientSecret, PreviousSecret: cfg.PreviousClientSecret}
+	return
+}
+
+// getLoginState reads the login state from its cookie
+func getLoginState(r *http.Request) (state loginState, err error) {
+	c, err := r.Cookie(loginStateCookieName)
+	if err != nil {
+		return
+	}
+	stateBytes, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(stateBytes, &state)
+	if err == nil && len(state.State) == 0 {
+		err = fmt.Errorf("blank state")
+	}
+	return
+}
+
+// getOidcRedirectUrl returns the URL of the /callback endpoint, which is either
+// configured or derived from the (forwarded) request
+func getOidcRedirectUrl(cfg *config.Config, r *http.Request) string {
+	if redirectUrl := cfg.OidcRedirectUrl; len(redirectUrl) > 0 {
+		return redirectUrl
+	}
+	return getExternalBaseUrl(r) + "/callback"
+}
+
+// getExternalBaseUrl returns the scheme and host by which the user reached the agent,
+// taking account of the forwarding headers set by the reverse-proxy. The forwarding headers
+// are only believed if the request comes from a trusted proxy - otherwise the origin of the
+// configured redirect URL is used, or else that of the request itself.
+func getExternalBaseUrl(r *http.Request) string {
+	trusted := isFromTrustedProxy(r)
+	if !trusted {
+		if redirectUrl, err := url.Parse(config.FromContext(r.Context()).OidcRedirectUrl); err == nil && len(redirectUrl.Host) > 0 {
+			return fmt.Sprintf("%s://%s", redirectUrl.Scheme, redirectUrl.Host)
+		}
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if trusted {
+		if forwardedProto := r.Header.Get("X-Forwarded-Proto"); len(forwardedProto) > 0 {
+			scheme = forwardedProto
+		}
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); len(forwardedHost) > 0 {
+			host = forwardedHost
+		}
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// getReturnUri returns the URI to which the user should be redirected, as specified in
+// the request. Only local paths are accepted, to avoid an open redirect.
+func getReturnUri(r *http.Request) string {
+	returnUri := r.URL.Query().Get(queryParamRedirect)
+	if !strings.HasPrefix(returnUri, "/") || strings.HasPrefix(returnUri, "//") || strings.HasPrefix(returnUri, "/\\") {
+		returnUri = "/"
+	}
+	return returnUri
+}
+
+// setUserIdCookie sets the User ID Token cookie with the configured attributes.
+// In the absence of a configured max age the cookie expires with the token.
+func setUserIdCookie(cfg *config.Config, w http.ResponseWriter, idToken string, expiry time.Time) {
+	maxAge := cfg.UserIdCookieMaxAge
+	if maxAge <= 0 {
+		maxAge = int(time.Until(expiry).Seconds())
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.UserIdCookieName,
+		Value:    idToken,
+		Path:     cfg.UserIdCookiePath,
+		Domain:   cfg.UserIdCookieDomain,
+		MaxAge:   maxAge,
+		Secure:   cfg.UserIdCookieSecure,
+		HttpOnly: true,
+		SameSite: cfg.UserIdCookieSameSite,
+	})
+}
+
+// setRefreshTokenCookie sets the refresh token cookie, so that it can be revoked at logout.
+// The cookie shares the attributes of the User ID Token cookie, but persists for the
+// browser session in the absence of a configured max age.
+func setRefreshTokenCookie(cfg *config.Config, w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.RefreshTokenCookieName,
+		Value:    refreshToken,
+		Path:     cfg.UserIdCookiePath,
+		Domain:   cfg.UserIdCookieDomain,
+		MaxAge:   cfg.UserIdCookieMaxAge,
+		Secure:   cfg.UserIdCookieSecure,
+		HttpOnly: true,
+		SameSite: cfg.UserIdCookieSameSite,
+	})
+}
+
+// clearCookie instructs the browser to delete the named cookie
+func clearCookie(w http.ResponseWriter, name string, path string, domain string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   name,
+		Value:  "",
+		Path:   path,
+		Domain: domain,
+		MaxAge: -1,
+	})
+}
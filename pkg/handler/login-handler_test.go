@@ -0,0 +1,373 @@
+package handler_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/gorilla/mux"
+)
+
+// unsignedJwt returns a JWT with the claims - for tokens whose signature is not verified
+func unsignedJwt(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".c2ln"
+}
+
+// fakeProvider is an OpenID Provider serving its discovery document and JWKS - and a
+// Token Endpoint that issues the ID Token set by the test, recording the exchange
+type fakeProvider struct {
+	*httptest.Server
+	key      *ecdsa.PrivateKey
+	mutex    sync.Mutex
+	idToken  string
+	exchange url.Values
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeProvider{key: key}
+	provider.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 provider.URL,
+				"authorization_endpoint": provider.URL + "/auth",
+				"token_endpoint":         provider.URL + "/token",
+				"jwks_uri":               provider.URL + "/jwks",
+			})
+		case "/token":
+			r.ParseForm()
+			provider.mutex.Lock()
+			provider.exchange = r.PostForm
+			idToken := provider.idToken
+			provider.mutex.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "access-token", "token_type": "Bearer", "id_token": idToken, "refresh_token": "refresh-token"})
+		case "/jwks":
+			encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(key.X.Bytes()), "y": encode(key.Y.Bytes())},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(provider.Close)
+	return provider
+}
+
+// sign returns the JWT of the claims, signed with the ES256 key of the provider
+func (provider *fakeProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"ec"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, provider.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// issue sets the ID Token issued at the Token Endpoint
+func (provider *fakeProvider) issue(idToken string) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.idToken, provider.exchange = idToken, nil
+}
+
+// exchanged returns the form of the last code exchange at the Token Endpoint
+func (provider *fakeProvider) exchanged() url.Values {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	return provider.exchange
+}
+
+// fakeAuthServer is an Authorization Server that records the tokens revoked at its
+// Revocation Endpoint, with the client that revoked them
+type fakeAuthServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	revoked map[string]string
+}
+
+func newFakeAuthServer(t *testing.T) *fakeAuthServer {
+	authServer := &fakeAuthServer{revoked: map[string]string{}}
+	authServer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/uma2-configuration":
+			fmt.Fprintf(w, `{"token_endpoint":"%s/token","revocation_endpoint":"%s/revoke"}`, authServer.URL, authServer.URL)
+		case "/revoke":
+			r.ParseForm()
+			authServer.mutex.Lock()
+			authServer.revoked[r.PostForm.Get("token")] = r.PostForm.Get("client_id") + ":" + r.PostForm.Get("client_secret")
+			authServer.mutex.Unlock()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(authServer.Close)
+	return authServer
+}
+
+func (authServer *fakeAuthServer) revokedBy(token string) (client string, ok bool) {
+	authServer.mutex.Lock()
+	defer authServer.mutex.Unlock()
+	client, ok = authServer.revoked[token]
+	return
+}
+
+// TestLogout tests that logout requires a same-origin POST, clears the RPT cookies with
+// the attributes by which they were set, and revokes each RPT at the Authorization Server
+// that issued it
+func TestLogout(t *testing.T) {
+	authServer := newFakeAuthServer(t)
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--authRptCookieSealed=false",
+		"--authRptCookiePath=/app", "--authRptCookieDomain=example.org",
+		fmt.Sprintf(`--authorization-servers={"%s": {"client-id": "as-client", "client-secret": "as-secret"}}`, authServer.URL)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := handler.NewLoginRouter(mux.NewRouter())
+
+	knownRpt := unsignedJwt(t, map[string]interface{}{"iss": authServer.URL + "/", "sub": "eric"})
+	unknownRpt := unsignedJwt(t, map[string]interface{}{"iss": "https://unknown.example.org", "sub": "eric"})
+	newRequest := func(method string, origin string) *http.Request {
+		r := httptest.NewRequest(method, "http://agent.example.org/logout?redirect=/bye", nil)
+		if len(origin) > 0 {
+			r.Header.Set("Origin", origin)
+		}
+		r.AddCookie(&http.Cookie{Name: "auth_rpt-ades", Value: knownRpt})
+		r.AddCookie(&http.Cookie{Name: "auth_rpt-catalogue", Value: unknownRpt})
+		return r
+	}
+
+	// Only POST is accepted
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newRequest(http.MethodGet, ""))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: unexpected status %v", w.Code)
+	}
+
+	// Cross-site requests are refused
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newRequest(http.MethodPost, "https://evil.example.com"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("cross-site POST: unexpected status %v", w.Code)
+	}
+	if _, ok := authServer.revokedBy(knownRpt); ok {
+		t.Error("RPT revoked by a cross-site logout")
+	}
+
+	// Same-origin logout
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newRequest(http.MethodPost, "http://agent.example.org"))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/bye" {
+		t.Fatalf("unexpected response %v to %v", w.Code, w.Header().Get("Location"))
+	}
+	cleared := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		cleared[c.Name] = c
+	}
+	for _, name := range []string{"auth_rpt-ades", "auth_rpt-catalogue"} {
+		c, ok := cleared[name]
+		if !ok || c.MaxAge >= 0 || c.Path != "/app" || c.Domain != "example.org" {
+			t.Errorf("cookie %v not cleared with its attributes: %+v", name, c)
+		}
+	}
+	if client, ok := authServer.revokedBy(knownRpt); !ok || client != "as-client:as-secret" {
+		t.Errorf("RPT not revoked with the client of its Authorization Server: %q", client)
+	}
+	if _, ok := authServer.revokedBy(unknownRpt); ok {
+		t.Error("RPT of an unknown Authorization Server revoked")
+	}
+}
+
+// TestLogoutForwardedOrigin tests that the forwarding headers only establish the external
+// origin of the agent if they are set by a trusted proxy - otherwise the origin is that of
+// the configured redirect URL, or else of the request
+func TestLogoutForwardedOrigin(t *testing.T) {
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--oidc.redirectUrl="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := handler.NewLoginRouter(mux.NewRouter())
+	logout := func(remoteAddr string, origin string, forwardedProto string, forwardedHost string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "http://agent.internal/logout", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Origin", origin)
+		r.Header.Set("X-Forwarded-Proto", forwardedProto)
+		r.Header.Set("X-Forwarded-Host", forwardedHost)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		origin     string
+		expected   int
+	}{
+		{"trusted proxy", "127.0.0.1:4711", "https://agent.example.org", http.StatusSeeOther},
+		{"untrusted peer with forged headers", "192.0.2.1:4711", "https://agent.example.org", http.StatusForbidden},
+		{"untrusted peer of the request host", "192.0.2.1:4711", "http://agent.internal", http.StatusSeeOther},
+	}
+	for _, test := range tests {
+		if code := logout(test.remoteAddr, test.origin, "https", "agent.example.org"); code != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, code)
+		}
+	}
+
+	// The configured redirect URL gives the origin for an untrusted peer
+	if err := config.ParseFlags("test", []string{"--oidc.redirectUrl=https://agent.example.org/callback"}); err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--oidc.redirectUrl="})
+	if code := logout("192.0.2.1:4711", "https://agent.example.org", "https", "evil.example.com"); code != http.StatusSeeOther {
+		t.Errorf("redirect URL origin: unexpected status %v", code)
+	}
+	if code := logout("192.0.2.1:4711", "https://evil.example.com", "https", "evil.example.com"); code != http.StatusForbidden {
+		t.Errorf("forged origin: unexpected status %v", code)
+	}
+}
+
+// TestLoginCallback tests the authorization code flow with PKCE - that the callback
+// checks the state, exchanges the code with the verifier, and accepts only an ID Token that
+// is signed by the provider and carries the nonce of the login
+func TestLoginCallback(t *testing.T) {
+	provider := newFakeProvider(t)
+	err := config.ParseFlags("test", []string{"--client-id=login-client", "--client-secret=login-secret", "--client-secret-file=",
+		"--oidc.issuer=" + provider.URL, "--oidc.redirectUrl=", "--session.enabled=false", "--authorization-servers={}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--oidc.issuer="})
+	router := handler.NewLoginRouter(mux.NewRouter())
+
+	// login returns the parameters of the redirect to the Authorization Endpoint, and the
+	// login state cookie
+	login := func(redirect string) (url.Values, *http.Cookie) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://agent.example.org/login?redirect="+url.QueryEscape(redirect), nil))
+		location, err := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), provider.URL+"/auth?") {
+			t.Fatalf("unexpected login response %v to %v", w.Code, w.Header().Get("Location"))
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "auth_login_state" && c.HttpOnly {
+				return location.Query(), c
+			}
+		}
+		t.Fatal("no login state cookie")
+		return nil, nil
+	}
+	// callback completes the login, with the ID Token issued by the provider
+	callback := func(query string, state *http.Cookie, idToken string) *httptest.ResponseRecorder {
+		t.Helper()
+		provider.issue(idToken)
+		r := httptest.NewRequest(http.MethodGet, "http://agent.example.org/callback?"+query, nil)
+		if state != nil {
+			r.AddCookie(state)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	idTokenCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "auth_user_id" && c.MaxAge > 0 {
+				return c
+			}
+		}
+		return nil
+	}
+	claims := func(nonce string) map[string]interface{} {
+		return map[string]interface{}{"iss": provider.URL, "sub": "eric", "aud": "login-client", "nonce": nonce,
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	// Successful login
+	params, state := login("/ades/jobs")
+	if params.Get("client_id") != "login-client" || params.Get("response_type") != "code" ||
+		params.Get("redirect_uri") != "http://agent.example.org/callback" || params.Get("code_challenge_method") != "S256" {
+		t.Errorf("unexpected authorization request: %v", params)
+	}
+	idToken := provider.sign(t, claims(params.Get("nonce")))
+	w := callback("code=the-code&state="+params.Get("state"), state, idToken)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/ades/jobs" {
+		t.Fatalf("unexpected callback response %v to %v: %v", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	if c := idTokenCookie(w); c == nil || c.Value != idToken || !c.HttpOnly {
+		t.Errorf("ID Token cookie not set: %+v", c)
+	}
+	exchange := provider.exchanged()
+	challenge := sha256.Sum256([]byte(exchange.Get("code_verifier")))
+	if exchange.Get("code") != "the-code" || exchange.Get("client_secret") != "login-secret" ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != params.Get("code_challenge") ||
+		exchange.Get("redirect_uri") != "http://agent.example.org/callback" {
+		t.Errorf("unexpected code exchange: %v", exchange)
+	}
+
+	// The return URI must be local
+	params, state = login("//evil.example.com/")
+	w = callback("code=the-code&state="+params.Get("state"), state, provider.sign(t, claims(params.Get("nonce"))))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Errorf("unexpected redirect after login: %v", w.Header().Get("Location"))
+	}
+
+	// Failed logins
+	params, state = login("/")
+	valid := provider.sign(t, claims(params.Get("nonce")))
+	for name, test := range map[string]struct {
+		query   string
+		state   *http.Cookie
+		idToken string
+		status  int
+	}{
+		"missing state":    {"code=the-code&state=" + params.Get("state"), nil, valid, http.StatusBadRequest},
+		"mismatched state": {"code=the-code&state=other", state, valid, http.StatusBadRequest},
+		"provider error":   {"error=access_denied&state=" + params.Get("state"), state, valid, http.StatusUnauthorized},
+		"missing code":     {"state=" + params.Get("state"), state, valid, http.StatusBadRequest},
+		"wrong nonce":      {"code=the-code&state=" + params.Get("state"), state, provider.sign(t, claims("other")), http.StatusUnauthorized},
+		"unsigned token":   {"code=the-code&state=" + params.Get("state"), state, unsignedJwt(t, claims(params.Get("nonce"))), http.StatusUnauthorized},
+	} {
+		w := callback(test.query, test.state, test.idToken)
+		if w.Code != test.status {
+			t.Errorf("%v: expected status %v, got %v", name, test.status, w.Code)
+		}
+		if idTokenCookie(w) != nil {
+			t.Errorf("%v: ID Token cookie set", name)
+		}
+	}
+}
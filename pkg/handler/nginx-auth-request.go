@@ -1,13 +1,30 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/EOEPCA/uma-user-agent/pkg/authcache"
+	"github.com/EOEPCA/uma-user-agent/pkg/breaker"
+	"github.com/EOEPCA/uma-user-agent/pkg/bulkhead"
 	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/oidc"
+	"github.com/EOEPCA/uma-user-agent/pkg/redact"
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+	"github.com/EOEPCA/uma-user-agent/pkg/tracing"
 	"github.com/EOEPCA/uma-user-agent/pkg/uma"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // HTTP Header Names
@@ -19,30 +36,81 @@ const headerNameXAuthRptOptions = "X-Auth-Rpt-Options"
 
 // ClientRequestDetails represents the details of the 'incoming' request made by the client
 type ClientRequestDetails struct {
+	RequestId         string
 	OrigUri           string
 	OrigMethod        string
 	UserIdToken       string
 	UserIdTokenSource TokenSource
 	Rpt               string
+	Pct               string
+	SessionId         string
 	Tries             int
+	Decision          string
+	AuthServerUrl     string
+	FromCache         bool
+	ClientIp          string
+	// Config is the configuration snapshot taken at the start of the request
+	Config *config.Config
+	// The `sub` of the User ID Token, once checked - see getVerifiedSubject
+	verifiedSubject string
+	subjectChecked  bool
+}
+
+// getVerifiedSubject returns the `sub` of the User ID Token if the token is verified
+// against the keys of the configured OIDC provider - else blank. The outcome is retained
+// for the request, so that the token is verified only once.
+func getVerifiedSubject(ctx context.Context, clientRequestDetails *ClientRequestDetails) string {
+	if !clientRequestDetails.subjectChecked {
+		clientRequestDetails.subjectChecked = true
+		if issuer := clientRequestDetails.Config.OidcIssuer; len(clientRequestDetails.UserIdToken) > 0 && len(issuer) > 0 {
+			claims, err := oidc.GetProvider(issuer).VerifyIdToken(ctx, clientRequestDetails.UserIdToken)
+			if err != nil {
+				GetRequestLogger(clientRequestDetails).Debugf("User ID Token not verified: %v", err)
+			} else {
+				clientRequestDetails.verifiedSubject = claims.Subject
+			}
+		}
+	}
+	return clientRequestDetails.verifiedSubject
+}
+
+// getAuditSubject returns the `sub` of the User ID Token for the audit record, and whether
+// it is verified. The verified `sub` is that resolved during the decision. In the absence
+// of a configured OIDC provider, against which the token could be verified, the `sub` is
+// taken from the unverified token.
+func getAuditSubject(clientRequestDetails *ClientRequestDetails) (subject string, verified bool) {
+	if len(clientRequestDetails.verifiedSubject) > 0 {
+		return clientRequestDetails.verifiedSubject, true
+	}
+	if len(clientRequestDetails.Config.OidcIssuer) == 0 && len(clientRequestDetails.UserIdToken) > 0 {
+		claims, _ := oidc.ParseIdTokenClaims(clientRequestDetails.UserIdToken)
+		subject = claims.Subject
+	}
+	return
 }
 
 // GetRequestLogger returns a logger with fields set from the supplied client request details
 func GetRequestLogger(clientRequestDetails *ClientRequestDetails) *logrus.Entry {
 	return logrus.StandardLogger().WithFields(logrus.Fields{
-		"origUri":    clientRequestDetails.OrigUri,
-		"origMethod": clientRequestDetails.OrigMethod,
-		"attempt":    clientRequestDetails.Tries,
+		logging.FieldRequestId: clientRequestDetails.RequestId,
+		"origUri":              clientRequestDetails.OrigUri,
+		"origMethod":           clientRequestDetails.OrigMethod,
+		"attempt":              clientRequestDetails.Tries,
 	})
 }
 
 // wrappedResponseWriter provides access to the StatusCode that is written to the http header,
-// for the purposes of request logging
+// and the (start of the) response body that explains it - for the purposes of request logging
+// and auditing
 type wrappedResponseWriter struct {
 	http.ResponseWriter
 	StatusCode int
+	Body       strings.Builder
 }
 
+// maxCapturedBody limits the response body that is retained by the wrappedResponseWriter
+const maxCapturedBody = 256
+
 // Override (wrap) the WriteHeader function to take a note of the status code - exposed via
 // a public (exported) value.
 func (rl *wrappedResponseWriter) WriteHeader(statusCode int) {
@@ -50,6 +118,17 @@ func (rl *wrappedResponseWriter) WriteHeader(statusCode int) {
 	rl.StatusCode = statusCode
 }
 
+// Override (wrap) the Write function to take a note of the start of the response body
+func (rl *wrappedResponseWriter) Write(data []byte) (int, error) {
+	if remaining := maxCapturedBody - rl.Body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		rl.Body.Write(data[:remaining])
+	}
+	return rl.ResponseWriter.Write(data)
+}
+
 // Helper function to log the request completion including the status code.
 func (rl *wrappedResponseWriter) LogRequestCompletion(requestLogger *logrus.Entry) {
 	requestLogger.WithField("statusCode", rl.StatusCode).Info("Request complete")
@@ -57,20 +136,41 @@ func (rl *wrappedResponseWriter) LogRequestCompletion(requestLogger *logrus.Entr
 
 // pepResponseHandlerFunc defines the function prototype for functions able to
 // handle the response to an `auth_request` made to the PEP
-type pepResponseHandlerFunc func(*ClientRequestDetails, *http.Response, http.ResponseWriter, *http.Request)
+type pepResponseHandlerFunc func(context.Context, *ClientRequestDetails, *http.Response, http.ResponseWriter, *http.Request)
 
 // NginxAuthRequestHandler is the entrypoint handler for the nginx `auth_request` implementation
 func NginxAuthRequestHandler(rw http.ResponseWriter, r *http.Request) {
 	var clientRequestDetails *ClientRequestDetails
+	// Continue the trace from nginx (traceparent), or start a new one
+	ctx, span := tracing.Tracer().Start(tracing.Extract(r), "auth_request", trace.WithSpanKind(trace.SpanKindServer))
+	// Bound the overall time of the decision, across all retries and authorization attempts
+	if timeout := config.FromContext(ctx).AuthDecisionTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
 	// Ensure that request status is logged at completion
-	w := &wrappedResponseWriter{rw, http.StatusOK}
+	w := &wrappedResponseWriter{ResponseWriter: rw, StatusCode: http.StatusOK}
 	defer func() {
 		w.LogRequestCompletion(GetRequestLogger(clientRequestDetails))
+		recordDecision(config.FromContext(ctx), clientRequestDetails, w.StatusCode)
+		auditDecision(clientRequestDetails, w)
+		span.SetAttributes(
+			attribute.String("auth.orig_uri", clientRequestDetails.OrigUri),
+			attribute.String("auth.orig_method", clientRequestDetails.OrigMethod),
+			attribute.String("auth.token_source", clientRequestDetails.UserIdTokenSource.String()),
+			attribute.Int("auth.attempts", clientRequestDetails.Tries),
+			attribute.Int("http.status_code", w.StatusCode),
+		)
+		span.End()
 	}()
 
 	// Gather expected info from headers/cookies
 	clientRequestDetails, err := processRequestHeaders(w, r)
 	requestLogger := GetRequestLogger(clientRequestDetails)
+	// Resolve the user's `sub` for the audit record - within the decision deadline
+	getVerifiedSubject(r.Context(), clientRequestDetails)
 	if err != nil {
 		requestLogger.Error("ERROR processing request headers: ", err)
 		return
@@ -81,16 +181,72 @@ func NginxAuthRequestHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Use a previously cached decision if there is one
+	if nginxAuthRequestHandlerCached(clientRequestDetails, w, r) {
+		return
+	}
+
 	// Defer the Authorization decision to the PEP
 	requestLogger.Debug("START handling new request")
 	requestLogger.Debugf("%s: %s", "User ID Token SOURCE", clientRequestDetails.UserIdTokenSource)
-	deferAuthorizationToPep(clientRequestDetails, w, r)
+	deferAuthorizationToPep(r.Context(), clientRequestDetails, w, r)
 }
 
-func deferAuthorizationToPep(clientRequestDetails *ClientRequestDetails, w http.ResponseWriter, r *http.Request) {
+// recordDecision counts the outcome of the request
+func recordDecision(cfg *config.Config, clientRequestDetails *ClientRequestDetails, statusCode int) {
+	decision := getDecision(clientRequestDetails, statusCode)
+	metrics.Decisions.WithLabelValues(decision, getRoute(cfg, clientRequestDetails.OrigUri), clientRequestDetails.UserIdTokenSource.String()).Inc()
+}
+
+// getDecision returns the outcome of the request. In the absence of an explicit
+// (error) decision, the outcome is deduced from the response status code.
+func getDecision(clientRequestDetails *ClientRequestDetails, statusCode int) (decision string) {
+	decision = clientRequestDetails.Decision
+	if len(decision) == 0 {
+		switch {
+		case statusCode >= 200 && statusCode <= 299:
+			decision = metrics.DecisionAllow
+		case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+			decision = metrics.DecisionDeny
+		default:
+			decision = metrics.DecisionError
+		}
+	}
+	return
+}
+
+// getRoute returns the 'route' of the requested resource for use as a metric label - the
+// longest of the configured routes that prefixes its path, else "other". Thus the label
+// values are bounded by the configuration, rather than by the requests.
+func getRoute(cfg *config.Config, origUri string) (route string) {
+	route = "other"
+	path := strings.SplitN(origUri, "?", 2)[0]
+	longest := -1
+	for _, prefix := range cfg.MetricsRoutes {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if (path == prefix || path == trimmed || strings.HasPrefix(path, trimmed+"/")) && len(trimmed) > longest {
+			route, longest = prefix, len(trimmed)
+		}
+	}
+	return
+}
+
+// deferAuthorizationToPep makes an authorization attempt via the PEP. The context is that of
+// the incoming request, which bounds the time of the attempt (and any retries).
+func deferAuthorizationToPep(ctx context.Context, clientRequestDetails *ClientRequestDetails, w http.ResponseWriter, r *http.Request) {
 	// Increment the 'try' counter
 	clientRequestDetails.Tries += 1
 	requestLogger := GetRequestLogger(clientRequestDetails)
+
+	// Abandon if the deadline has passed, or the client has gone away
+	if err := ctx.Err(); err != nil {
+		msg := "authorization abandoned - deadline exceeded or request cancelled"
+		requestLogger.Warn(fmt.Errorf("%s: %w", msg, err))
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
+		fmt.Fprint(w, msg)
+		return
+	}
 	if clientRequestDetails.Tries > 1 {
 		requestLogger.Warningf("Authorization retry attempt #%d", clientRequestDetails.Tries-1)
 	} else {
@@ -98,23 +254,30 @@ func deferAuthorizationToPep(clientRequestDetails *ClientRequestDetails, w http.
 	}
 
 	// Naive call to the PEP
+	if checkRateLimit(ctx, clientRequestDetails, pepRateLimiters, w, requestLogger) {
+		return
+	}
 	requestLogger.Debug("Calling PEP `auth_request` initial (naive) attempt")
-	pepResponse, err := pepAuthRequest(clientRequestDetails, requestLogger)
+	pepResponse, err := pepAuthRequest(ctx, clientRequestDetails, requestLogger)
+	if handleUpstreamUnavailable(clientRequestDetails, err, w, requestLogger) {
+		return
+	}
 	if err != nil {
 		msg := "ERROR making naive call to the pep auth_request endpoint"
 		requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 		return
 	}
 
 	// Handle the response
-	handlePepResponse(clientRequestDetails, pepResponse, handlePepNaiveUnauthorized, w, r)
+	handlePepResponse(ctx, clientRequestDetails, pepResponse, handlePepNaiveUnauthorized, w, r)
 }
 
 // nginxAuthRequestHandlerOpen provides an nginx `auth_request` handler for OPEN access
 func nginxAuthRequestHandlerOpen(clientRequestDetails *ClientRequestDetails, w http.ResponseWriter, r *http.Request) (requestHandled bool) {
-	requestHandled = config.IsOpenAccess()
+	requestHandled = clientRequestDetails.Config.OpenAccess
 	if requestHandled {
 		// Pass on the User ID Token if provided in the request
 		w.Header().Set(headerNameXUserId, clientRequestDetails.UserIdToken)
@@ -124,8 +287,52 @@ func nginxAuthRequestHandlerOpen(clientRequestDetails *ClientRequestDetails, w h
 	return
 }
 
+// nginxAuthRequestHandlerCached provides an nginx `auth_request` handler for requests that
+// match a previously cached authorization decision
+func nginxAuthRequestHandlerCached(clientRequestDetails *ClientRequestDetails, w http.ResponseWriter, r *http.Request) (requestHandled bool) {
+	if clientRequestDetails.Config.AuthCacheMaxAge <= 0 || len(clientRequestDetails.UserIdToken) == 0 {
+		return
+	}
+	entry, requestHandled := authcache.Decisions.Load(newAuthCacheEntry(clientRequestDetails))
+	metrics.RecordCacheLookup("decision", requestHandled)
+	if requestHandled {
+		clientRequestDetails.FromCache = true
+		GetRequestLogger(clientRequestDetails).Debug("Using cached authorization decision")
+		w.Header().Set(headerNameXUserId, clientRequestDetails.UserIdToken)
+		if len(clientRequestDetails.SessionId) == 0 {
+			setRptCookieInResponse(clientRequestDetails.Config, entry.Rpt, w, GetRequestLogger(clientRequestDetails))
+		}
+		fmt.Fprint(w, "Authorized by cached decision")
+	}
+	return
+}
+
+// cacheAuthorizationDecision records the successful authorization for the configured duration
+func cacheAuthorizationDecision(clientRequestDetails *ClientRequestDetails) {
+	maxAge := clientRequestDetails.Config.AuthCacheMaxAge
+	if maxAge <= 0 || len(clientRequestDetails.UserIdToken) == 0 {
+		return
+	}
+	entry := newAuthCacheEntry(clientRequestDetails)
+	entry.Rpt = clientRequestDetails.Rpt
+	entry.Expiry = time.Now().Add(maxAge)
+	authcache.Decisions.Store(entry)
+}
+
+// newAuthCacheEntry returns a cache entry populated with the key elements of the request
+func newAuthCacheEntry(clientRequestDetails *ClientRequestDetails) authcache.AuthCacheEntry {
+	claims, _ := oidc.ParseIdTokenClaims(clientRequestDetails.UserIdToken)
+	return authcache.AuthCacheEntry{
+		UserID:        claims.Subject,
+		IDTokenHash:   authcache.HashToken(clientRequestDetails.UserIdToken),
+		ResourcePath:  clientRequestDetails.OrigUri,
+		RequestMethod: clientRequestDetails.OrigMethod,
+	}
+}
+
 // handlePepResponse is a helper function to handle the response from the PEP's `auth_request` endpoint
-func handlePepResponse(clientRequestDetails *ClientRequestDetails, pepResponse *http.Response, unauthResponseHandler pepResponseHandlerFunc, w http.ResponseWriter, r *http.Request) {
+func handlePepResponse(ctx context.Context, clientRequestDetails *ClientRequestDetails, pepResponse *http.Response, unauthResponseHandler pepResponseHandlerFunc, w http.ResponseWriter, r *http.Request) {
+	defer discardResponseBody(pepResponse)
 	requestLogger := GetRequestLogger(clientRequestDetails)
 	switch code := pepResponse.StatusCode; {
 	case code >= 200 && code <= 299:
@@ -133,7 +340,14 @@ func handlePepResponse(clientRequestDetails *ClientRequestDetails, pepResponse *
 		msg := fmt.Sprintf("PEP authorized the request with code: %v", code)
 		requestLogger.Debug(msg)
 		w.Header().Set(headerNameXUserId, clientRequestDetails.UserIdToken)
-		setRptCookieInResponse(clientRequestDetails.Rpt, w)
+		if len(clientRequestDetails.SessionId) > 0 {
+			if err := saveRptToSession(clientRequestDetails); err != nil {
+				requestLogger.Error(fmt.Errorf("error saving RPT to session: %w", err))
+			}
+		} else {
+			setRptCookieInResponse(clientRequestDetails.Config, clientRequestDetails.Rpt, w, requestLogger)
+		}
+		cacheAuthorizationDecision(clientRequestDetails)
 		w.WriteHeader(code)
 		fmt.Fprint(w, msg)
 	case code == 401:
@@ -142,15 +356,15 @@ func handlePepResponse(clientRequestDetails *ClientRequestDetails, pepResponse *
 		requestLogger.Debug(msg)
 		// Use specific handler if it's been provided
 		if unauthResponseHandler != nil {
-			unauthResponseHandler(clientRequestDetails, pepResponse, w, r)
+			unauthResponseHandler(ctx, clientRequestDetails, pepResponse, w, r)
 		} else {
 			// If) we have remaining retry attempts, then go back around the loop
 			// Else) retries are exhausted, so return unauthorized
-			if (clientRequestDetails.Tries - 1) < config.GetRetriesAuthorizationAttempt() {
-				deferAuthorizationToPep(clientRequestDetails, w, r)
+			if (clientRequestDetails.Tries - 1) < clientRequestDetails.Config.RetriesAuthorizationAttempt {
+				deferAuthorizationToPep(ctx, clientRequestDetails, w, r)
 			} else {
-				requestLogger.Debugf("RPT was not accepted: %s", clientRequestDetails.Rpt)
-				WriteHeaderUnauthorized(w)
+				requestLogger.Debugf("RPT was not accepted: %s", redact.Token(clientRequestDetails.Rpt))
+				WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 				fmt.Fprint(w, msg)
 			}
 		}
@@ -164,7 +378,8 @@ func handlePepResponse(clientRequestDetails *ClientRequestDetails, pepResponse *
 		// UNEXPECTED
 		msg := fmt.Sprintf("Unexpected return code from PEP auth_request endpoint: %v", code)
 		requestLogger.Error(msg)
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 	}
 }
@@ -172,14 +387,19 @@ func handlePepResponse(clientRequestDetails *ClientRequestDetails, pepResponse *
 // processRequestHeaders is a helper function to extract the expected information from the
 // http headers of the received `auth_request`
 func processRequestHeaders(w http.ResponseWriter, r *http.Request) (details *ClientRequestDetails, err error) {
-	details = &ClientRequestDetails{}
+	details = &ClientRequestDetails{Config: config.FromContext(r.Context())}
 	err = nil
 
+	_, span := tracing.Tracer().Start(r.Context(), "processRequestHeaders")
+	defer span.End()
+
 	details.UserIdTokenSource = TS_Undefined
 
 	// Gather expected info from headers/cookies
+	details.RequestId = logging.RequestIdFromContext(r.Context())
 	details.OrigUri = r.Header.Get(headerNameXOriginalUri)
 	details.OrigMethod = r.Header.Get(headerNameXOriginalMethod)
+	details.ClientIp = getClientIp(r)
 
 	// User ID Token has a number of sources. In prority order...
 	//
@@ -194,28 +414,52 @@ func processRequestHeaders(w http.ResponseWriter, r *http.Request) (details *Cli
 			details.UserIdTokenSource = TS_Header
 		} else {
 			// 3. `auth_user_id` (name configurable) cookie
-			c, err := r.Cookie(config.GetUserIdCookieName())
+			c, err := r.Cookie(details.Config.UserIdCookieName)
 			if err == nil {
 				details.UserIdToken = c.Value
 				details.UserIdTokenSource = TS_Cookie
 			}
 		}
 	}
+	// 4. Server-side session referenced by the `auth_session` (name configurable) cookie
+	var userSession session.Session
+	if details.UserIdTokenSource == TS_Undefined {
+		id, s, ok, err := loadSession(r)
+		if err != nil {
+			GetRequestLogger(details).Error(fmt.Errorf("error loading session: %w", err))
+		} else if ok {
+			userSession = s
+			details.SessionId = id
+			details.UserIdToken = s.IdToken
+			details.UserIdTokenSource = TS_Session
+			details.Pct = s.Pct
+		}
+	}
 
 	// RPT
 	// Priority order...
 	//   1. From cookie
-	//   2. From Bearer - also interpreted as user ID token
+	//   2. From session
+	//   3. From Bearer - also interpreted as user ID token
 	{
-		c, err := r.Cookie(config.GetAuthRptCookieName())
+		c, err := r.Cookie(details.Config.AuthRptCookieName)
 		// 1. From cookie
 		if err == nil {
-			details.Rpt = c.Value
-		} else {
-			// 2. From Bearer
-			if details.UserIdTokenSource == TS_Bearer {
-				details.Rpt = details.UserIdToken
+			if rpt, err := unsealRpt(details.Config, c.Value); err == nil {
+				details.Rpt = rpt
+			} else {
+				GetRequestLogger(details).Warn(fmt.Errorf("ignoring RPT cookie that could not be unsealed: %w", err))
 			}
+		} else if details.UserIdTokenSource == TS_Session {
+			// 2. From session
+			rpt, ok := userSession.GetRpt(getResource(details.OrigUri))
+			metrics.RecordCacheLookup("sessionRpt", ok)
+			if ok {
+				details.Rpt = rpt.Value
+			}
+		} else if details.UserIdTokenSource == TS_Bearer {
+			// 3. From Bearer
+			details.Rpt = details.UserIdToken
 		}
 	}
 
@@ -225,13 +469,14 @@ func processRequestHeaders(w http.ResponseWriter, r *http.Request) (details *Cli
 	// Some verbose logging
 	requestLogger.Tracef("%s: %s", headerNameXOriginalMethod, details.OrigMethod)
 	requestLogger.Tracef("%s: %s", headerNameXOriginalUri, details.OrigUri)
-	requestLogger.Tracef("%s: %s", headerNameXUserId, details.UserIdToken)
-	requestLogger.Tracef("%s: %s", headerNameXAuthRpt, details.Rpt)
+	requestLogger.Tracef("%s: %s", headerNameXUserId, redact.Token(details.UserIdToken))
+	requestLogger.Tracef("%s: %s", headerNameXAuthRpt, redact.Token(details.Rpt))
 
 	// Check details are complete
 	if len(details.OrigUri) == 0 || len(details.OrigMethod) == 0 {
 		err = fmt.Errorf("mandatory header values missing")
-		WriteHeaderUnauthorized(w)
+		details.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(details.Config, w)
 		fmt.Fprintln(w, "ERROR: Expecting non-zero values for the following data...")
 		fmt.Fprintf(w, "  Original URI:    %v\n    [header %v]\n", details.OrigUri, headerNameXOriginalUri)
 		fmt.Fprintf(w, "  Original Method: %v\n    [header %v]\n", details.OrigMethod, headerNameXOriginalMethod)
@@ -264,12 +509,23 @@ func getBearerTokenFromAuthHeader(r *http.Request) (token string) {
 }
 
 // pepAuthRequest calls the PEP `auth_request` endpoint
-func pepAuthRequest(details *ClientRequestDetails, requestLogger *logrus.Entry) (response *http.Response, err error) {
+func pepAuthRequest(ctx context.Context, details *ClientRequestDetails, requestLogger *logrus.Entry) (response *http.Response, err error) {
 	response = nil
 	err = nil
 
+	ctx, span := tracing.Tracer().Start(ctx, "pepAuthRequest", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Bool("auth.with_rpt", len(details.Rpt) > 0)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+		}
+		span.End()
+	}()
+
 	// Prepare the request
-	pepReq, err := http.NewRequest("GET", config.GetPepUrl(), nil)
+	pepReq, err := http.NewRequestWithContext(ctx, "GET", details.Config.PepUrl, nil)
 	if err != nil {
 		err = fmt.Errorf("error establishing request for PEP: %w", err)
 		return
@@ -284,7 +540,9 @@ func pepAuthRequest(details *ClientRequestDetails, requestLogger *logrus.Entry)
 	}
 
 	// Send the request
+	start := time.Now()
 	response, err = uma.MakeResilentRequest(pepReq, requestLogger, "pepAuthRequest")
+	metrics.UpstreamDuration.WithLabelValues("pepAuthRequest").Observe(time.Since(start).Seconds())
 	if err != nil {
 		response = nil
 		err = fmt.Errorf("error requesting auth from PEP: %w", err)
@@ -295,13 +553,17 @@ func pepAuthRequest(details *ClientRequestDetails, requestLogger *logrus.Entry)
 
 // handlePepNaiveUnauthorized provides the behaviour that is triggered by a 401 (Unauthorized)
 // response to a naive (no RPT) request to the PEP `auth_request` endpoint
-func handlePepNaiveUnauthorized(clientRequestDetails *ClientRequestDetails, pepUnauthResponse *http.Response, w http.ResponseWriter, r *http.Request) {
+func handlePepNaiveUnauthorized(ctx context.Context, clientRequestDetails *ClientRequestDetails, pepUnauthResponse *http.Response, w http.ResponseWriter, r *http.Request) {
+	// Only the headers are needed - so release the connection before the exchange with the
+	// Authorization Server
+	discardResponseBody(pepUnauthResponse)
 	requestLogger := GetRequestLogger(clientRequestDetails)
 	// Check that this is a 401 response
 	if pepUnauthResponse.StatusCode != http.StatusUnauthorized {
 		msg := "not an Unauthorized response"
 		requestLogger.Error(msg)
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 		return
 	}
@@ -311,7 +573,8 @@ func handlePepNaiveUnauthorized(clientRequestDetails *ClientRequestDetails, pepU
 	if len(wwwAuthHeader) == 0 {
 		msg := "no Www-Authenticate header in PEP response"
 		requestLogger.Error(msg)
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 		return
 	}
@@ -321,24 +584,39 @@ func handlePepNaiveUnauthorized(clientRequestDetails *ClientRequestDetails, pepU
 	if err != nil {
 		msg := "could not parse the Www-Authenticate header"
 		requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 		return
 	}
+	clientRequestDetails.AuthServerUrl = authServerUrl
 	// Store the Authorization Server
 	authServer, _ := uma.AuthorizationServers.LoadOrStore(requestLogger, authServerUrl, *uma.NewAuthorizationServer(authServerUrl))
 	if len(authServer.GetUrl()) == 0 {
 		msg := "error getting the Authorization Server details"
 		requestLogger.Error(msg)
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 		return
 	}
 
 	// Exchange the ticket for an RPT at the Authorization Server
-	umaClient := &uma.UmaClient{Id: config.GetClientId(), Secret: config.GetClientSecret()}
+	if checkRateLimit(ctx, clientRequestDetails, asRateLimiters, w, requestLogger) {
+		return
+	}
+	cfg := clientRequestDetails.Config
+	client, specific := cfg.GetAuthServerClient(authServerUrl)
+	if specific {
+		requestLogger.Debugf("Using client %v configured for the Authorization Server", client.ClientId)
+	}
+	umaClient := &uma.UmaClient{Id: client.ClientId, Secret: client.ClientSecret, PreviousSecret: client.PreviousClientSecret, AuthMethod: client.AuthMethod}
 	var forbidden bool
-	clientRequestDetails.Rpt, forbidden, err = umaClient.ExchangeTicketForRpt(requestLogger, authServer, clientRequestDetails.UserIdToken, ticket)
+	var pct string
+	clientRequestDetails.Rpt, pct, forbidden, err = umaClient.ExchangeTicketForRptWithPct(ctx, requestLogger, authServer, clientRequestDetails.UserIdToken, ticket, clientRequestDetails.Pct)
+	if handleUpstreamUnavailable(clientRequestDetails, err, w, requestLogger) {
+		return
+	}
 	if err != nil {
 		var msg string
 		if forbidden {
@@ -348,7 +626,8 @@ func handlePepNaiveUnauthorized(clientRequestDetails *ClientRequestDetails, pepU
 		} else {
 			msg = "error getting RPT from Authorization Server"
 			requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
-			WriteHeaderUnauthorized(w)
+			clientRequestDetails.Decision = metrics.DecisionError
+			WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		}
 		fmt.Fprint(w, msg)
 		return
@@ -358,33 +637,89 @@ func handlePepNaiveUnauthorized(clientRequestDetails *ClientRequestDetails, pepU
 	if len(clientRequestDetails.Rpt) == 0 {
 		msg := "the RPT obtained is blank"
 		requestLogger.Error(msg)
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 		return
 	}
-	requestLogger.Tracef("Obtained RPT: %s", clientRequestDetails.Rpt)
+	requestLogger.Tracef("Obtained RPT: %s", redact.Token(clientRequestDetails.Rpt))
+	if len(pct) > 0 {
+		clientRequestDetails.Pct = pct
+	}
 
 	// Refresh the request logger with updated client details
 	requestLogger = GetRequestLogger(clientRequestDetails)
 
 	// Call the PEP with the RPT
+	if checkRateLimit(ctx, clientRequestDetails, pepRateLimiters, w, requestLogger) {
+		return
+	}
 	requestLogger.Debug("Calling PEP `auth_request` with RPT")
-	pepResponse, err := pepAuthRequest(clientRequestDetails, requestLogger)
+	pepResponse, err := pepAuthRequest(ctx, clientRequestDetails, requestLogger)
+	if handleUpstreamUnavailable(clientRequestDetails, err, w, requestLogger) {
+		return
+	}
 	if err != nil {
 		msg := "ERROR making call (with RPT) to the pep auth_request endpoint"
 		requestLogger.Error(fmt.Errorf("%s: %w", msg, err))
-		WriteHeaderUnauthorized(w)
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
 		fmt.Fprint(w, msg)
 		return
 	}
 
 	// Handle the response
-	handlePepResponse(clientRequestDetails, pepResponse, nil, w, r)
+	handlePepResponse(ctx, clientRequestDetails, pepResponse, nil, w, r)
 }
 
-// WriteHeaderUnauthorized writes the header response to indicate unauthorized
-func WriteHeaderUnauthorized(w http.ResponseWriter) {
-	w.Header().Set("Www-Authenticate", config.GetUnauthorizedResponse())
+// discardResponseBody drains and closes the body of the upstream response, so that its
+// connection can be reused
+func discardResponseBody(response *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	response.Body.Close()
+}
+
+// handleUpstreamUnavailable provides the response if the error is due to an upstream that
+// is not being called...
+// * saturated (request shed): 503 (Service Unavailable), with Retry-After of the queue timeout
+// * open circuit breaker: the configured (fail-open or fail-closed) response
+func handleUpstreamUnavailable(clientRequestDetails *ClientRequestDetails, err error, w http.ResponseWriter, requestLogger *logrus.Entry) (requestHandled bool) {
+	if errors.Is(err, bulkhead.ErrShed) {
+		msg := "Service unavailable - upstream saturated"
+		requestLogger.Warn(fmt.Errorf("%s: %w", msg, err))
+		clientRequestDetails.Decision = metrics.DecisionError
+		retryAfter := int(math.Ceil(clientRequestDetails.Config.LoadSheddingQueueTimeout.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, msg)
+		return true
+	}
+	requestHandled = errors.Is(err, breaker.ErrOpen)
+	if !requestHandled {
+		return
+	}
+	if clientRequestDetails.Config.CircuitBreakerFailOpen {
+		msg := "Allowing access (fail-open) while upstream circuit is open"
+		requestLogger.Warn(fmt.Errorf("%s: %w", msg, err))
+		w.Header().Set(headerNameXUserId, clientRequestDetails.UserIdToken)
+		fmt.Fprint(w, msg)
+	} else {
+		msg := "Denying access (fail-closed) while upstream circuit is open"
+		requestLogger.Warn(fmt.Errorf("%s: %w", msg, err))
+		clientRequestDetails.Decision = metrics.DecisionError
+		WriteHeaderUnauthorized(clientRequestDetails.Config, w)
+		fmt.Fprint(w, msg)
+	}
+	return
+}
+
+// WriteHeaderUnauthorized writes the header response to indicate unauthorized, with the
+// unauthorized response of the supplied configuration snapshot
+func WriteHeaderUnauthorized(cfg *config.Config, w http.ResponseWriter) {
+	w.Header().Set("Www-Authenticate", cfg.UnauthorizedResponse)
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
@@ -392,10 +727,25 @@ func WriteHeaderUnauthorized(w http.ResponseWriter) {
 // Two headers are used:
 // * one for the RPT
 // * one for the additional cookie options
-func setRptCookieInResponse(rpt string, w http.ResponseWriter) {
-	w.Header().Set(headerNameXAuthRpt, rpt)
-	w.Header().Set(headerNameXAuthRptOptions,
-		fmt.Sprintf("Path=/; Secure; HttpOnly; SameSite=Strict; Max-Age=%d", config.GetAuthRptCookieMaxAge()))
+// If configured, the RPT is sealed so that the client only holds an opaque value.
+func setRptCookieInResponse(cfg *config.Config, rpt string, w http.ResponseWriter, requestLogger *logrus.Entry) {
+	value, err := sealRpt(cfg, rpt)
+	if err != nil {
+		requestLogger.Error(fmt.Errorf("RPT cookie not set - error sealing RPT: %w", err))
+		return
+	}
+	w.Header().Set(headerNameXAuthRpt, value)
+	w.Header().Set(headerNameXAuthRptOptions, getRptCookieOptions(cfg))
+}
+
+// getRptCookieOptions returns the attributes with which nginx sets the RPT cookie - which
+// must match those with which it is cleared at logout
+func getRptCookieOptions(cfg *config.Config) string {
+	options := fmt.Sprintf("Path=%s; ", cfg.AuthRptCookiePath)
+	if len(cfg.AuthRptCookieDomain) > 0 {
+		options += fmt.Sprintf("Domain=%s; ", cfg.AuthRptCookieDomain)
+	}
+	return options + fmt.Sprintf("Secure; HttpOnly; SameSite=Strict; Max-Age=%d", cfg.AuthRptCookieMaxAge)
 }
 
 //------------------------------------------------------------------------------
@@ -410,6 +760,7 @@ const (
 	TS_Bearer
 	TS_Header
 	TS_Cookie
+	TS_Session
 )
 
 func (ts TokenSource) String() string {
@@ -422,6 +773,8 @@ func (ts TokenSource) String() string {
 		return "Header"
 	case TS_Cookie:
 		return "Cookie"
+	case TS_Session:
+		return "Session"
 	default:
 		return "Unknown"
 	}
@@ -0,0 +1,371 @@
+package handler_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestDecisionRoutes tests that the decisions are counted by the longest configured route
+// that prefixes the path - else as 'other', whatever path the client requests - and that
+// the metrics are served by the admin API
+func TestDecisionRoutes(t *testing.T) {
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pep.Close()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--pep.url=" + pep.URL, "--admin.bearerToken=admin-token",
+		"--metrics.routes=/ades,/ades/jobs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uri := range []string{"/ades/jobs/1", "/ades?x=1", "/adesx/1", "/random-4711"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", uri)
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		handler.NginxAuthRequestHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status %v", uri, w.Code)
+		}
+	}
+
+	router := handler.NewAdminRouter(mux.NewRouter())
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v for the metrics", w.Code)
+	}
+	body, _ := io.ReadAll(w.Body)
+	for _, label := range []string{`route="/ades"`, `route="/ades/jobs/"`, `route="other"`} {
+		if !strings.Contains(string(body), label) {
+			t.Errorf("expected decisions with %v", label)
+		}
+	}
+	for _, label := range []string{`route="/adesx"`, `route="/random-4711"`} {
+		if strings.Contains(string(body), label) {
+			t.Errorf("unexpected decisions with %v", label)
+		}
+	}
+}
+
+// TestUnauthorizedResponse tests that the unauthorized response is taken from the
+// configuration snapshot of the request - not from a configuration reloaded meanwhile
+func TestUnauthorizedResponse(t *testing.T) {
+	if err := config.ParseFlags("test", []string{"--unauthorizedResponse=Bearer realm=\"before\""}); err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--unauthorizedResponse=Please login to access the resource"})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(config.NewContext(r.Context(), config.Get()))
+	if err := config.ParseFlags("test", []string{"--unauthorizedResponse=Bearer realm=\"after\""}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request lacks the mandatory X-Original-Uri
+	w := httptest.NewRecorder()
+	handler.NginxAuthRequestHandler(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Www-Authenticate") != `Bearer realm="before"` {
+		t.Errorf("unexpected response %v: %q", w.Code, w.Header().Get("Www-Authenticate"))
+	}
+}
+
+// TestDecisionCache tests that a successful decision is reused for the same User ID Token,
+// method and URI without consulting the PEP - until the user logs out
+func TestDecisionCache(t *testing.T) {
+	var mutex sync.Mutex
+	pepCalls := 0
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		pepCalls++
+	}))
+	defer pep.Close()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--pep.url=" + pep.URL, "--authCache.maxAge=60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--authCache.maxAge=0"})
+	idToken := unsignedJwt(t, map[string]interface{}{"sub": "cached-user", "exp": time.Now().Add(time.Hour).Unix()})
+
+	authorize := func(uri string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", uri)
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		r.AddCookie(&http.Cookie{Name: "auth_user_id", Value: idToken})
+		w := httptest.NewRecorder()
+		handler.NginxAuthRequestHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status %v", uri, w.Code)
+		}
+	}
+	expectPepCalls := func(expected int) {
+		t.Helper()
+		mutex.Lock()
+		defer mutex.Unlock()
+		if pepCalls != expected {
+			t.Errorf("expected %d PEP calls, got %d", expected, pepCalls)
+		}
+	}
+
+	authorize("/ades/jobs")
+	authorize("/ades/jobs")
+	expectPepCalls(1)
+	authorize("/ades/processes")
+	expectPepCalls(2)
+
+	// Logout drops the cached decisions of the user
+	r := httptest.NewRequest(http.MethodPost, "http://agent.example.org/logout", nil)
+	r.AddCookie(&http.Cookie{Name: "auth_user_id", Value: idToken})
+	w := httptest.NewRecorder()
+	handler.NewLoginRouter(mux.NewRouter()).ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected logout status %v", w.Code)
+	}
+	authorize("/ades/jobs")
+	expectPepCalls(3)
+}
+
+// TestPepResponseBodyClosed tests that the PEP response bodies are drained and closed, so
+// that the connections to the PEP are reused across decisions
+func TestPepResponseBodyClosed(t *testing.T) {
+	var mutex sync.Mutex
+	connections := 0
+	pep := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, strings.Repeat("forbidden ", 1000))
+	}))
+	pep.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			defer mutex.Unlock()
+			connections++
+		}
+	}
+	pep.Start()
+	defer pep.Close()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--pep.url=" + pep.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", "/ades/jobs")
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		handler.NginxAuthRequestHandler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("unexpected status %v", w.Code)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if connections != 1 {
+		t.Errorf("expected a single reused connection to the PEP, got %d", connections)
+	}
+}
+
+// TestTracing tests that the decision continues the trace of nginx (traceparent), with its
+// attributes, and that the trace context is propagated to the PEP from the span of the call
+func TestTracing(t *testing.T) {
+	var mutex sync.Mutex
+	pepTraceparent := ""
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		pepTraceparent = r.Header.Get("traceparent")
+	}))
+	defer pep.Close()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--pep.url=" + pep.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	traceId, nginxSpanId := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Original-Uri", "/ades/jobs")
+	r.Header.Set("X-Original-Method", http.MethodPost)
+	r.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", traceId, nginxSpanId))
+	w := httptest.NewRecorder()
+	handler.NginxAuthRequestHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v", w.Code)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	decision, ok := spans["auth_request"]
+	if !ok {
+		t.Fatal("no span for the decision")
+	}
+	if decision.SpanKind() != trace.SpanKindServer || decision.SpanContext().TraceID().String() != traceId ||
+		decision.Parent().SpanID().String() != nginxSpanId {
+		t.Errorf("decision span does not continue the trace of nginx: %v %v", decision.SpanContext(), decision.Parent())
+	}
+	attributes := map[string]string{}
+	for _, kv := range decision.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	expected := map[string]string{"auth.orig_uri": "/ades/jobs", "auth.orig_method": http.MethodPost, "auth.attempts": "1", "http.status_code": "200"}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("decision span attribute %v: expected %q, got %q", key, value, attributes[key])
+		}
+	}
+
+	pepCall, ok := spans["pepAuthRequest"]
+	if !ok {
+		t.Fatal("no span for the PEP call")
+	}
+	if pepCall.SpanKind() != trace.SpanKindClient || pepCall.Parent().SpanID() != decision.SpanContext().SpanID() {
+		t.Errorf("PEP call span is not a client child of the decision span: %v", pepCall.Parent())
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if expected := fmt.Sprintf("00-%s-%s-01", traceId, pepCall.SpanContext().SpanID()); pepTraceparent != expected {
+		t.Errorf("expected traceparent %q at the PEP, got %q", expected, pepTraceparent)
+	}
+}
+
+// TestLoadShedding tests that a decision is shed with 503 (Service Unavailable) and a
+// Retry-After when the PEP is saturated and its queue is full - rather than waiting
+func TestLoadShedding(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer pep.Close()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--session.enabled=false", "--pep.url=" + pep.URL,
+		"--loadShedding.maxInFlight=1", "--loadShedding.maxQueue=0", "--loadShedding.queueTimeout=1500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--loadShedding.maxInFlight=0", "--loadShedding.maxQueue=100", "--loadShedding.queueTimeout=1000"})
+	authorize := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", "/ades/jobs")
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		handler.NginxAuthRequestHandler(w, r)
+		return w
+	}
+
+	// The only slot is taken by a decision in-flight at the PEP
+	inFlight := make(chan int, 1)
+	go func() { inFlight <- authorize().Code }()
+	<-started
+
+	start := time.Now()
+	w := authorize()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("decision queued for %v, rather than shed", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("unexpected response %v with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("unexpected status %v of the in-flight decision", code)
+	}
+}
+
+// cacheLookups returns the count of lookups of the cache with the result, as scraped
+func cacheLookups(t *testing.T, cache string, result string) (count float64) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	series := fmt.Sprintf(`uma_user_agent_cache_lookups_total{cache="%s",result="%s"} `, cache, result)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, series) {
+			count, _ = strconv.ParseFloat(strings.TrimPrefix(line, series), 64)
+		}
+	}
+	return
+}
+
+// TestCacheMetrics tests that the lookups of cached decisions and of the RPTs held in the
+// session are counted by result
+func TestCacheMetrics(t *testing.T) {
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pep.Close()
+	dir := t.TempDir()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--oidc.issuer=", "--pep.url=" + pep.URL, "--authCache.maxAge=60", "--session.enabled=true", "--session.store=file",
+		"--session.fileDir=" + dir, "--session.cookieName=auth_session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--authCache.maxAge=0", "--session.enabled=false"})
+	idToken := unsignedJwt(t, map[string]interface{}{"sub": "metered-user", "exp": time.Now().Add(time.Hour).Unix()})
+	store, err := session.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := session.NewSessionId()
+	s := session.Session{IdToken: idToken, Expiry: time.Now().Add(time.Hour)}
+	s.SetRpt(session.Rpt{Value: "rpt", AuthServer: "https://as.example.org", Resource: "/ades", Updated: time.Now()})
+	if err = store.Save(id, s); err != nil {
+		t.Fatal(err)
+	}
+	authorize := func(uri string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", uri)
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		r.AddCookie(&http.Cookie{Name: "auth_session", Value: id})
+		w := httptest.NewRecorder()
+		handler.NginxAuthRequestHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status %v", uri, w.Code)
+		}
+	}
+	expectDelta := func(cache string, result string, before float64, delta float64) {
+		t.Helper()
+		if count := cacheLookups(t, cache, result); count-before != delta {
+			t.Errorf("expected %v %v lookups of the %v cache, got %v", delta, result, cache, count-before)
+		}
+	}
+
+	decisionHits, decisionMisses := cacheLookups(t, "decision", "hit"), cacheLookups(t, "decision", "miss")
+	rptHits, rptMisses := cacheLookups(t, "sessionRpt", "hit"), cacheLookups(t, "sessionRpt", "miss")
+	authorize("/ades/metered")
+	authorize("/ades/metered")
+	authorize("/catalogue/metered")
+	expectDelta("decision", "hit", decisionHits, 1)
+	expectDelta("decision", "miss", decisionMisses, 2)
+	expectDelta("sessionRpt", "hit", rptHits, 2)
+	expectDelta("sessionRpt", "miss", rptMisses, 1)
+}
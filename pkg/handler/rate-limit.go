@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/ratelimit"
+	"github.com/EOEPCA/uma-user-agent/pkg/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamRateLimiters are the rate limits applied to the calls to an upstream
+type upstreamRateLimiters struct {
+	name        string
+	perUser     *ratelimit.Limiter
+	perClientIp *ratelimit.Limiter
+}
+
+// Rate limits of the calls to the PEP and to the Authorization Server (ticket exchange)
+var pepRateLimiters = upstreamRateLimiters{"pep", ratelimit.NewLimiter(ratelimit.Settings{}), ratelimit.NewLimiter(ratelimit.Settings{})}
+var asRateLimiters = upstreamRateLimiters{"as", ratelimit.NewLimiter(ratelimit.Settings{}), ratelimit.NewLimiter(ratelimit.Settings{})}
+
+// configureRateLimiters applies the configured rate limits
+func configureRateLimiters() {
+	pepRateLimiters.perUser.Configure(ratelimit.Settings{Rate: config.GetRateLimitPepPerUserRate(), Burst: config.GetRateLimitPepPerUserBurst()})
+	pepRateLimiters.perClientIp.Configure(ratelimit.Settings{Rate: config.GetRateLimitPepPerClientIpRate(), Burst: config.GetRateLimitPepPerClientIpBurst()})
+	asRateLimiters.perUser.Configure(ratelimit.Settings{Rate: config.GetRateLimitAsPerUserRate(), Burst: config.GetRateLimitAsPerUserBurst()})
+	asRateLimiters.perClientIp.Configure(ratelimit.Settings{Rate: config.GetRateLimitAsPerClientIpRate(), Burst: config.GetRateLimitAsPerClientIpBurst()})
+}
+
+// getRateLimitUser returns the key that identifies the user for rate limiting - the
+// verified `sub` of the User ID Token, or else the token fingerprint with the client IP.
+// An unverified `sub` is not used, since it could be chosen to exhaust another user's limit.
+func getRateLimitUser(ctx context.Context, clientRequestDetails *ClientRequestDetails) string {
+	if len(clientRequestDetails.UserIdToken) == 0 {
+		return ""
+	}
+	if subject := getVerifiedSubject(ctx, clientRequestDetails); len(subject) > 0 {
+		return "sub:" + subject
+	}
+	return redact.Fingerprint(clientRequestDetails.UserIdToken) + "|" + clientRequestDetails.ClientIp
+}
+
+// checkRateLimit applies the rate limits of the upstream to the request. If a limit is
+// exceeded then the response is 429 (Too Many Requests) with Retry-After.
+func checkRateLimit(ctx context.Context, clientRequestDetails *ClientRequestDetails, limiters upstreamRateLimiters, w http.ResponseWriter, requestLogger *logrus.Entry) (limited bool) {
+	var retryAfter time.Duration
+	var keyType string
+	if user := getRateLimitUser(ctx, clientRequestDetails); len(user) > 0 {
+		if allowed, wait := limiters.perUser.Allow(user); !allowed {
+			limited, retryAfter, keyType = true, wait, "user"
+		}
+	}
+	if !limited && len(clientRequestDetails.ClientIp) > 0 {
+		if allowed, wait := limiters.perClientIp.Allow(clientRequestDetails.ClientIp); !allowed {
+			limited, retryAfter, keyType = true, wait, "client_ip"
+		}
+	}
+	if !limited {
+		return
+	}
+
+	metrics.RateLimited.WithLabelValues(limiters.name, keyType).Inc()
+	msg := fmt.Sprintf("rate limit exceeded for calls to the %v (per %v)", limiters.name, keyType)
+	requestLogger.Warn(msg)
+	clientRequestDetails.Decision = metrics.DecisionRateLimited
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprint(w, msg)
+	return
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+)
+
+// TestRateLimitUser tests that the user of an unverified User ID Token is identified by
+// the token and client IP - rather than by the `sub` that it claims
+func TestRateLimitUser(t *testing.T) {
+	if err := config.ParseFlags("test", []string{"--oidc.issuer="}); err != nil {
+		t.Fatal(err)
+	}
+	// {"sub":"eric"}
+	token := "eyJhbGciOiJub25lIn0.eyJzdWIiOiJlcmljIn0.c2ln"
+	details := func(clientIp string) *ClientRequestDetails {
+		return &ClientRequestDetails{UserIdToken: token, ClientIp: clientIp, Config: config.Get()}
+	}
+	first := getRateLimitUser(context.Background(), details("198.51.100.1"))
+	second := getRateLimitUser(context.Background(), details("198.51.100.2"))
+	if first == "sub:eric" || first == second {
+		t.Errorf("unverified token identified by its sub, or not by the client IP: %v %v", first, second)
+	}
+	if user := getRateLimitUser(context.Background(), &ClientRequestDetails{ClientIp: "198.51.100.1", Config: config.Get()}); len(user) > 0 {
+		t.Errorf("expected no user without a token, got %v", user)
+	}
+}
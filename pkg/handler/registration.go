@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+	"github.com/sirupsen/logrus"
+)
+
+// Delays between attempts to register the client
+const (
+	registrationRetryInitial = 5 * time.Second
+	registrationRetryMax     = 5 * time.Minute
+)
+
+// registeredCredentials are the credentials of the registered client, as persisted in the
+// credentials file - with the Authorization Server at which the client is registered
+type registeredCredentials struct {
+	AuthorizationServer string `json:"authorization_server"`
+	uma.ClientRegistration
+}
+
+// registrar tracks the registration of the client. The credentials of a client registered
+// by this process are retained, so that the client is reused rather than registered again
+// - e.g. if its credentials could not be persisted.
+var registrar = struct {
+	mutex      sync.Mutex
+	running    bool
+	signature  string
+	registered *registeredCredentials
+}{}
+
+// configureRegistration registers the client at the Authorization Server, if so configured
+// and there are no configured client credentials. The registration is made in the
+// background, retrying until it succeeds.
+func configureRegistration() {
+	cfg := config.Get()
+	if !cfg.RegistrationEnabled || (len(cfg.ClientId) > 0 && !cfg.ClientRegistered) {
+		return
+	}
+	registrar.mutex.Lock()
+	defer registrar.mutex.Unlock()
+	if registrar.running || registrar.signature == getRegistrationSignature(cfg) {
+		return
+	}
+	registrar.running = true
+	go registerClient()
+}
+
+// getRegistrationSignature identifies the registration settings in effect
+func getRegistrationSignature(cfg *config.Config) string {
+	return cfg.RegistrationAuthorizationServer + "|" + cfg.RegistrationCredentialsFile
+}
+
+// registerClient obtains the credentials of the registered client, with retries - and
+// supplies them to the configuration
+func registerClient() {
+	delay := registrationRetryInitial
+	for {
+		cfg := config.Get()
+		if !cfg.RegistrationEnabled || (len(cfg.ClientId) > 0 && !cfg.ClientRegistered) {
+			break
+		}
+		credentials, err := getRegisteredCredentials(cfg)
+		if err == nil {
+			registrar.mutex.Lock()
+			registrar.running = false
+			registrar.signature = getRegistrationSignature(cfg)
+			registrar.mutex.Unlock()
+			config.SetRegisteredClient(credentials.ClientId, credentials.ClientSecret)
+			return
+		}
+		// Back off, with jitter so that replicas do not retry in step
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		logrus.Error(fmt.Errorf("client registration failed, retrying in %v: %w", wait, err))
+		time.Sleep(wait)
+		if delay *= 2; delay > registrationRetryMax {
+			delay = registrationRetryMax
+		}
+	}
+	registrar.mutex.Lock()
+	registrar.running = false
+	registrar.mutex.Unlock()
+}
+
+// getRegisteredCredentials returns the credentials persisted from a previous registration
+// at the Authorization Server - or else those of the client registered earlier by this
+// process, or else registers the client - and persists its credentials
+func getRegisteredCredentials(cfg *config.Config) (credentials registeredCredentials, err error) {
+	logger := logrus.WithField("authorizationServer", cfg.RegistrationAuthorizationServer)
+
+	credentials, err = readRegisteredCredentials(cfg.RegistrationCredentialsFile)
+	switch {
+	case err == nil && credentials.AuthorizationServer != cfg.RegistrationAuthorizationServer:
+		logger.Info("The persisted client is registered at a different Authorization Server - registering again")
+	case err == nil && credentials.IsExpired():
+		logger.Info("The secret of the persisted client has expired - registering again")
+	case err == nil:
+		logger.Infof("Using the registered client %v from %v", credentials.ClientId, cfg.RegistrationCredentialsFile)
+		return
+	case !errors.Is(err, os.ErrNotExist):
+		logger.Warn(fmt.Errorf("ignoring the persisted client credentials: %w", err))
+	}
+
+	// Reuse the client registered earlier by this process, else register the client
+	registrar.mutex.Lock()
+	registered := registrar.registered
+	registrar.mutex.Unlock()
+	if registered != nil && registered.AuthorizationServer == cfg.RegistrationAuthorizationServer && !registered.IsExpired() {
+		credentials, err = *registered, nil
+		logger.Infof("Reusing the registered client %v", credentials.ClientId)
+	} else if credentials, err = registerAtAuthorizationServer(cfg, logger); err != nil {
+		return
+	}
+
+	// Persist the credentials for reuse on restart
+	if persistErr := writeRegisteredCredentials(cfg.RegistrationCredentialsFile, credentials); persistErr != nil {
+		logger.Error(fmt.Errorf("the client will be registered again on restart - could not persist its credentials: %w", persistErr))
+	}
+	return
+}
+
+// registerAtAuthorizationServer registers the client at the Authorization Server, and
+// retains its credentials for reuse
+func registerAtAuthorizationServer(cfg *config.Config, logger *logrus.Entry) (credentials registeredCredentials, err error) {
+	metadata := uma.ClientMetadata{
+		ClientName:              cfg.RegistrationClientName,
+		GrantTypes:              []string{"urn:ietf:params:oauth:grant-type:uma-ticket"},
+		TokenEndpointAuthMethod: "client_secret_post",
+		Scope:                   "openid",
+	}
+	if len(cfg.OidcIssuer) > 0 {
+		metadata.GrantTypes = append(metadata.GrantTypes, "authorization_code", "refresh_token")
+		metadata.ResponseTypes = []string{"code"}
+		if len(cfg.OidcRedirectUrl) > 0 {
+			metadata.RedirectUris = []string{cfg.OidcRedirectUrl}
+		}
+	}
+	ctx := config.NewContext(context.Background(), cfg)
+	authServer := uma.NewAuthorizationServer(cfg.RegistrationAuthorizationServer)
+	registration, err := uma.RegisterClient(ctx, logger, *authServer, cfg.RegistrationInitialAccessToken, metadata)
+	if err != nil {
+		return
+	}
+	credentials = registeredCredentials{AuthorizationServer: cfg.RegistrationAuthorizationServer, ClientRegistration: registration}
+	logger.Infof("Registered client %v at the Authorization Server", credentials.ClientId)
+	registrar.mutex.Lock()
+	registrar.registered = &credentials
+	registrar.mutex.Unlock()
+	return
+}
+
+// readRegisteredCredentials reads the credentials of the registered client from the file
+func readRegisteredCredentials(path string) (credentials registeredCredentials, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &credentials); err != nil {
+		err = fmt.Errorf("could not interpret %v: %w", path, err)
+		return
+	}
+	if len(credentials.ClientId) == 0 || len(credentials.ClientSecret) == 0 {
+		err = fmt.Errorf("no client credentials in %v", path)
+	}
+	return
+}
+
+// writeRegisteredCredentials writes the credentials of the registered client to the file,
+// readable only by the owner. The file is replaced atomically, so that it is never left
+// incomplete.
+func writeRegisteredCredentials(path string, credentials registeredCredentials) (err error) {
+	data, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), path)
+}
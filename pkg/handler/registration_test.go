@@ -0,0 +1,149 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+)
+
+// fakeRegistrationServer is an Authorization Server that registers clients at its
+// Registration Endpoint, authorized by the initial access token
+type fakeRegistrationServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	prefix   string // distinguishes the clients of this server
+	metadata []map[string]interface{}
+}
+
+func newFakeRegistrationServer(t *testing.T) *fakeRegistrationServer {
+	authServer := &fakeRegistrationServer{prefix: fmt.Sprint(time.Now().UnixNano())}
+	authServer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/uma2-configuration":
+			fmt.Fprintf(w, `{"token_endpoint":"%s/token","registration_endpoint":"%s/register"}`, authServer.URL, authServer.URL)
+		case "/register":
+			if r.Header.Get("Authorization") != "Bearer initial-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			metadata := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&metadata)
+			authServer.mutex.Lock()
+			authServer.metadata = append(authServer.metadata, metadata)
+			n := len(authServer.metadata)
+			authServer.mutex.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"client_id":"%s","client_secret":"%s"}`, authServer.clientId(n), authServer.clientSecret(n))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(authServer.Close)
+	return authServer
+}
+
+func (authServer *fakeRegistrationServer) clientId(n int) string {
+	return fmt.Sprintf("client-%s-%d", authServer.prefix, n)
+}
+
+func (authServer *fakeRegistrationServer) clientSecret(n int) string {
+	return fmt.Sprintf("secret-%s-%d", authServer.prefix, n)
+}
+
+func (authServer *fakeRegistrationServer) registrations() int {
+	authServer.mutex.Lock()
+	defer authServer.mutex.Unlock()
+	return len(authServer.metadata)
+}
+
+// TestRegistration tests that the client is registered dynamically, and its credentials
+// persisted - and that a persisted or previously registered client is reused rather than
+// registered again
+func TestRegistration(t *testing.T) {
+	authServer := newFakeRegistrationServer(t)
+	dir := t.TempDir()
+	configure := func(authServerUrl string, credentialsFile string) {
+		t.Helper()
+		err := config.ParseFlags("test", []string{"--client-id=", "--client-secret=", "--client-secret-file=", "--oidc.issuer=",
+			"--registration.enabled=true", "--registration.authorizationServer=" + authServerUrl,
+			"--registration.initialAccessToken=initial-token", "--registration.credentialsFile=" + credentialsFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer config.ParseFlags("test", []string{"--registration.enabled=false", "--client-id=global", "--client-secret=global-secret"})
+	// expectClient waits for the (background) registration to supply the client
+	expectClient := func(clientId string, clientSecret string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if cfg := config.Get(); cfg.ClientId == clientId && cfg.ClientSecret == clientSecret {
+				return
+			}
+		}
+		t.Fatalf("expected client %v, got %v", clientId, config.Get().ClientId)
+	}
+	// expectPersisted waits for the credentials of the client to be persisted in the file
+	expectPersisted := func(path string, clientId string) {
+		t.Helper()
+		persisted := struct {
+			AuthorizationServer string `json:"authorization_server"`
+			ClientId            string `json:"client_id"`
+		}{}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &persisted) == nil && persisted.ClientId == clientId {
+				break
+			}
+		}
+		if persisted.ClientId != clientId || persisted.AuthorizationServer != authServer.URL {
+			t.Fatalf("credentials of %v not persisted in %v: %+v", clientId, path, persisted)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("credentials not persisted privately: %v %v", info, err)
+		}
+	}
+
+	// Registration
+	configure(authServer.URL, filepath.Join(dir, "client.json"))
+	expectClient(authServer.clientId(1), authServer.clientSecret(1))
+	expectPersisted(filepath.Join(dir, "client.json"), authServer.clientId(1))
+	if n := authServer.registrations(); n != 1 {
+		t.Fatalf("expected 1 registration, got %d", n)
+	}
+	if grantTypes := fmt.Sprint(authServer.metadata[0]["grant_types"]); grantTypes != "[urn:ietf:params:oauth:grant-type:uma-ticket]" {
+		t.Errorf("unexpected grant types registered: %v", grantTypes)
+	}
+
+	// Persisted credentials are loaded
+	persisted := filepath.Join(dir, "persisted.json")
+	data := fmt.Sprintf(`{"authorization_server":"%s","client_id":"persisted-client","client_secret":"persisted-secret"}`, authServer.URL)
+	if err := os.WriteFile(persisted, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configure(authServer.URL, persisted)
+	expectClient("persisted-client", "persisted-secret")
+
+	// The client registered by this process is reused, and persisted in the new file
+	configure(authServer.URL, filepath.Join(dir, "moved", "client.json"))
+	expectClient(authServer.clientId(1), authServer.clientSecret(1))
+	expectPersisted(filepath.Join(dir, "moved", "client.json"), authServer.clientId(1))
+
+	// Credentials persisted for another Authorization Server are not used
+	other := filepath.Join(dir, "other.json")
+	data = `{"authorization_server":"https://other.example.org","client_id":"other-client","client_secret":"other-secret"}`
+	if err := os.WriteFile(other, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configure(authServer.URL, other)
+	expectPersisted(other, authServer.clientId(1))
+	if n := authServer.registrations(); n != 1 {
+		t.Errorf("expected the registered client to be reused, got %d registrations", n)
+	}
+}
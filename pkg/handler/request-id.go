@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+)
+
+// RequestIdMiddleware establishes the correlation ID of the request - from the `X-Request-Id`
+// header, or newly generated. The ID is returned in the response header, and carried in the
+// request context for logging and onward propagation to the PEP and Authorization Server.
+func RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := logging.GetOrNewRequestId(r)
+		w.Header().Set(logging.HeaderNameXRequestId, requestId)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestId(r.Context(), requestId)))
+	})
+}
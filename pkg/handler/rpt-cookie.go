@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/seal"
+	"github.com/sirupsen/logrus"
+)
+
+// rptSealPurpose is the additional data with which the RPT is sealed, which binds the
+// sealed value to its purpose. It does not depend on the cookie name - which varies by
+// endpoint, and is not known to the instance that unseals the cookie at logout.
+const rptSealPurpose = "uma-user-agent/rpt"
+
+// rptKeyringFile provides the keys used to seal the RPT cookie value
+var rptKeyringFile = struct {
+	mutex sync.Mutex
+	file  *seal.KeyringFile
+}{}
+
+// getRptKeyring returns the keyring from the configured key file
+func getRptKeyring(cfg *config.Config) (*seal.Keyring, error) {
+	rptKeyringFile.mutex.Lock()
+	path := cfg.AuthRptCookieKeyFile
+	if rptKeyringFile.file == nil || rptKeyringFile.file.GetPath() != path {
+		rptKeyringFile.file = seal.NewKeyringFile(path)
+	}
+	file := rptKeyringFile.file
+	rptKeyringFile.mutex.Unlock()
+
+	keyring, err := file.Keyring()
+	if err != nil && keyring != nil {
+		logrus.Warn(fmt.Errorf("using previously loaded keys for RPT cookie: %w", err))
+		err = nil
+	}
+	return keyring, err
+}
+
+// sealRpt returns the value of the RPT cookie for the supplied RPT, which is sealed
+// (encrypted and authenticated) if so configured
+func sealRpt(cfg *config.Config, rpt string) (string, error) {
+	if !cfg.AuthRptCookieSealed || len(rpt) == 0 {
+		return rpt, nil
+	}
+	keyring, err := getRptKeyring(cfg)
+	if err != nil {
+		return "", err
+	}
+	return keyring.Seal([]byte(rpt), []byte(rptSealPurpose))
+}
+
+// unsealRpt returns the RPT from the value of an RPT cookie, which is unsealed if so
+// configured
+func unsealRpt(cfg *config.Config, value string) (string, error) {
+	if !cfg.AuthRptCookieSealed || len(value) == 0 {
+		return value, nil
+	}
+	keyring, err := getRptKeyring(cfg)
+	if err != nil {
+		return "", err
+	}
+	rpt, err := keyring.Unseal(value, []byte(rptSealPurpose))
+	return string(rpt), err
+}
@@ -0,0 +1,106 @@
+package handler_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/gorilla/mux"
+)
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// TestSealedRptCookie tests that the RPT cookie sealed for an authorized request is
+// unsealed at logout under its endpoint-suffixed name - across rotation of the keys, in
+// which the previous key still unseals and the new key seals
+func TestSealedRptCookie(t *testing.T) {
+	authServer := newFakeAuthServer(t)
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pep.Close()
+	dir := t.TempDir()
+	oldKey, newKey := newKey(t), newKey(t)
+
+	// Each phase of the rotation uses a new key file, which is loaded immediately
+	configure := func(name string, keys ...string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.Join(keys, "\n")), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+			"--oidc.issuer=", "--session.enabled=false", "--pep.url=" + pep.URL, "--authRptCookieName=auth_rpt",
+			"--authRptCookiePath=/", "--authRptCookieDomain=", "--authRptCookieSealed=true", "--authRptCookieKeyFile=" + path,
+			fmt.Sprintf(`--authorization-servers={"%s": {"client-id": "as-client", "client-secret": "as-secret"}}`, authServer.URL)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// authorize returns the sealed RPT cookie value for the authorized request
+	authorize := func(rpt string) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", "/ades/jobs")
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		r.Header.Set("Authorization", "Bearer "+rpt)
+		w := httptest.NewRecorder()
+		handler.NginxAuthRequestHandler(w, r)
+		sealed := w.Header().Get("X-Auth-Rpt")
+		if w.Code != http.StatusOK || len(sealed) == 0 || sealed == rpt {
+			t.Fatalf("expected a sealed RPT for the authorized request: %v %q", w.Code, sealed)
+		}
+		return sealed
+	}
+	// logout presents the sealed value in an endpoint-suffixed cookie, and reports whether
+	// the RPT was unsealed - and so revoked
+	logout := func(sealed string, rpt string) bool {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+		r.AddCookie(&http.Cookie{Name: "auth_rpt-ades", Value: sealed})
+		w := httptest.NewRecorder()
+		handler.NewLoginRouter(mux.NewRouter()).ServeHTTP(w, r)
+		_, revoked := authServer.revokedBy(rpt)
+		return revoked
+	}
+
+	configure("keys-old", oldKey)
+	rpt1 := unsignedJwt(t, map[string]interface{}{"iss": authServer.URL, "jti": "1"})
+	sealed1 := authorize(rpt1)
+
+	// The new key is rotated-in - the old key still unseals
+	configure("keys-rotating", newKey, oldKey)
+	if !logout(sealed1, rpt1) {
+		t.Error("RPT sealed with the previous key was not unsealed")
+	}
+	rpt2 := unsignedJwt(t, map[string]interface{}{"iss": authServer.URL, "jti": "2"})
+	sealed2 := authorize(rpt2)
+
+	// The old key is retired - the value sealed during rotation used the new key
+	configure("keys-new", newKey)
+	if !logout(sealed2, rpt2) {
+		t.Error("RPT sealed during rotation was not sealed with the new key")
+	}
+
+	// A value sealed with a retired key is not unsealed
+	rpt3 := unsignedJwt(t, map[string]interface{}{"iss": authServer.URL, "jti": "3"})
+	configure("keys-old-again", oldKey)
+	sealed3 := authorize(rpt3)
+	configure("keys-new-again", newKey)
+	if logout(sealed3, rpt3) {
+		t.Error("RPT sealed with a retired key was unsealed")
+	}
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionStore is the store of server-side sessions, which is (re)created according
+// to the current configuration
+var sessionStore = struct {
+	mutex     sync.Mutex
+	store     session.Store
+	signature string
+}{}
+
+// getSessionStore returns the session store for the configured store type
+func getSessionStore(cfg *config.Config) (store session.Store, err error) {
+	storeType := cfg.SessionStore
+	var signature string
+	switch storeType {
+	case "memory":
+		signature = storeType
+	case "file":
+		signature = fmt.Sprintf("%s|%s", storeType, cfg.SessionFileDir)
+	case "redis":
+		signature = fmt.Sprintf("%s|%s|%s|%d|%s", storeType, cfg.SessionRedisAddress, cfg.SessionRedisPassword,
+			cfg.SessionRedisDatabase, cfg.SessionRedisKeyPrefix)
+	default:
+		err = fmt.Errorf("unknown session store type '%v'", storeType)
+		return
+	}
+
+	sessionStore.mutex.Lock()
+	defer sessionStore.mutex.Unlock()
+	if sessionStore.store != nil && sessionStore.signature == signature {
+		return sessionStore.store, nil
+	}
+
+	// (Re)create the store
+	switch storeType {
+	case "memory":
+		store = session.NewMemoryStore()
+	case "file":
+		if store, err = session.NewFileStore(cfg.SessionFileDir); err != nil {
+			return
+		}
+	case "redis":
+		store = session.NewRedisStore(session.RedisOptions{
+			Address:   cfg.SessionRedisAddress,
+			Password:  cfg.SessionRedisPassword,
+			Database:  cfg.SessionRedisDatabase,
+			KeyPrefix: cfg.SessionRedisKeyPrefix,
+			Timeout:   cfg.HttpTimeout,
+		})
+	}
+	if sessionStore.store != nil {
+		sessionStore.store.Close()
+	}
+	sessionStore.store, sessionStore.signature = store, signature
+	logrus.Infof("Initialised session store: %v", storeType)
+	return
+}
+
+// loadSession returns the session referenced by the session cookie of the request.
+// The ok result indicates whether an unexpired session was found.
+func loadSession(r *http.Request) (id string, s session.Session, ok bool, err error) {
+	cfg := config.FromContext(r.Context())
+	if !cfg.SessionEnabled {
+		return
+	}
+	c, cookieErr := r.Cookie(cfg.SessionCookieName)
+	if cookieErr != nil || len(c.Value) == 0 {
+		return
+	}
+	store, err := getSessionStore(cfg)
+	if err != nil {
+		return
+	}
+	id = c.Value
+	s, ok, err = store.Load(id)
+	return
+}
+
+// createSession creates a new session for the supplied tokens and sets its cookie
+func createSession(cfg *config.Config, w http.ResponseWriter, idToken string, refreshToken string) (err error) {
+	store, err := getSessionStore(cfg)
+	if err != nil {
+		return
+	}
+	id, err := session.NewSessionId()
+	if err != nil {
+		return
+	}
+	maxAge := cfg.SessionMaxAge
+	s := session.Session{IdToken: idToken, RefreshToken: refreshToken, Expiry: time.Now().Add(maxAge)}
+	if err = store.Save(id, s); err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.SessionCookieName,
+		Value:    id,
+		Path:     cfg.UserIdCookiePath,
+		Domain:   cfg.UserIdCookieDomain,
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   cfg.UserIdCookieSecure,
+		HttpOnly: true,
+		SameSite: cfg.UserIdCookieSameSite,
+	})
+	return
+}
+
+// saveRptToSession records the RPT (and PCT) obtained for a successful authorization in the
+// session - held by its Authorization Server and the resource of the request. The update
+// is atomic, so that the RPTs of concurrent requests do not replace each other. An RPT
+// that was not newly obtained from an Authorization Server is already held.
+func saveRptToSession(clientRequestDetails *ClientRequestDetails) (err error) {
+	if len(clientRequestDetails.AuthServerUrl) == 0 || len(clientRequestDetails.Rpt) == 0 {
+		return
+	}
+	store, err := getSessionStore(clientRequestDetails.Config)
+	if err != nil {
+		return
+	}
+	rpt := session.Rpt{
+		Value:      clientRequestDetails.Rpt,
+		AuthServer: clientRequestDetails.AuthServerUrl,
+		Resource:   getResource(clientRequestDetails.OrigUri),
+		Updated:    time.Now(),
+	}
+	_, err = store.UpdateRpt(clientRequestDetails.SessionId, rpt, clientRequestDetails.Pct)
+	return
+}
+
+// getResource returns the resource of the requested URI, by which its RPT is held in the
+// session - its first path segment
+func getResource(origUri string) string {
+	path := strings.SplitN(origUri, "?", 2)[0]
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	return "/" + segments[0]
+}
+
+// deleteSession removes the session from the store
+func deleteSession(cfg *config.Config, id string) (err error) {
+	store, err := getSessionStore(cfg)
+	if err != nil {
+		return
+	}
+	return store.Delete(id)
+}
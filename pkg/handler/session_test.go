@@ -0,0 +1,94 @@
+package handler_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+)
+
+// TestSessionRpts tests that the RPTs obtained for different resources are held side by side
+// in the session - so that a resource reuses its RPT after another resource was authorized
+func TestSessionRpts(t *testing.T) {
+	// The Authorization Server issues an RPT for the resource of the ticket
+	var mutex sync.Mutex
+	exchanges := 0
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/uma2-configuration":
+			fmt.Fprintf(w, `{"token_endpoint":"http://%s/token"}`, r.Host)
+		case "/token":
+			r.ParseForm()
+			mutex.Lock()
+			exchanges++
+			fmt.Fprintf(w, `{"access_token":"rpt:%s:%d"}`, strings.TrimPrefix(r.PostForm.Get("ticket"), "ticket:"), exchanges)
+			mutex.Unlock()
+		}
+	}))
+	defer authServer.Close()
+	// The PEP accepts only an RPT for the resource of the request
+	pep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource := "/" + strings.SplitN(strings.TrimPrefix(r.Header.Get("X-Original-Uri"), "/"), "/", 2)[0]
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer rpt:"+resource+":") {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`UMA realm="eoepca",as_uri=%s,ticket=ticket:%s`, authServer.URL, resource))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer pep.Close()
+
+	dir := t.TempDir()
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--pep.url=" + pep.URL, "--authorization-servers={}", "--session.enabled=true", "--session.store=file",
+		"--session.fileDir=" + dir, "--session.cookieName=auth_session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := session.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := session.NewSessionId()
+	idToken := unsignedJwt(t, map[string]interface{}{"sub": "eric", "exp": time.Now().Add(time.Hour).Unix()})
+	if err = store.Save(id, session.Session{IdToken: idToken, Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func(uri string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Original-Uri", uri)
+		r.Header.Set("X-Original-Method", http.MethodGet)
+		r.AddCookie(&http.Cookie{Name: "auth_session", Value: id})
+		w := httptest.NewRecorder()
+		handler.NginxAuthRequestHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status %v: %v", uri, w.Code, w.Body.String())
+		}
+		if len(w.Header().Get("X-Auth-Rpt")) > 0 {
+			t.Errorf("%v: RPT returned rather than held in the session", uri)
+		}
+	}
+	authorize("/ades/jobs")
+	authorize("/catalogue/search")
+	authorize("/ades/jobs/1")
+	if exchanges != 2 {
+		t.Errorf("expected the RPT of each resource to be reused, got %d exchanges", exchanges)
+	}
+
+	s, ok, err := store.Load(id)
+	if !ok || err != nil {
+		t.Fatalf("session not found: %v", err)
+	}
+	for resource, value := range map[string]string{"/ades": "rpt:/ades:1", "/catalogue": "rpt:/catalogue:2"} {
+		if rpt, ok := s.GetRpt(resource); !ok || rpt.Value != value || rpt.AuthServer != authServer.URL {
+			t.Errorf("unexpected RPT for %v: %+v", resource, rpt)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shuttingDown is set when the service begins its graceful shutdown
+var shuttingDown atomic.Bool
+
+// BeginShutdown flips the readiness to not-ready, ahead of the graceful shutdown - so that
+// the service is removed from load-balancing while in-flight requests complete
+func BeginShutdown() {
+	shuttingDown.Store(true)
+}
+
+// IsShuttingDown indicates whether the graceful shutdown has begun
+func IsShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// Close releases the resources of the handlers - stopping the health checks, delivering any
+// queued audit records and closing the session store
+func Close() {
+	healthChecker.Stop()
+
+	closeAuditor()
+
+	sessionStore.mutex.Lock()
+	if sessionStore.store != nil {
+		if err := sessionStore.store.Close(); err != nil {
+			logrus.Warn("Error closing session store: ", err)
+		}
+		sessionStore.store = nil
+	}
+	sessionStore.mutex.Unlock()
+}
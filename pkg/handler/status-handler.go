@@ -1,19 +1,41 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/EOEPCA/uma-user-agent/pkg/authcache"
 	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/health"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+	"github.com/EOEPCA/uma-user-agent/pkg/version"
 	"github.com/gorilla/mux"
 )
 
-// NewStatusRouter registers the handlers to report service status for probes.
+// startTime is the time at which the service started, for its uptime
+var startTime = time.Now()
+
+// NewStatusRouter registers the handlers to report service status for probes. The
+// status is reduced to up/down, since the router is public - the details of the status
+// are served by the admin API.
 func NewStatusRouter(router *mux.Router) *mux.Router {
 
+	// Status
+	router.Path("").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if ready, _ := isReady(); ready {
+			json.NewEncoder(w).Encode(map[string]string{"status": "up"})
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "down"})
+		}
+	})
+
 	// Readiness
 	router.PathPrefix("/ready").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if config.IsReady() {
+		if ready, _ := isReady(); ready {
 			fmt.Fprintln(w, "READY")
 		} else {
 			w.WriteHeader(http.StatusTooEarly)
@@ -28,3 +50,63 @@ func NewStatusRouter(router *mux.Router) *mux.Router {
 
 	return router
 }
+
+// isReady indicates whether the service is ready to handle requests - being configured,
+// not shutting down, and (if configured) with healthy upstreams. The failing upstream
+// health checks are returned.
+func isReady() (ready bool, failing []string) {
+	ready = config.IsReady() && !IsShuttingDown()
+	if config.IsReadinessCheckUpstreams() {
+		var healthy bool
+		healthy, failing = healthChecker.Healthy()
+		ready = ready && healthy
+	}
+	return
+}
+
+func getBreakerStates() map[string]string {
+	states := map[string]string{}
+	for name, state := range uma.Breakers.States() {
+		states[name] = state.String()
+	}
+	return states
+}
+
+// status is the detailed status document of the service
+type status struct {
+	Version              version.Info             `json:"version"`
+	StartTime            time.Time                `json:"startTime"`
+	Uptime               string                   `json:"uptime"`
+	Ready                bool                     `json:"ready"`
+	ShuttingDown         bool                     `json:"shuttingDown"`
+	ConfigChecksum       string                   `json:"configChecksum"`
+	CircuitBreakers      map[string]string        `json:"circuitBreakers"`
+	Caches               map[string]int           `json:"caches"`
+	AuthorizationServers []string                 `json:"authorizationServers"`
+	HealthChecks         map[string]health.Result `json:"healthChecks,omitempty"`
+}
+
+func getStatus() status {
+	ready, _ := isReady()
+	caches := map[string]int{
+		"authDecisions":        authcache.Decisions.Len(),
+		"authorizationServers": uma.AuthorizationServers.Len(),
+	}
+	sessionStore.mutex.Lock()
+	if store, ok := sessionStore.store.(interface{ Len() int }); ok {
+		caches["sessions"] = store.Len()
+	}
+	sessionStore.mutex.Unlock()
+	return status{
+		Version:              version.Get(),
+		StartTime:            startTime,
+		Uptime:               time.Since(startTime).Round(time.Second).String(),
+		Ready:                ready,
+		ShuttingDown:         IsShuttingDown(),
+		ConfigChecksum:       config.GetChecksum(),
+		CircuitBreakers:      getBreakerStates(),
+		Caches:               caches,
+		AuthorizationServers: uma.AuthorizationServers.Urls(),
+		HealthChecks:         healthChecker.Results(),
+	}
+}
@@ -0,0 +1,43 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/handler"
+	"github.com/gorilla/mux"
+)
+
+// TestStatus tests that the public status reports only up/down - the detailed status
+// being served by the admin API
+func TestStatus(t *testing.T) {
+	err := config.ParseFlags("test", []string{"--client-id=global", "--client-secret=global-secret", "--client-secret-file=",
+		"--admin.bearerToken=admin-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.NewStatusRouter(mux.NewRouter().PathPrefix("/status").Subrouter()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"status":"up"}` {
+		t.Errorf("unexpected public status %v: %v", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/status", nil)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w = httptest.NewRecorder()
+	handler.NewAdminRouter(mux.NewRouter()).ServeHTTP(w, r)
+	status := struct {
+		Ready          bool           `json:"ready"`
+		ConfigChecksum string         `json:"configChecksum"`
+		Caches         map[string]int `json:"caches"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &status)
+	if _, ok := status.Caches["authDecisions"]; err != nil || w.Code != http.StatusOK || !status.Ready || len(status.ConfigChecksum) == 0 || !ok {
+		t.Errorf("unexpected admin status %v: %v", w.Code, w.Body.String())
+	}
+}
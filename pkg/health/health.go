@@ -0,0 +1,161 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CheckFunc checks the health of a dependency - returning an error if unhealthy
+type CheckFunc func(ctx context.Context) error
+
+// Result is the outcome of the most recent run of a check
+type Result struct {
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Duration  string    `json:"duration"`
+}
+
+//------------------------------------------------------------------------------
+
+// Checker runs a set of named checks periodically in the background, and caches their
+// results - so that probes are answered without calling the dependencies
+type Checker struct {
+	mutex    sync.RWMutex
+	checks   map[string]CheckFunc
+	results  map[string]Result
+	interval time.Duration
+	timeout  time.Duration
+	wake     chan struct{}
+	stop     chan struct{}
+	stopped  bool
+}
+
+//------------------------------------------------------------------------------
+
+func NewChecker() *Checker {
+	return &Checker{
+		checks:  map[string]CheckFunc{},
+		results: map[string]Result{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Configure replaces the checks and their schedule. Results of checks that are no longer
+// configured are discarded, and the checks are run promptly. A zero interval stops the
+// periodic checking.
+func (checker *Checker) Configure(checks map[string]CheckFunc, interval time.Duration, timeout time.Duration) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.checks = checks
+	for name := range checker.results {
+		if _, ok := checks[name]; !ok {
+			delete(checker.results, name)
+		}
+	}
+	checker.interval, checker.timeout = interval, timeout
+
+	if interval > 0 && checker.stop == nil && !checker.stopped {
+		checker.stop = make(chan struct{})
+		go checker.run(checker.stop)
+	} else if interval <= 0 && checker.stop != nil {
+		close(checker.stop)
+		checker.stop = nil
+	}
+	select {
+	case checker.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends the periodic checking
+func (checker *Checker) Stop() {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if checker.stop != nil {
+		close(checker.stop)
+		checker.stop = nil
+	}
+	checker.stopped = true
+}
+
+// Results returns the most recent result of each check. A check that has not yet
+// completed has no result.
+func (checker *Checker) Results() map[string]Result {
+	checker.mutex.RLock()
+	defer checker.mutex.RUnlock()
+	results := make(map[string]Result, len(checker.results))
+	for name, result := range checker.results {
+		results[name] = result
+	}
+	return results
+}
+
+// Healthy indicates whether all checks have a healthy result. The names of the checks
+// that are unhealthy, or not yet completed, are returned.
+func (checker *Checker) Healthy() (healthy bool, failing []string) {
+	checker.mutex.RLock()
+	defer checker.mutex.RUnlock()
+	for name := range checker.checks {
+		if result, ok := checker.results[name]; !ok || !result.Healthy {
+			failing = append(failing, name)
+		}
+	}
+	sort.Strings(failing)
+	return len(failing) == 0, failing
+}
+
+// run performs the checks at each interval, or when woken by a change of configuration
+func (checker *Checker) run(stop chan struct{}) {
+	for {
+		checker.mutex.RLock()
+		interval := checker.interval
+		checker.mutex.RUnlock()
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-checker.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+		checker.RunChecks()
+	}
+}
+
+// RunChecks runs all the checks concurrently, and records their results
+func (checker *Checker) RunChecks() {
+	checker.mutex.RLock()
+	checks, timeout := checker.checks, checker.timeout
+	checker.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check CheckFunc) {
+			defer wg.Done()
+			ctx := context.Background()
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			err := check(ctx)
+			result := Result{Healthy: err == nil, CheckedAt: start, Duration: time.Since(start).String()}
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			checker.mutex.Lock()
+			defer checker.mutex.Unlock()
+			if _, ok := checker.checks[name]; ok {
+				checker.results[name] = result
+			}
+		}(name, check)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,65 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/health"
+)
+
+// TestChecker tests the cached results of the checks, and reconfiguration
+func TestChecker(t *testing.T) {
+	checker := health.NewChecker()
+	defer checker.Stop()
+	checker.Configure(map[string]health.CheckFunc{
+		"good": func(ctx context.Context) error { return nil },
+		"bad":  func(ctx context.Context) error { return errors.New("unreachable") },
+	}, 0, time.Second)
+	if healthy, failing := checker.Healthy(); healthy || len(failing) != 2 {
+		t.Fatalf("checks not yet run should be failing: %v", failing)
+	}
+
+	checker.RunChecks()
+	healthy, failing := checker.Healthy()
+	if healthy || len(failing) != 1 || failing[0] != "bad" {
+		t.Fatalf("unexpected failing checks: %v", failing)
+	}
+	if result := checker.Results()["bad"]; result.Healthy || result.Error != "unreachable" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// Removing the failing check discards its result
+	checker.Configure(map[string]health.CheckFunc{
+		"good": func(ctx context.Context) error { return nil },
+	}, 0, time.Second)
+	if healthy, failing := checker.Healthy(); !healthy {
+		t.Errorf("unexpected failing checks: %v", failing)
+	}
+	if _, ok := checker.Results()["bad"]; ok {
+		t.Error("result of removed check should be discarded")
+	}
+}
+
+// TestCheckerPeriodic tests that checks are run in the background, subject to the timeout
+func TestCheckerPeriodic(t *testing.T) {
+	checker := health.NewChecker()
+	defer checker.Stop()
+	checker.Configure(map[string]health.CheckFunc{
+		"slow": func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}, time.Hour, 20*time.Millisecond)
+
+	// The checks are run promptly on configuration
+	deadline := time.Now().Add(time.Second)
+	for len(checker.Results()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	result, ok := checker.Results()["slow"]
+	if !ok || result.Healthy || len(result.Error) == 0 {
+		t.Errorf("expected timed-out result: %+v", result)
+	}
+}
@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+// Field naming conventions for the json format
+const (
+	FieldNamesDefault = "default"
+	FieldNamesEcs     = "ecs"
+	FieldNamesGelf    = "gelf"
+)
+
+const timestampFormat = "2006-01-02 15:04:05.000"
+
+// NewFormatter returns the log formatter for the format and (json) field naming convention
+func NewFormatter(format string, fieldNames string) (formatter logrus.Formatter, err error) {
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		formatter = &logrus.TextFormatter{TimestampFormat: timestampFormat, FullTimestamp: true}
+	case FormatJson:
+		switch strings.ToLower(fieldNames) {
+		case FieldNamesDefault, "":
+			formatter = &logrus.JSONFormatter{TimestampFormat: timestampFormat}
+		case FieldNamesEcs:
+			formatter = &ecsFormatter{}
+		case FieldNamesGelf:
+			host, _ := os.Hostname()
+			formatter = &gelfFormatter{host: host}
+		default:
+			err = fmt.Errorf("unknown log field names '%v'", fieldNames)
+		}
+	default:
+		err = fmt.Errorf("unknown log format '%v'", format)
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// ECS (Elastic Common Schema)
+//------------------------------------------------------------------------------
+
+// ecsFieldNames maps the agent's field names to their ECS equivalents
+var ecsFieldNames = map[string]string{
+	FieldRequestId: "http.request.id",
+	"origUri":      "url.original",
+	"origMethod":   "http.request.method",
+	"statusCode":   "http.response.status_code",
+}
+
+type ecsFormatter struct{}
+
+func (f *ecsFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+4)
+	for k, v := range entry.Data {
+		if name, ok := ecsFieldNames[k]; ok {
+			k = name
+		}
+		data[k] = jsonValue(v)
+	}
+	data["@timestamp"] = entry.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	data["log.level"] = entry.Level.String()
+	data["message"] = entry.Message
+	data["ecs.version"] = "1.6.0"
+	return marshalLine(data)
+}
+
+//------------------------------------------------------------------------------
+// GELF (Graylog Extended Log Format)
+//------------------------------------------------------------------------------
+
+type gelfFormatter struct {
+	host string
+}
+
+// gelfLevels maps to the syslog severity levels used by GELF
+var gelfLevels = map[logrus.Level]int{
+	logrus.PanicLevel: 0,
+	logrus.FatalLevel: 2,
+	logrus.ErrorLevel: 3,
+	logrus.WarnLevel:  4,
+	logrus.InfoLevel:  6,
+	logrus.DebugLevel: 7,
+	logrus.TraceLevel: 7,
+}
+
+func (f *gelfFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+5)
+	for k, v := range entry.Data {
+		// Additional fields are prefixed with an underscore, and `_id` is reserved
+		if k == "id" {
+			k = "id_"
+		}
+		data["_"+k] = jsonValue(v)
+	}
+	data["version"] = "1.1"
+	data["host"] = f.host
+	data["short_message"] = entry.Message
+	data["timestamp"] = float64(entry.Time.UnixNano()/int64(1e6)) / 1000
+	data["level"] = gelfLevels[entry.Level]
+	return marshalLine(data)
+}
+
+//------------------------------------------------------------------------------
+
+// jsonValue ensures that errors are rendered as their message
+func jsonValue(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+	return v
+}
+
+func marshalLine(data logrus.Fields) ([]byte, error) {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal log fields to json: %w", err)
+	}
+	return append(line, '\n'), nil
+}
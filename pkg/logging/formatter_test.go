@@ -0,0 +1,77 @@
+package logging_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+func formatEntry(t *testing.T, fieldNames string) map[string]interface{} {
+	formatter, err := logging.NewFormatter(logging.FormatJson, fieldNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := logrus.NewEntry(logrus.New()).WithFields(logrus.Fields{
+		logging.FieldRequestId: "req-123",
+		"origUri":              "/ades",
+	})
+	entry.Time = time.Unix(1700000000, 0)
+	entry.Level = logrus.WarnLevel
+	entry.Message = "test message"
+	line, err := formatter.Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(line, &result); err != nil {
+		t.Fatalf("log line is not json: %v", err)
+	}
+	return result
+}
+
+// TestFormatterEcs tests the field names of the ECS json format
+func TestFormatterEcs(t *testing.T) {
+	result := formatEntry(t, logging.FieldNamesEcs)
+	expected := map[string]interface{}{
+		"message":         "test message",
+		"log.level":       "warning",
+		"http.request.id": "req-123",
+		"url.original":    "/ades",
+		"@timestamp":      "2023-11-14T22:13:20.000Z",
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Errorf("unexpected value for %v: %v", k, result[k])
+		}
+	}
+}
+
+// TestFormatterGelf tests the field names of the GELF json format
+func TestFormatterGelf(t *testing.T) {
+	result := formatEntry(t, logging.FieldNamesGelf)
+	expected := map[string]interface{}{
+		"version":       "1.1",
+		"short_message": "test message",
+		"level":         float64(4),
+		"timestamp":     float64(1700000000),
+		"_requestId":    "req-123",
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Errorf("unexpected value for %v: %v", k, result[k])
+		}
+	}
+}
+
+// TestFormatterUnknown tests that bad format settings are reported
+func TestFormatterUnknown(t *testing.T) {
+	if _, err := logging.NewFormatter("xml", ""); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if _, err := logging.NewFormatter(logging.FormatJson, "splunk"); err == nil {
+		t.Error("expected error for unknown field names")
+	}
+}
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// HeaderNameXRequestId is the http header that carries the request correlation ID
+const HeaderNameXRequestId = "X-Request-Id"
+
+// FieldRequestId is the log field that carries the request correlation ID
+const FieldRequestId = "requestId"
+
+// Maximum length of a request ID that is accepted from the incoming request
+const maxRequestIdLength = 128
+
+type requestIdKey struct{}
+
+// WithRequestId returns a context that carries the request ID
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// RequestIdFromContext returns the request ID carried by the context, if any
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// GetOrNewRequestId returns the request ID from the `X-Request-Id` header of the request,
+// or a newly generated ID if the header is absent or unsuitable
+func GetOrNewRequestId(r *http.Request) string {
+	requestId := r.Header.Get(HeaderNameXRequestId)
+	if isValidRequestId(requestId) {
+		return requestId
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// isValidRequestId checks that the supplied ID is safe to log and forward
+func isValidRequestId(requestId string) bool {
+	if len(requestId) == 0 || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range requestId {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Inject sets the request ID carried by the request's context in the outgoing request headers
+func Inject(req *http.Request) {
+	if requestId := RequestIdFromContext(req.Context()); len(requestId) > 0 {
+		req.Header.Set(HeaderNameXRequestId, requestId)
+	}
+}
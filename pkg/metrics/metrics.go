@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "uma_user_agent"
+
+// Decision outcomes
+const (
+	DecisionAllow = "allow"
+	DecisionDeny  = "deny"
+	DecisionError = "error"
+	// Rejected by rate limiting, without a decision by the PEP
+	DecisionRateLimited = "ratelimited"
+)
+
+// Cache lookup results
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Decisions counts the final authorization decisions
+var Decisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "decisions_total",
+	Help:      "Authorization decisions by outcome (allow/deny/error), route and source of the User ID Token.",
+}, []string{"decision", "route", "token_source"})
+
+// UpstreamDuration observes the latency of the calls made to upstream services
+var UpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "upstream_request_duration_seconds",
+	Help:      "Latency of calls to upstream services (PEP, Authorization Server), including retries.",
+	Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+}, []string{"operation"})
+
+// HttpRetries counts the retries of upstream http requests
+var HttpRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "http_retries_total",
+	Help:      "Retries of upstream http requests, by operation.",
+}, []string{"operation"})
+
+// CacheLookups counts the lookups of the agent's caches, by result
+var CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "cache_lookups_total",
+	Help:      "Cache lookups by cache and result (hit/miss).",
+}, []string{"cache", "result"})
+
+// CircuitBreakerState reports the state of the circuit breaker of each upstream
+var CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "circuit_breaker_state",
+	Help:      "State of the circuit breaker per upstream (0=closed, 1=open, 2=half-open).",
+}, []string{"upstream"})
+
+// CircuitBreakerRejections counts the calls rejected (failed fast) by an open circuit breaker
+var CircuitBreakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "circuit_breaker_rejections_total",
+	Help:      "Calls rejected by an open circuit breaker, by upstream.",
+}, []string{"upstream"})
+
+// UpstreamInFlight reports the calls in flight to each upstream
+var UpstreamInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "upstream_in_flight",
+	Help:      "Calls in flight to each upstream.",
+}, []string{"upstream"})
+
+// UpstreamQueueDepth reports the calls waiting for a slot within the concurrency bound of each upstream
+var UpstreamQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "upstream_queue_depth",
+	Help:      "Calls waiting for a slot within the concurrency bound of each upstream.",
+}, []string{"upstream"})
+
+// UpstreamShed counts the calls shed because an upstream is saturated
+var UpstreamShed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "upstream_shed_total",
+	Help:      "Calls shed because the upstream is saturated, by upstream and reason (queue_full/queue_timeout).",
+}, []string{"upstream", "reason"})
+
+// RateLimited counts the requests rejected by rate limiting
+var RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "rate_limited_total",
+	Help:      "Requests rejected by rate limiting, by upstream (pep/as) and key (user/client_ip).",
+}, []string{"upstream", "key"})
+
+// AuditDropped counts the audit records dropped because the queue was full or closed
+var AuditDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "audit_dropped_total",
+	Help:      "Audit records dropped because the queue was full or closed.",
+})
+
+// RecordCacheLookup counts a lookup of the named cache
+func RecordCacheLookup(cache string, hit bool) {
+	result := CacheMiss
+	if hit {
+		result = CacheHit
+	}
+	CacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// RegisterGaugeFunc registers a gauge whose value is provided by the supplied function
+func RegisterGaugeFunc(name string, help string, f func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f)
+}
+
+// Handler returns the http handler that exposes the metrics for scraping
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,81 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// IdTokenClaims represents the subset of ID Token claims of interest to the agent
+type IdTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience Audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	Nonce    string   `json:"nonce"`
+}
+
+// ExpiryTime returns the `exp` claim as a time
+func (claims *IdTokenClaims) ExpiryTime() time.Time {
+	return time.Unix(claims.Expiry, 0)
+}
+
+// ParseIdTokenClaims decodes the claims from the payload of the supplied JWT.
+// Note that the token signature is NOT verified - this is only suitable for informational
+// use. Claims that are relied upon must be taken from Provider.VerifyIdToken
+func ParseIdTokenClaims(token string) (claims IdTokenClaims, err error) {
+	claims = IdTokenClaims{}
+	err = nil
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		err = fmt.Errorf("token is not a JWT")
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		err = fmt.Errorf("could not decode JWT payload: %w", err)
+		return
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		err = fmt.Errorf("could not interpret JWT payload: %w", err)
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// Audience
+// The `aud` claim may be either a single string or an array of strings
+//------------------------------------------------------------------------------
+
+type Audience []string
+
+func (aud *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = Audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*aud = multiple
+	return nil
+}
+
+// Contains reports whether the audience includes the supplied value
+func (aud Audience) Contains(value string) bool {
+	for _, a := range aud {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
@@ -0,0 +1,207 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+	"github.com/sirupsen/logrus"
+)
+
+//------------------------------------------------------------------------------
+
+// TokenResponse represents the tokens returned from the Token Endpoint
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IdToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+//------------------------------------------------------------------------------
+
+type OidcClient struct {
+	Id     string
+	Secret string
+	// PreviousSecret is the secret being rotated-out, if any - used only if the Secret is
+	// rejected by the OpenID Provider
+	PreviousSecret string
+}
+
+// AuthCodeUrl returns the URL of the Authorization Endpoint to which the user is redirected
+// to begin the authorization code flow with PKCE
+func (oidcClient *OidcClient) AuthCodeUrl(ctx context.Context, provider *Provider, redirectUri string, scopes string, state string, nonce string, codeVerifier string) (authUrl string, err error) {
+	authUrl = ""
+
+	authorizationEndpoint, err := provider.GetAuthorizationEndpoint(ctx)
+	if err != nil {
+		err = fmt.Errorf("error getting authorization endpoint for OpenID Provider %v: %w", provider.issuer, err)
+		return
+	}
+	u, err := url.Parse(authorizationEndpoint)
+	if err != nil {
+		err = fmt.Errorf("bad authorization endpoint %v: %w", authorizationEndpoint, err)
+		return
+	}
+
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", oidcClient.Id)
+	query.Set("redirect_uri", redirectUri)
+	query.Set("scope", scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallengeS256(codeVerifier))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+
+	authUrl = u.String()
+	return
+}
+
+// ExchangeCode exchanges the authorization code for tokens at the Token Endpoint
+func (oidcClient *OidcClient) ExchangeCode(ctx context.Context, requestLogger *logrus.Entry, provider *Provider, code string, codeVerifier string, redirectUri string) (tokens TokenResponse, err error) {
+	tokens = TokenResponse{}
+
+	// Get the token endpoint
+	tokenEndpoint, err := provider.GetTokenEndpoint(ctx)
+	if err != nil {
+		err = fmt.Errorf("error getting token endpoint for OpenID Provider %v: %w", provider.issuer, err)
+		return
+	}
+
+	// Exchange the code - falling back to the previous client secret during rotation. The
+	// code is not consumed by a request whose client authentication fails.
+	err = uma.WithClientSecrets(requestLogger, oidcClient.Secret, oidcClient.PreviousSecret, func(secret string) (err error) {
+		tokens, err = oidcClient.exchangeCode(ctx, requestLogger, tokenEndpoint, secret, code, codeVerifier, redirectUri)
+		return
+	})
+	return
+}
+
+// exchangeCode requests the tokens from the Token Endpoint, authenticating with the client secret
+func (oidcClient *OidcClient) exchangeCode(ctx context.Context, requestLogger *logrus.Entry, tokenEndpoint string, secret string, code string, codeVerifier string, redirectUri string) (tokens TokenResponse, err error) {
+	// Prepare the request
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("code_verifier", codeVerifier)
+	data.Set("redirect_uri", redirectUri)
+	data.Set("client_id", oidcClient.Id)
+	data.Set("client_secret", secret)
+	request, err := http.NewRequestWithContext(ctx, "POST", tokenEndpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		err = fmt.Errorf("error preparing request to Token Endpoint %v: %w", tokenEndpoint, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Cache-Control", "no-cache")
+
+	// Make the request - not retried, since the code is single-use
+	requestLogger.Debug("Exchanging authorization code at token endpoint: ", tokenEndpoint)
+	response, err := uma.GetHttpClient().Do(request)
+	if err != nil {
+		err = fmt.Errorf("error making request to Token Endpoint %v: %w", tokenEndpoint, err)
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		err = uma.EndpointError(response, "Token Endpoint", tokenEndpoint)
+		return
+	}
+	body := response.Body
+	defer body.Close()
+
+	// Read the response body
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		err = fmt.Errorf("could not read response data from Token Endpoint %v: %w", tokenEndpoint, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &tokens)
+	if err != nil {
+		err = fmt.Errorf("could not interpret json response from Token Endpoint %v: %w", tokenEndpoint, err)
+		return
+	}
+	if len(tokens.IdToken) == 0 {
+		err = fmt.Errorf("no ID Token in response from Token Endpoint %v", tokenEndpoint)
+	}
+	return
+}
+
+// RevokeToken revokes the supplied token at the Revocation Endpoint (RFC 7009).
+// The tokenTypeHint is optional, being one of `access_token` or `refresh_token`.
+// Providers that do not advertise a Revocation Endpoint are skipped without error.
+func (oidcClient *OidcClient) RevokeToken(ctx context.Context, requestLogger *logrus.Entry, provider *Provider, token string, tokenTypeHint string) (err error) {
+	// Get the revocation endpoint
+	revocationEndpoint, err := provider.GetRevocationEndpoint(ctx)
+	if err != nil {
+		err = fmt.Errorf("error getting revocation endpoint for OpenID Provider %v: %w", provider.issuer, err)
+		return
+	}
+	if len(revocationEndpoint) == 0 {
+		requestLogger.Debugf("OpenID Provider %v does not support token revocation", provider.issuer)
+		return
+	}
+
+	// Revoke the token - falling back to the previous client secret during rotation
+	return uma.WithClientSecrets(requestLogger, oidcClient.Secret, oidcClient.PreviousSecret, func(secret string) error {
+		return oidcClient.revokeToken(ctx, requestLogger, revocationEndpoint, secret, token, tokenTypeHint)
+	})
+}
+
+// revokeToken requests the revocation at the Revocation Endpoint, authenticating with the
+// client secret
+func (oidcClient *OidcClient) revokeToken(ctx context.Context, requestLogger *logrus.Entry, revocationEndpoint string, secret string, token string, tokenTypeHint string) (err error) {
+	// Prepare the request
+	data := url.Values{}
+	data.Set("token", token)
+	if len(tokenTypeHint) > 0 {
+		data.Set("token_type_hint", tokenTypeHint)
+	}
+	data.Set("client_id", oidcClient.Id)
+	data.Set("client_secret", secret)
+	request, err := http.NewRequestWithContext(ctx, "POST", revocationEndpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		err = fmt.Errorf("error preparing request to Revocation Endpoint %v: %w", revocationEndpoint, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Make the request
+	requestLogger.Debugf("Revoking %s at revocation endpoint: %s", tokenTypeHint, revocationEndpoint)
+	response, err := uma.MakeResilentRequest(request, requestLogger, "RevokeToken")
+	if err != nil {
+		err = fmt.Errorf("error making request to Revocation Endpoint %v: %w", revocationEndpoint, err)
+		return
+	}
+	// RFC 7009 - invalid tokens also result in 200 (OK)
+	if response.StatusCode != http.StatusOK {
+		err = uma.EndpointError(response, "Revocation Endpoint", revocationEndpoint)
+		return
+	}
+	response.Body.Close()
+	return
+}
+
+// ValidateIdToken validates the ID Token received from the Token Endpoint, as per OIDC Core
+// 3.1.3.7 - its signature, issuer, audience, nonce and expiry
+func (oidcClient *OidcClient) ValidateIdToken(ctx context.Context, provider *Provider, idToken string, nonce string) (claims IdTokenClaims, err error) {
+	claims, err = provider.VerifyIdToken(ctx, idToken)
+	if err != nil {
+		return
+	}
+	switch {
+	case !claims.Audience.Contains(oidcClient.Id):
+		err = fmt.Errorf("ID Token audience %v does not include client '%v'", claims.Audience, oidcClient.Id)
+	case claims.Nonce != nonce:
+		err = fmt.Errorf("ID Token nonce does not match")
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
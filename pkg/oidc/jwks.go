@@ -0,0 +1,243 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/tracing"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+)
+
+// jwksRefreshInterval is the minimum interval between fetches of the JWKS, which is
+// fetched again when a token is signed by an unknown key - e.g. after key rotation
+const jwksRefreshInterval = time.Minute
+
+// keySet holds the signing keys of the provider, from its JWKS document
+type keySet struct {
+	mutex   sync.Mutex
+	keys    []jsonWebKey
+	fetched time.Time
+}
+
+// jsonWebKey is a public signing key of the provider (RFC 7517)
+type jsonWebKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// signingAlgorithms maps the supported JWS algorithms (RFC 7518) to their hash
+var signingAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// VerifyIdToken verifies the signature of the ID Token against the keys of the provider,
+// and checks that it was issued by the provider and has not expired. The audience is not
+// checked - see OidcClient.ValidateIdToken.
+func (provider *Provider) VerifyIdToken(ctx context.Context, idToken string) (claims IdTokenClaims, err error) {
+	if err = provider.verifySignature(ctx, idToken); err != nil {
+		return
+	}
+	if claims, err = ParseIdTokenClaims(idToken); err != nil {
+		return
+	}
+	issuer, err := provider.GetIssuer(ctx)
+	if err != nil {
+		return
+	}
+	switch {
+	case claims.Issuer != issuer:
+		err = fmt.Errorf("ID Token issuer '%v' does not match '%v'", claims.Issuer, issuer)
+	case time.Now().After(claims.ExpiryTime()):
+		err = fmt.Errorf("ID Token has expired")
+	}
+	return
+}
+
+// verifySignature verifies the JWS signature of the token with the provider's key
+func (provider *Provider) verifySignature(ctx context.Context, token string) (err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("token is not a JWT")
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("could not decode JWT header: %w", err)
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err = json.Unmarshal(headerJson, &header); err != nil {
+		return fmt.Errorf("could not interpret JWT header: %w", err)
+	}
+	hash, ok := signingAlgorithms[header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported JWT signing algorithm '%v'", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("could not decode JWT signature: %w", err)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hasher.Sum(nil)
+
+	keys, err := provider.getSigningKeys(ctx, header.Kid)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if verify(header.Alg, key, hash, digest, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("JWT signature is not valid")
+}
+
+// verify checks the signature of the digest with the key, for the algorithm
+func verify(alg string, key crypto.PublicKey, hash crypto.Hash, digest []byte, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// getSigningKeys returns the keys with the key ID - or all keys if the token names none.
+// The JWKS is fetched again if the key is unknown.
+func (provider *Provider) getSigningKeys(ctx context.Context, kid string) (keys []crypto.PublicKey, err error) {
+	jwksUri, err := provider.getJwksUri(ctx)
+	if err != nil {
+		return
+	}
+	provider.keySet.mutex.Lock()
+	defer provider.keySet.mutex.Unlock()
+	find := func() {
+		for _, key := range provider.keySet.keys {
+			if len(kid) == 0 || key.kid == kid {
+				keys = append(keys, key.key)
+			}
+		}
+	}
+	find()
+	metrics.RecordCacheLookup("jwks", len(keys) > 0)
+	if len(keys) == 0 && time.Since(provider.keySet.fetched) >= jwksRefreshInterval {
+		var fetched []jsonWebKey
+		if fetched, err = fetchJwks(ctx, jwksUri); err != nil {
+			return
+		}
+		provider.keySet.keys, provider.keySet.fetched = fetched, time.Now()
+		find()
+	}
+	if len(keys) == 0 {
+		err = fmt.Errorf("no signing key '%v' in %v", kid, jwksUri)
+	}
+	return
+}
+
+// getJwksUri returns the JWKS URI of the provider
+func (provider *Provider) getJwksUri(ctx context.Context) (jwksUri string, err error) {
+	if err = provider.discover(ctx); err == nil {
+		jwksUri = provider.jwksUri
+	}
+	if err == nil && len(jwksUri) == 0 {
+		err = fmt.Errorf("OpenID Provider %v does not advertise a jwks_uri", provider.issuer)
+	}
+	return
+}
+
+// fetchJwks retrieves the signing keys from the JWKS document
+func fetchJwks(ctx context.Context, jwksUri string) (keys []jsonWebKey, err error) {
+	defer func(start time.Time) {
+		metrics.UpstreamDuration.WithLabelValues("oidcJwks").Observe(time.Since(start).Seconds())
+	}(time.Now())
+	request, err := http.NewRequestWithContext(ctx, "GET", jwksUri, nil)
+	if err != nil {
+		err = fmt.Errorf("could not prepare request to %v: %w", jwksUri, err)
+		return
+	}
+	tracing.Inject(request)
+	logging.Inject(request)
+	response, err := uma.GetHttpClient().Do(request)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve signing keys from %v: %w", jwksUri, err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected response code '%v' from %v", response.StatusCode, jwksUri)
+		return
+	}
+	bodyBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		err = fmt.Errorf("could not read response data from %v: %w", jwksUri, err)
+		return
+	}
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err = json.Unmarshal(bodyBytes, &jwks); err != nil {
+		err = fmt.Errorf("could not interpret json response from %v: %w", jwksUri, err)
+		return
+	}
+
+	// Keys of unsupported types are skipped
+	decode := func(value string) *big.Int {
+		data, decodeErr := base64.RawURLEncoding.DecodeString(value)
+		if decodeErr != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			if n, e := decode(jwk.N), decode(jwk.E); n != nil && e != nil && e.IsInt64() {
+				keys = append(keys, jsonWebKey{kid: jwk.Kid, key: &rsa.PublicKey{N: n, E: int(e.Int64())}})
+			}
+		case "EC":
+			curve, ok := curves[jwk.Crv]
+			if x, y := decode(jwk.X), decode(jwk.Y); ok && x != nil && y != nil && curve.IsOnCurve(x, y) {
+				keys = append(keys, jsonWebKey{kid: jwk.Kid, key: &ecdsa.PublicKey{Curve: curve, X: x, Y: y}})
+			}
+		}
+	}
+	return
+}
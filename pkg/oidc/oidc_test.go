@@ -0,0 +1,221 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/oidc"
+)
+
+// testProvider is an OpenID Provider serving its discovery document and JWKS
+type testProvider struct {
+	server *httptest.Server
+	issuer string // advertised in the discovery document
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	provider := &testProvider{}
+	var err error
+	if provider.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if provider.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	provider.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		url := provider.server.URL
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 provider.issuer,
+				"authorization_endpoint": url + "/auth",
+				"token_endpoint":         url + "/token",
+				"jwks_uri":               url + "/jwks",
+			})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "n": encode(provider.rsaKey.N), "e": encode(big.NewInt(int64(provider.rsaKey.E)))},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(provider.ecKey.X), "y": encode(provider.ecKey.Y)},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	provider.issuer = provider.server.URL
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+// sign returns the JWT of the claims, signed with the RS256 or ES256 key
+func (provider *testProvider) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := encode(map[string]string{"alg": alg, "kid": kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, provider.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, provider.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestValidateIdToken tests the validation of the signature and claims of the ID Token
+func TestValidateIdToken(t *testing.T) {
+	provider := newTestProvider(t)
+	client := oidc.OidcClient{Id: "my-client"}
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": provider.issuer, "sub": "user-1", "aud": "my-client", "nonce": "n-0S6",
+			"exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix(),
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	valid := provider.sign(t, "RS256", "rsa", claims(nil))
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + strings.Split(provider.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["sub"] = "admin" })), ".")[1] + "." + parts[2]
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid RS256", valid, true},
+		{"valid ES256", provider.sign(t, "ES256", "ec", claims(nil)), true},
+		{"valid without key ID", provider.sign(t, "RS256", "", claims(nil)), true},
+		{"audience in list", provider.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "my-client"} })), true},
+		{"tampered payload", tampered, false},
+		{"unsigned", unsigned, false},
+		{"signed with wrong key type", provider.sign(t, "ES256", "rsa", claims(nil)), false},
+		{"unknown key", provider.sign(t, "RS256", "unknown", claims(nil)), false},
+		{"wrong issuer", provider.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.org" })), false},
+		{"wrong audience", provider.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["aud"] = "other" })), false},
+		{"expired", provider.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), false},
+		{"wrong nonce", provider.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["nonce"] = "replayed" })), false},
+		{"not a JWT", "not-a-jwt", false},
+	}
+	oidcProvider := oidc.NewProvider(provider.issuer)
+	for _, test := range tests {
+		validated, err := client.ValidateIdToken(context.Background(), oidcProvider, test.token, "n-0S6")
+		if test.ok && (err != nil || validated.Subject != "user-1") {
+			t.Errorf("%v: expected the ID Token to be valid: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%v: expected the ID Token to be rejected", test.name)
+		}
+	}
+}
+
+// TestDiscoveryIssuerMismatch tests that the provider is rejected if its discovery
+// document advertises a different issuer
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.issuer = "https://evil.example.org"
+	if _, err := oidc.NewProvider(provider.server.URL).GetTokenEndpoint(context.Background()); err == nil {
+		t.Error("expected the mismatched issuer to be rejected")
+	}
+
+	// A trailing slash in the configured issuer is ignored
+	provider.issuer = provider.server.URL
+	if issuer, err := oidc.NewProvider(provider.server.URL + "/").GetIssuer(context.Background()); err != nil || issuer != provider.server.URL {
+		t.Errorf("unexpected issuer '%v': %v", issuer, err)
+	}
+}
+
+// TestPkce tests the PKCE code verifier and S256 code challenge
+func TestPkce(t *testing.T) {
+	// RFC 7636 Appendix B
+	if challenge := oidc.CodeChallengeS256("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("unexpected code challenge: %v", challenge)
+	}
+
+	first, err := oidc.NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := oidc.NewCodeVerifier()
+	if len(first) != 43 || strings.Trim(first, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		t.Errorf("code verifier is not 43 unreserved characters: %v", first)
+	}
+	if first == second {
+		t.Error("expected distinct code verifiers")
+	}
+}
+
+// cacheLookups returns the count of lookups of the cache with the result, as scraped
+func cacheLookups(t *testing.T, cache string, result string) (count float64) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	series := fmt.Sprintf(`uma_user_agent_cache_lookups_total{cache="%s",result="%s"} `, cache, result)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, series) {
+			count, _ = strconv.ParseFloat(strings.TrimPrefix(line, series), 64)
+		}
+	}
+	return
+}
+
+// TestCacheMetrics tests that the lookups of the discovery document and the signing keys
+// are counted as hits once they are retained
+func TestCacheMetrics(t *testing.T) {
+	provider := newTestProvider(t)
+	oidcProvider := oidc.NewProvider(provider.issuer)
+	idToken := provider.sign(t, "RS256", "rsa", map[string]interface{}{"iss": provider.issuer, "sub": "user-1", "exp": time.Now().Add(time.Minute).Unix()})
+	counts := func() []float64 {
+		return []float64{cacheLookups(t, "oidcDiscovery", "hit"), cacheLookups(t, "oidcDiscovery", "miss"),
+			cacheLookups(t, "jwks", "hit"), cacheLookups(t, "jwks", "miss")}
+	}
+
+	before := counts()
+	if _, err := oidcProvider.VerifyIdToken(context.Background(), idToken); err != nil {
+		t.Fatal(err)
+	}
+	first := counts()
+	if first[1]-before[1] != 1 || first[3]-before[3] != 1 || first[2] != before[2] {
+		t.Errorf("expected a miss of each cache on first use: %v -> %v", before, first)
+	}
+	if _, err := oidcProvider.VerifyIdToken(context.Background(), idToken); err != nil {
+		t.Fatal(err)
+	}
+	second := counts()
+	if second[0] <= first[0] || second[1] != first[1] || second[2]-first[2] != 1 || second[3] != first[3] {
+		t.Errorf("expected hits of each cache on reuse: %v -> %v", first, second)
+	}
+}
@@ -0,0 +1,33 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// RandomString returns a url-safe random string derived from the given number of random bytes
+func RandomString(numBytes int) (value string, err error) {
+	value = ""
+	buf := make([]byte, numBytes)
+	if _, err = rand.Read(buf); err != nil {
+		err = fmt.Errorf("could not generate random data: %w", err)
+		return
+	}
+	value = base64.RawURLEncoding.EncodeToString(buf)
+	return
+}
+
+// NewCodeVerifier returns a PKCE code verifier (RFC 7636) - 32 random bytes give
+// the 43 characters that is the minimum length permitted
+func NewCodeVerifier() (string, error) {
+	return RandomString(32)
+}
+
+// CodeChallengeS256 returns the PKCE code challenge for the supplied verifier,
+// using the S256 method
+func CodeChallengeS256(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
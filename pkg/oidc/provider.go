@@ -0,0 +1,180 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/tracing"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+)
+
+//------------------------------------------------------------------------------
+
+// Provider represents an OpenID Provider, with the endpoints obtained from its
+// discovery document
+type Provider struct {
+	mutex                 sync.Mutex
+	issuer                string
+	authorizationEndpoint string
+	tokenEndpoint         string
+	endSessionEndpoint    string
+	revocationEndpoint    string
+	jwksUri               string
+	keySet                keySet
+}
+
+//------------------------------------------------------------------------------
+
+func NewProvider(issuer string) *Provider {
+	return &Provider{issuer: strings.TrimSuffix(issuer, "/")}
+}
+
+// GetIssuer returns the issuer identifier, as advertised by the provider's discovery document
+// - which matches the configured issuer, other than a trailing slash
+func (provider *Provider) GetIssuer(ctx context.Context) (issuer string, err error) {
+	if err = provider.discover(ctx); err == nil {
+		issuer = provider.issuer
+	}
+	return
+}
+
+// GetAuthorizationEndpoint returns the Authorization Endpoint of the provider
+func (provider *Provider) GetAuthorizationEndpoint(ctx context.Context) (endpoint string, err error) {
+	if err = provider.discover(ctx); err == nil {
+		endpoint = provider.authorizationEndpoint
+	}
+	return
+}
+
+// GetTokenEndpoint returns the Token Endpoint of the provider
+func (provider *Provider) GetTokenEndpoint(ctx context.Context) (endpoint string, err error) {
+	if err = provider.discover(ctx); err == nil {
+		endpoint = provider.tokenEndpoint
+	}
+	return
+}
+
+// GetEndSessionEndpoint returns the End Session Endpoint of the provider,
+// which is blank if the provider does not advertise one
+func (provider *Provider) GetEndSessionEndpoint(ctx context.Context) (endpoint string, err error) {
+	if err = provider.discover(ctx); err == nil {
+		endpoint = provider.endSessionEndpoint
+	}
+	return
+}
+
+// GetRevocationEndpoint returns the Revocation Endpoint (RFC 7009) of the provider,
+// which is blank if the provider does not advertise one
+func (provider *Provider) GetRevocationEndpoint(ctx context.Context) (endpoint string, err error) {
+	if err = provider.discover(ctx); err == nil {
+		endpoint = provider.revocationEndpoint
+	}
+	return
+}
+
+// discover performs a lookup (HTTP GET) of the OpenID Provider's discovery document,
+// to retrieve the endpoints. The lookup is made only once, and the results are retained
+func (provider *Provider) discover(ctx context.Context) (err error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	// If we have it already, then nothing to do
+	metrics.RecordCacheLookup("oidcDiscovery", len(provider.authorizationEndpoint) > 0)
+	if len(provider.authorizationEndpoint) > 0 {
+		return
+	}
+
+	// Fetch the discovery document from the provider
+	defer func(start time.Time) {
+		metrics.UpstreamDuration.WithLabelValues("oidcDiscovery").Observe(time.Since(start).Seconds())
+	}(time.Now())
+	discoveryUrl := provider.issuer + "/.well-known/openid-configuration"
+	request, err := http.NewRequestWithContext(ctx, "GET", discoveryUrl, nil)
+	if err != nil {
+		err = fmt.Errorf("could not prepare request to %v: %w", discoveryUrl, err)
+		return
+	}
+	tracing.Inject(request)
+	logging.Inject(request)
+	response, err := uma.GetHttpClient().Do(request)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve OpenID Provider details from %v: %w", discoveryUrl, err)
+		return
+	}
+
+	// Read the response body
+	body := response.Body
+	defer body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected response code '%v' from %v", response.StatusCode, discoveryUrl)
+		return
+	}
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		err = fmt.Errorf("could not read response data from %v: %w", discoveryUrl, err)
+		return
+	}
+
+	// Interpret as json response
+	bodyJson := struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+		RevocationEndpoint    string `json:"revocation_endpoint"`
+		JwksUri               string `json:"jwks_uri"`
+	}{}
+	err = json.Unmarshal(bodyBytes, &bodyJson)
+	if err != nil {
+		err = fmt.Errorf("could not interpret json response from %v: %w", discoveryUrl, err)
+		return
+	}
+
+	// Check the mandatory endpoints are non-empty
+	if len(bodyJson.AuthorizationEndpoint) == 0 || len(bodyJson.TokenEndpoint) == 0 {
+		err = fmt.Errorf("blank Authorization and/or Token Endpoint retrieved from %v", discoveryUrl)
+		return
+	}
+
+	// The issuer must be that which was configured (OIDC Discovery 4.3) - the issuer in the
+	// document is then used for ID token validation, as it may have a trailing slash
+	if strings.TrimSuffix(bodyJson.Issuer, "/") != provider.issuer {
+		err = fmt.Errorf("issuer '%v' retrieved from %v does not match '%v'", bodyJson.Issuer, discoveryUrl, provider.issuer)
+		return
+	}
+	provider.issuer = bodyJson.Issuer
+	provider.authorizationEndpoint = bodyJson.AuthorizationEndpoint
+	provider.tokenEndpoint = bodyJson.TokenEndpoint
+	provider.endSessionEndpoint = bodyJson.EndSessionEndpoint
+	provider.revocationEndpoint = bodyJson.RevocationEndpoint
+	provider.jwksUri = bodyJson.JwksUri
+	return
+}
+
+//------------------------------------------------------------------------------
+
+// providers retains the Provider per issuer, so that discovery is performed only once
+var providers = struct {
+	mutex     sync.Mutex
+	providers map[string]*Provider
+}{providers: make(map[string]*Provider)}
+
+// GetProvider returns the (shared) Provider for the supplied issuer
+func GetProvider(issuer string) *Provider {
+	providers.mutex.Lock()
+	defer providers.mutex.Unlock()
+	provider, ok := providers.providers[issuer]
+	if !ok {
+		provider = NewProvider(issuer)
+		providers.providers[issuer] = provider
+	}
+	return provider
+}
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// Settings configures a token bucket rate limit
+type Settings struct {
+	// Sustained rate (tokens per second). Zero disables the limit.
+	Rate float64
+	// Bucket capacity, i.e. the number of requests allowed in a burst (minimum 1)
+	Burst int
+}
+
+func (settings Settings) burst() float64 {
+	if settings.Burst < 1 {
+		return 1
+	}
+	return float64(settings.Burst)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//------------------------------------------------------------------------------
+
+// Limiter applies a token bucket rate limit independently per key
+type Limiter struct {
+	mutex     sync.Mutex
+	settings  Settings
+	buckets   map[string]*bucket
+	lastPurge time.Time
+}
+
+// Purge interval for idle buckets
+const purgeInterval = time.Minute
+
+//------------------------------------------------------------------------------
+
+func NewLimiter(settings Settings) *Limiter {
+	return &Limiter{settings: settings, buckets: make(map[string]*bucket), lastPurge: time.Now()}
+}
+
+// Configure updates the settings. Existing buckets are retained.
+func (limiter *Limiter) Configure(settings Settings) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.settings = settings
+	if settings.Rate <= 0 {
+		limiter.buckets = make(map[string]*bucket)
+	}
+}
+
+// IsEnabled indicates whether a limit is configured
+func (limiter *Limiter) IsEnabled() bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.settings.Rate > 0
+}
+
+// Allow takes a token from the bucket of the key. If the bucket is empty then the request
+// is not allowed, and the time until a token is available is returned.
+func (limiter *Limiter) Allow(key string) (allowed bool, retryAfter time.Duration) {
+	return limiter.allowAt(key, time.Now())
+}
+
+func (limiter *Limiter) allowAt(key string, now time.Time) (allowed bool, retryAfter time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	rate := limiter.settings.Rate
+	if rate <= 0 {
+		return true, 0
+	}
+	capacity := limiter.settings.burst()
+	limiter.purge(now)
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// purge drops the buckets that have refilled, which are equivalent to new buckets
+func (limiter *Limiter) purge(now time.Time) {
+	if now.Sub(limiter.lastPurge) < purgeInterval {
+		return
+	}
+	limiter.lastPurge = now
+	capacity := limiter.settings.burst()
+	for key, b := range limiter.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limiter.settings.Rate >= capacity {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of keys being tracked
+func (limiter *Limiter) Len() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return len(limiter.buckets)
+}
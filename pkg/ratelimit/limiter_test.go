@@ -0,0 +1,43 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/ratelimit"
+)
+
+// TestLimiter tests the burst, the retry-after and the independence of keys
+func TestLimiter(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Settings{Rate: 10, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("eric"); !allowed {
+			t.Fatalf("request %d within burst should be allowed", i)
+		}
+	}
+	allowed, retryAfter := limiter.Allow("eric")
+	if allowed {
+		t.Fatal("request beyond burst should not be allowed")
+	}
+	if retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Errorf("unexpected retry-after: %v", retryAfter)
+	}
+	if allowed, _ := limiter.Allow("alice"); !allowed {
+		t.Error("other key should not be limited")
+	}
+
+	time.Sleep(retryAfter + 10*time.Millisecond)
+	if allowed, _ := limiter.Allow("eric"); !allowed {
+		t.Error("request should be allowed after refill")
+	}
+}
+
+// TestLimiterDisabled tests that a zero rate does not limit
+func TestLimiterDisabled(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Settings{})
+	for i := 0; i < 100; i++ {
+		if allowed, _ := limiter.Allow("eric"); !allowed {
+			t.Fatal("disabled limiter should allow all requests")
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Patterns that identify sensitive values that have found their way into a log line
+var (
+	// A JWT - three base64url parts, of which the first is a json object `{"...`
+	jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+	// Authorization header credentials
+	bearerPattern = regexp.MustCompile(`(?i)\b(bearer|basic)(\s+)([A-Za-z0-9._~+/=-]+)`)
+	// Form/query parameters that carry credentials
+	paramPattern = regexp.MustCompile(`(?i)\b(client_secret|password|access_token|refresh_token|id_token|claim_token|pct|token|code_verifier)=([^&\s"',;]+)`)
+	// Cookie and Set-Cookie header values - e.g. `Cookie: a=1; b=2` or `Set-Cookie:[a=1; Path=/]`
+	cookiePattern = regexp.MustCompile(`(?i)\b((?:set-)?cookie)(:\s*\[?)([^\r\n\]"]+)`)
+	// The `name=value` pairs of a cookie header value
+	cookiePairPattern = regexp.MustCompile(`([^=;,\s]+)=([^;,\s]+)`)
+	// The attributes of a Set-Cookie header, whose values are not sensitive
+	cookieAttributes = map[string]bool{"path": true, "domain": true, "expires": true, "max-age": true, "samesite": true}
+)
+
+// secrets are known sensitive values (e.g. the client secret) that are redacted by exact
+// match, keyed by name so that they can be replaced when the configuration changes
+var secrets = struct {
+	rwMutex sync.RWMutex
+	values  map[string]string
+	ordered []string
+}{values: make(map[string]string)}
+
+// SetSecret registers (or replaces) the named sensitive value, to be redacted from all logs.
+// A blank value removes the registration.
+func SetSecret(name string, value string) {
+	secrets.rwMutex.Lock()
+	defer secrets.rwMutex.Unlock()
+	if len(value) == 0 {
+		delete(secrets.values, name)
+	} else {
+		secrets.values[name] = value
+	}
+	// Longest first, so that a secret that contains another is fully redacted
+	secrets.ordered = secrets.ordered[:0]
+	for _, v := range secrets.values {
+		secrets.ordered = append(secrets.ordered, v)
+	}
+	sort.Slice(secrets.ordered, func(i, j int) bool { return len(secrets.ordered[i]) > len(secrets.ordered[j]) })
+}
+
+// String redacts the sensitive values from the supplied text
+func String(text string) string {
+	secrets.rwMutex.RLock()
+	for _, secret := range secrets.ordered {
+		if strings.Contains(text, secret) {
+			text = strings.ReplaceAll(text, secret, Fingerprint(secret))
+		}
+	}
+	secrets.rwMutex.RUnlock()
+
+	text = jwtPattern.ReplaceAllStringFunc(text, Token)
+	text = bearerPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := bearerPattern.FindStringSubmatch(match)
+		if strings.HasPrefix(parts[3], "[token") {
+			return match
+		}
+		return parts[1] + parts[2] + Token(parts[3])
+	})
+	text = cookiePattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := cookiePattern.FindStringSubmatch(match)
+		return parts[1] + parts[2] + cookiePairPattern.ReplaceAllStringFunc(parts[3], func(pair string) string {
+			nameValue := cookiePairPattern.FindStringSubmatch(pair)
+			if cookieAttributes[strings.ToLower(nameValue[1])] || strings.HasPrefix(nameValue[2], "sha256:") || strings.HasPrefix(nameValue[2], "[token") {
+				return pair
+			}
+			return nameValue[1] + "=" + Fingerprint(nameValue[2])
+		})
+	})
+	text = paramPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := paramPattern.FindStringSubmatch(match)
+		if strings.HasPrefix(parts[2], "sha256:") {
+			return match
+		}
+		return parts[1] + "=" + Fingerprint(parts[2])
+	})
+	return text
+}
+
+//------------------------------------------------------------------------------
+// Hook
+// logrus hook that redacts sensitive values from the message and fields of all entries
+//------------------------------------------------------------------------------
+
+type Hook struct{}
+
+func NewHook() *Hook {
+	return &Hook{}
+}
+
+func (hook *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *Hook) Fire(entry *logrus.Entry) error {
+	entry.Message = String(entry.Message)
+	for k, v := range entry.Data {
+		switch value := v.(type) {
+		case Secret:
+			// already safe
+		case string:
+			entry.Data[k] = String(value)
+		case error:
+			entry.Data[k] = String(value.Error())
+		case fmt.Stringer:
+			entry.Data[k] = String(value.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Number of hex characters of the hash that form the fingerprint
+const fingerprintLength = 12
+
+// Fingerprint returns a short, non-reversible identifier of the supplied value - sufficient
+// to correlate occurrences of the same token across log lines without revealing it
+func Fingerprint(value string) string {
+	if len(value) == 0 {
+		return "<empty>"
+	}
+	hash := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(hash[:])[:fingerprintLength]
+}
+
+// Token returns a loggable representation of the supplied bearer token - its fingerprint
+// plus, for a JWT, the non-sensitive `sub` and `exp` claims
+func Token(token string) string {
+	if len(token) == 0 {
+		return "<empty>"
+	}
+	sb := strings.Builder{}
+	sb.WriteString("[token ")
+	sb.WriteString(Fingerprint(token))
+	if sub, exp, ok := jwtClaims(token); ok {
+		if len(sub) > 0 {
+			fmt.Fprintf(&sb, " sub=%s", sub)
+		}
+		if exp > 0 {
+			fmt.Fprintf(&sb, " exp=%s", time.Unix(exp, 0).UTC().Format(time.RFC3339))
+		}
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// jwtClaims decodes the `sub` and `exp` claims from the (unverified) JWT payload
+func jwtClaims(token string) (sub string, exp int64, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return
+	}
+	claims := struct {
+		Sub string  `json:"sub"`
+		Exp float64 `json:"exp"`
+	}{}
+	if json.Unmarshal(payload, &claims) != nil {
+		return
+	}
+	// Guard against the `sub` being used to smuggle content into the log
+	if len(claims.Sub) > 128 || strings.ContainsAny(claims.Sub, " \r\n\t") {
+		claims.Sub = Fingerprint(claims.Sub)
+	}
+	return claims.Sub, int64(claims.Exp), true
+}
+
+//------------------------------------------------------------------------------
+// Secret
+// Typed wrapper for a sensitive value, that only renders its fingerprint
+//------------------------------------------------------------------------------
+
+type Secret string
+
+func (s Secret) String() string {
+	return Token(string(s))
+}
+
+// GoString ensures that the value is also redacted for `%#v`
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalJSON ensures that the value is also redacted by json formatters
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Reveal returns the underlying sensitive value
+func (s Secret) Reveal() string {
+	return string(s)
+}
@@ -0,0 +1,136 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// Policy defines when, and after what delay, a failed http request is retried
+type Policy struct {
+	// Maximum number of retries (after the first attempt)
+	MaxRetries int
+	// Exponential backoff - the delay before retry n is InitialBackoff * Multiplier^(n-1), capped at MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Fraction (0.0 - 1.0) by which the backoff is randomly varied, to spread out the retries of concurrent clients
+	Jitter float64
+	// Overall time, from the first attempt, beyond which no retry is started. Zero means no limit.
+	Budget time.Duration
+	// Response status codes that are retried
+	RetryableStatuses []int
+	// Allow retry of non-idempotent requests (e.g. POST) when the upstream may have processed the failed attempt
+	RetryNonIdempotent bool
+}
+
+// DefaultRetryableStatuses are the status codes that indicate a transient failure
+var DefaultRetryableStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+//------------------------------------------------------------------------------
+
+// IsIdempotent indicates whether requests with the method can safely be repeated
+func IsIdempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// ShouldRetryStatus indicates whether the response status warrants a retry of the request.
+// 429 and 503 responses indicate that the request was not processed, and so are retried
+// regardless of idempotency.
+func (policy Policy) ShouldRetryStatus(method string, statusCode int) bool {
+	retryable := false
+	for _, status := range policy.RetryableStatuses {
+		if status == statusCode {
+			retryable = true
+			break
+		}
+	}
+	if !retryable {
+		return false
+	}
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable {
+		return true
+	}
+	return IsIdempotent(method) || policy.RetryNonIdempotent
+}
+
+// ShouldRetryError indicates whether the error of a request warrants a retry.
+// A failure to connect is always retried, since the request was not sent. A timeout is
+// retried subject to idempotency. Cancellation of the request's context is not retried -
+// the caller should also check for expiry of the request's context deadline, which is not
+// distinguishable from a client timeout by the error alone.
+func (policy Policy) ShouldRetryError(method string, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return IsIdempotent(method) || policy.RetryNonIdempotent
+	}
+	return false
+}
+
+// Delay returns the delay before the numbered retry (from 1). A delay requested by the
+// upstream (Retry-After) is respected if it is longer than the backoff.
+func (policy Policy) Delay(retry int, retryAfter time.Duration) time.Duration {
+	backoff := float64(policy.InitialBackoff)
+	if retry > 1 && policy.Multiplier > 1 {
+		backoff *= math.Pow(policy.Multiplier, float64(retry-1))
+	}
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		jitter := math.Min(policy.Jitter, 1)
+		backoff *= 1 - jitter + 2*jitter*rand.Float64()
+	}
+	delay := time.Duration(backoff)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// ParseRetryAfter interprets the value of a Retry-After header - either delay-seconds or an http-date
+func ParseRetryAfter(value string, now time.Time) (delay time.Duration, ok bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay = date.Sub(now); delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
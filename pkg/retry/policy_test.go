@@ -0,0 +1,76 @@
+package retry_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/retry"
+)
+
+var testPolicy = retry.Policy{
+	MaxRetries:        3,
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        time.Second,
+	Multiplier:        2,
+	Jitter:            0.2,
+	RetryableStatuses: retry.DefaultRetryableStatuses,
+}
+
+// TestDelay tests the exponential backoff, with jitter, cap and Retry-After
+func TestDelay(t *testing.T) {
+	for retryNum, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 6: time.Second} {
+		delay := testPolicy.Delay(retryNum, 0)
+		if delay < expected*8/10 || delay > expected*12/10 {
+			t.Errorf("retry %d: delay %v not within jitter of %v", retryNum, delay, expected)
+		}
+	}
+	if delay := testPolicy.Delay(1, 5*time.Second); delay != 5*time.Second {
+		t.Errorf("Retry-After not respected: %v", delay)
+	}
+}
+
+// TestParseRetryAfter tests both forms of the Retry-After header
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	if delay, ok := retry.ParseRetryAfter("7", now); !ok || delay != 7*time.Second {
+		t.Errorf("unexpected delay-seconds result: %v %v", delay, ok)
+	}
+	date := now.Add(30 * time.Second).Format(http.TimeFormat)
+	if delay, ok := retry.ParseRetryAfter(date, now); !ok || delay != 30*time.Second {
+		t.Errorf("unexpected http-date result: %v %v", delay, ok)
+	}
+	if _, ok := retry.ParseRetryAfter("soon", now); ok {
+		t.Error("expected invalid value to be rejected")
+	}
+}
+
+// TestShouldRetry tests the retryable statuses, errors and idempotency rules
+func TestShouldRetry(t *testing.T) {
+	if !testPolicy.ShouldRetryStatus("GET", 502) || testPolicy.ShouldRetryStatus("GET", 404) {
+		t.Error("unexpected retry decision for GET")
+	}
+	if testPolicy.ShouldRetryStatus("POST", 502) {
+		t.Error("non-idempotent request should not be retried after 502")
+	}
+	if !testPolicy.ShouldRetryStatus("POST", 503) || !testPolicy.ShouldRetryStatus("POST", 429) {
+		t.Error("non-idempotent request should be retried when not processed (429/503)")
+	}
+
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	if !testPolicy.ShouldRetryError("POST", dialErr) {
+		t.Error("connection failure should be retried")
+	}
+	timeoutErr := &net.OpError{Op: "read", Err: timeoutError{}}
+	if !testPolicy.ShouldRetryError("GET", timeoutErr) || testPolicy.ShouldRetryError("POST", timeoutErr) {
+		t.Error("unexpected retry decision for timeout")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,183 @@
+package seal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version prefix of the sealed format: version(1) | keyId(4) | nonce(12) | ciphertext
+const sealVersion byte = 1
+const keyIdLength = 4
+
+//------------------------------------------------------------------------------
+
+// key is a single AES-256-GCM key, identified by a prefix of its hash
+type key struct {
+	id   [keyIdLength]byte
+	aead cipher.AEAD
+}
+
+// Keyring is an ordered set of keys. Values are sealed with the first (primary) key,
+// and unsealed with whichever key sealed them - to support key rotation.
+type Keyring struct {
+	keys []key
+}
+
+//------------------------------------------------------------------------------
+
+// ParseKeyring reads keys from the supplied data, one base64-encoded 32-byte key per line.
+// The first key is the primary. Blank lines and lines beginning with '#' are ignored.
+func ParseKeyring(data []byte) (keyring *Keyring, err error) {
+	keyring = &Keyring{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyBytes, decodeErr := decodeKey(line)
+		if decodeErr != nil {
+			err = fmt.Errorf("bad key at line %d: %w", lineNum, decodeErr)
+			return nil, err
+		}
+		if len(keyBytes) != 32 {
+			err = fmt.Errorf("bad key at line %d: expecting 32 bytes, got %d", lineNum, len(keyBytes))
+			return nil, err
+		}
+		block, _ := aes.NewCipher(keyBytes)
+		aead, _ := cipher.NewGCM(block)
+		k := key{aead: aead}
+		hash := sha256.Sum256(keyBytes)
+		copy(k.id[:], hash[:keyIdLength])
+		keyring.keys = append(keyring.keys, k)
+	}
+	if len(keyring.keys) == 0 {
+		err = fmt.Errorf("no keys found")
+		return nil, err
+	}
+	return
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Seal encrypts and authenticates the plaintext with the primary key, binding it to the
+// additional data. The result is url-safe, for use as a cookie value.
+func (keyring *Keyring) Seal(plaintext []byte, additionalData []byte) (sealed string, err error) {
+	k := keyring.keys[0]
+	out := make([]byte, 1+keyIdLength+k.aead.NonceSize(), 1+keyIdLength+k.aead.NonceSize()+len(plaintext)+k.aead.Overhead())
+	out[0] = sealVersion
+	copy(out[1:], k.id[:])
+	nonce := out[1+keyIdLength:]
+	if _, err = rand.Read(nonce); err != nil {
+		err = fmt.Errorf("could not generate nonce: %w", err)
+		return
+	}
+	out = k.aead.Seal(out, nonce, plaintext, additionalData)
+	sealed = base64.RawURLEncoding.EncodeToString(out)
+	return
+}
+
+// Unseal reverses Seal, using the key that sealed the value. An error is returned if
+// the value was sealed with an unknown key, or has been tampered with.
+func (keyring *Keyring) Unseal(sealed string, additionalData []byte) (plaintext []byte, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		err = fmt.Errorf("sealed value is not valid base64: %w", err)
+		return
+	}
+	if len(data) < 1+keyIdLength || data[0] != sealVersion {
+		err = fmt.Errorf("sealed value has unrecognised format")
+		return
+	}
+	for _, k := range keyring.keys {
+		if !bytes.Equal(k.id[:], data[1:1+keyIdLength]) {
+			continue
+		}
+		nonceEnd := 1 + keyIdLength + k.aead.NonceSize()
+		if len(data) < nonceEnd {
+			err = fmt.Errorf("sealed value is truncated")
+			return
+		}
+		plaintext, err = k.aead.Open(nil, data[1+keyIdLength:nonceEnd], data[nonceEnd:], additionalData)
+		if err != nil {
+			err = fmt.Errorf("sealed value failed authentication: %w", err)
+		}
+		return
+	}
+	err = fmt.Errorf("sealed value uses an unknown key")
+	return
+}
+
+//------------------------------------------------------------------------------
+
+// KeyringFile provides the Keyring from a (mounted) file, which is reloaded when
+// the file is modified - to pick up rotated keys
+type KeyringFile struct {
+	mutex     sync.Mutex
+	path      string
+	modTime   time.Time
+	keyring   *Keyring
+	lastCheck time.Time
+}
+
+// Minimum interval between checks for modification of the keyring file
+const keyringCheckInterval = 5 * time.Second
+
+//------------------------------------------------------------------------------
+
+func NewKeyringFile(path string) *KeyringFile {
+	return &KeyringFile{path: path}
+}
+
+func (keyringFile *KeyringFile) GetPath() string {
+	return keyringFile.path
+}
+
+// Keyring returns the current keyring, reloading the file if it has changed.
+// If a reload fails then the previously loaded keyring is returned, along with the error.
+func (keyringFile *KeyringFile) Keyring() (keyring *Keyring, err error) {
+	keyringFile.mutex.Lock()
+	defer keyringFile.mutex.Unlock()
+
+	if keyringFile.keyring != nil && time.Since(keyringFile.lastCheck) < keyringCheckInterval {
+		return keyringFile.keyring, nil
+	}
+	keyringFile.lastCheck = time.Now()
+
+	info, err := os.Stat(keyringFile.path)
+	if err == nil && (keyringFile.keyring == nil || !info.ModTime().Equal(keyringFile.modTime)) {
+		var data []byte
+		if data, err = os.ReadFile(keyringFile.path); err == nil {
+			if keyring, err = ParseKeyring(data); err == nil {
+				keyringFile.keyring = keyring
+				keyringFile.modTime = info.ModTime()
+			}
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("could not load keyring from %v: %w", keyringFile.path, err)
+		if keyringFile.keyring != nil {
+			// Keep using the last good keyring
+			return keyringFile.keyring, err
+		}
+		return nil, err
+	}
+	return keyringFile.keyring, nil
+}
+
+//------------------------------------------------------------------------------
@@ -0,0 +1,14 @@
+package server
+
+import (
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+)
+
+func init() {
+	configChangeHandler()
+	config.AddConfigChangeHandler(configChangeHandler)
+}
+
+func configChangeHandler() {
+	configureTls()
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+//------------------------------------------------------------------------------
+
+// Server serves the http handler, with the configured timeouts - on the TCP port (over TLS
+// if configured) and/or the unix domain socket
+type Server struct {
+	httpServer *http.Server
+	useTls     bool
+	tcpAddr    string
+	socketPath string
+	socketMode fs.FileMode
+}
+
+// unixSocketKey is the context key that marks a connection received on the unix socket
+type unixSocketKey struct{}
+
+// FromUnixSocket reports whether the request was received on the unix domain socket - whose
+// peers are local processes (e.g. nginx), admitted by the permissions of the socket, which
+// have no IP address of their own
+func FromUnixSocket(ctx context.Context) bool {
+	fromUnixSocket, _ := ctx.Value(unixSocketKey{}).(bool)
+	return fromUnixSocket
+}
+
+// markUnixSocket marks the context of the connection if it was received on the unix socket
+func markUnixSocket(ctx context.Context, conn net.Conn) context.Context {
+	if _, ok := conn.(*net.UnixConn); ok {
+		return context.WithValue(ctx, unixSocketKey{}, true)
+	}
+	return ctx
+}
+
+//------------------------------------------------------------------------------
+
+// NewServer creates the server for the handler. The timeouts and listeners are taken from
+// the configuration at the time of creation.
+func NewServer(handler http.Handler) *Server {
+	server := &Server{
+		useTls:     config.IsTlsEnabled(),
+		socketPath: config.GetUnixSocketPath(),
+		httpServer: &http.Server{
+			Handler:           handler,
+			ReadTimeout:       config.GetReadTimeout(),
+			ReadHeaderTimeout: config.GetReadHeaderTimeout(),
+			WriteTimeout:      config.GetWriteTimeout(),
+			IdleTimeout:       config.GetIdleTimeout(),
+			ConnContext:       markUnixSocket,
+		},
+	}
+	if port := config.GetPort(); port > 0 {
+		server.tcpAddr = fmt.Sprintf(":%v", port)
+	}
+	mode, err := strconv.ParseUint(config.GetUnixSocketMode(), 8, 32)
+	if err != nil {
+		logrus.Warnf("Bad unix socket mode '%v', using 0660: %v", config.GetUnixSocketMode(), err)
+		mode = 0660
+	}
+	server.socketMode = fs.FileMode(mode) & fs.ModePerm
+	listenerTls.start(server.useTls)
+	if server.useTls {
+		server.httpServer.TLSConfig = newTlsConfig(listenerTls)
+	}
+	return server
+}
+
+// NewAdminServer creates the server for the admin handler, on the admin port - over TLS if
+// configured. The admin port must not be exposed via nginx. There is no write timeout, to
+// allow for the duration of pprof profiles.
+func NewAdminServer(handler http.Handler) *Server {
+	server := &Server{
+		useTls:  config.IsAdminTlsEnabled(),
+		tcpAddr: fmt.Sprintf(":%v", config.GetAdminListenPort()),
+		httpServer: &http.Server{
+			Handler:           handler,
+			ReadTimeout:       config.GetReadTimeout(),
+			ReadHeaderTimeout: config.GetReadHeaderTimeout(),
+			IdleTimeout:       config.GetIdleTimeout(),
+		},
+	}
+	adminTls.start(server.useTls)
+	if server.useTls {
+		server.httpServer.TLSConfig = newTlsConfig(adminTls)
+	}
+	return server
+}
+
+// Serve accepts connections until the server is shutdown, in which case the returned
+// error is nil. If either listener fails then its error is returned.
+func (server *Server) Serve() (err error) {
+	if len(server.tcpAddr) == 0 && len(server.socketPath) == 0 {
+		return fmt.Errorf("no listener is configured - set network.listenPort and/or network.unixSocket.path")
+	}
+	logrus.Infof("Server timeouts: read-timeout=%v, write-timeout=%v, idle-timeout=%v",
+		server.httpServer.ReadTimeout, server.httpServer.WriteTimeout, server.httpServer.IdleTimeout)
+
+	var listeners []net.Listener
+	if len(server.tcpAddr) > 0 {
+		listener, err := net.Listen("tcp", server.tcpAddr)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Begin listening on %v (tls=%v)", server.tcpAddr, server.useTls)
+		if server.useTls {
+			// The certificate is provided by the TLS config
+			listener = tls.NewListener(listener, server.httpServer.TLSConfig)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(server.socketPath) > 0 {
+		listener, err := server.listenUnixSocket()
+		if err != nil {
+			// Release the listeners that are not served
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		logrus.Infof("Begin listening on unix socket %v (mode=%#o)", server.socketPath, uint32(server.socketMode))
+		listeners = append(listeners, listener)
+	}
+
+	// Serve until the first listener stops
+	serveErr := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			serveErr <- server.httpServer.Serve(listener)
+		}(listener)
+	}
+	err = <-serveErr
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return
+}
+
+// listenUnixSocket listens on the unix domain socket, replacing any stale socket file
+// that was left behind by a previous run. The socket is created in a private (0700)
+// directory, and moved into place once its permissions are set - so that it is never
+// accessible with the permissions given by the umask.
+func (server *Server) listenUnixSocket() (listener net.Listener, err error) {
+	if info, statErr := os.Lstat(server.socketPath); statErr == nil && info.Mode().Type() != fs.ModeSocket {
+		return nil, fmt.Errorf("cannot listen on unix socket %v: file exists and is not a socket", server.socketPath)
+	}
+	privateDir, err := os.MkdirTemp(filepath.Dir(server.socketPath), ".uma-user-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create unix socket %v: %w", server.socketPath, err)
+	}
+	defer os.RemoveAll(privateDir)
+	privatePath := filepath.Join(privateDir, "socket")
+	listener, err = net.Listen("unix", privatePath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is removed by Shutdown, at its final path
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(privatePath, server.socketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not set permissions of unix socket %v: %w", server.socketPath, err)
+	}
+	// Atomically replaces a stale socket
+	if err = os.Rename(privatePath, server.socketPath); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not create unix socket %v: %w", server.socketPath, err)
+	}
+	return
+}
+
+// Shutdown stops accepting connections, and waits for in-flight requests to complete -
+// until the context expires. The unix socket file is removed.
+func (server *Server) Shutdown(ctx context.Context) (err error) {
+	err = server.httpServer.Shutdown(ctx)
+	if len(server.socketPath) > 0 {
+		// Not removed on close of the listener, which was bound at the private path
+		if removeErr := os.Remove(server.socketPath); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			logrus.Warnf("Could not remove unix socket %v: %v", server.socketPath, removeErr)
+		}
+	}
+	return
+}
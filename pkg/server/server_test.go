@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+)
+
+// TestUnixSocket tests that the unix socket is served with its configured permissions,
+// replacing a stale socket, and is removed at shutdown
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uma.sock")
+	// A stale socket left behind by a previous run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	if err := config.ParseFlags("test", []string{"--network.listenPort=0", "--network.tls.enabled=false",
+		"--network.unixSocket.path=" + path, "--network.unixSocket.mode=0600"}); err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--network.listenPort=80", "--network.unixSocket.path=", "--network.unixSocket.mode=0660"})
+	server := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve() }()
+
+	client := http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	var response *http.Response
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if response, err = client.Get("http://unix/"); err == nil {
+			response.Body.Close()
+			break
+		}
+	}
+	if err != nil || response.StatusCode != http.StatusTeapot {
+		t.Fatalf("request over the unix socket failed: %v", err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode().Type() != fs.ModeSocket || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket file: %v %v", info, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected only the socket in its directory: %v", entries)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := <-serveErr; err != nil {
+		t.Errorf("unexpected error at shutdown: %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed at shutdown: %v", err)
+	}
+}
+
+// TestUnixSocketFailure tests that a file that is not a socket is not replaced - and that
+// the TCP listener is released when the unix socket cannot be listened on
+func TestUnixSocketFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	if err := config.ParseFlags("test", []string{"--network.listenPort=" + strconv.Itoa(port), "--network.tls.enabled=false",
+		"--network.unixSocket.path=" + path}); err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--network.listenPort=80", "--network.unixSocket.path="})
+	if err := NewServer(http.NotFoundHandler()).Serve(); err == nil {
+		t.Fatal("expected failure to listen on the unix socket")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Error("file that is not a socket was replaced")
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("TCP listener not released: %v", err)
+	}
+	listener.Close()
+}
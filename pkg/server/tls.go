@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Minimum interval between checks for modification of the certificate files
+const tlsFileCheckInterval = 5 * time.Second
+
+//------------------------------------------------------------------------------
+
+// CertificateFiles provides the certificate from (mounted) files, which are reloaded when
+// modified - to pick up renewed certificates
+type CertificateFiles struct {
+	mutex       sync.Mutex
+	certFile    string
+	keyFile     string
+	modTime     time.Time
+	certificate *tls.Certificate
+	lastCheck   time.Time
+}
+
+func NewCertificateFiles(certFile string, keyFile string) *CertificateFiles {
+	return &CertificateFiles{certFile: certFile, keyFile: keyFile}
+}
+
+// Certificate returns the current certificate, reloading the files if they have changed.
+// If a reload fails then the previously loaded certificate is returned, along with the error.
+func (certificateFiles *CertificateFiles) Certificate() (certificate *tls.Certificate, err error) {
+	certificateFiles.mutex.Lock()
+	defer certificateFiles.mutex.Unlock()
+
+	if certificateFiles.certificate != nil && time.Since(certificateFiles.lastCheck) < tlsFileCheckInterval {
+		return certificateFiles.certificate, nil
+	}
+	certificateFiles.lastCheck = time.Now()
+
+	modTime, err := latestModTime(certificateFiles.certFile, certificateFiles.keyFile)
+	if err == nil && (certificateFiles.certificate == nil || !modTime.Equal(certificateFiles.modTime)) {
+		var loaded tls.Certificate
+		if loaded, err = tls.LoadX509KeyPair(certificateFiles.certFile, certificateFiles.keyFile); err == nil {
+			certificateFiles.certificate = &loaded
+			certificateFiles.modTime = modTime
+			logrus.Infof("Loaded TLS certificate from %v", certificateFiles.certFile)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("could not load TLS certificate from %v: %w", certificateFiles.certFile, err)
+		if certificateFiles.certificate != nil {
+			// Keep using the last good certificate
+			return certificateFiles.certificate, err
+		}
+		return nil, err
+	}
+	return certificateFiles.certificate, nil
+}
+
+//------------------------------------------------------------------------------
+
+// CaBundleFile provides the pool of CA certificates from a (mounted) bundle file, which is
+// reloaded when modified
+type CaBundleFile struct {
+	mutex     sync.Mutex
+	path      string
+	modTime   time.Time
+	pool      *x509.CertPool
+	lastCheck time.Time
+}
+
+func NewCaBundleFile(path string) *CaBundleFile {
+	return &CaBundleFile{path: path}
+}
+
+// Pool returns the current CA pool, reloading the file if it has changed.
+// If a reload fails then the previously loaded pool is returned, along with the error.
+func (caBundleFile *CaBundleFile) Pool() (pool *x509.CertPool, err error) {
+	caBundleFile.mutex.Lock()
+	defer caBundleFile.mutex.Unlock()
+
+	if caBundleFile.pool != nil && time.Since(caBundleFile.lastCheck) < tlsFileCheckInterval {
+		return caBundleFile.pool, nil
+	}
+	caBundleFile.lastCheck = time.Now()
+
+	modTime, err := latestModTime(caBundleFile.path)
+	if err == nil && (caBundleFile.pool == nil || !modTime.Equal(caBundleFile.modTime)) {
+		var data []byte
+		if data, err = os.ReadFile(caBundleFile.path); err == nil {
+			loaded := x509.NewCertPool()
+			if loaded.AppendCertsFromPEM(data) {
+				caBundleFile.pool = loaded
+				caBundleFile.modTime = modTime
+				logrus.Infof("Loaded client CA bundle from %v", caBundleFile.path)
+			} else {
+				err = fmt.Errorf("no PEM certificates found")
+			}
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("could not load CA bundle from %v: %w", caBundleFile.path, err)
+		if caBundleFile.pool != nil {
+			// Keep using the last good pool
+			return caBundleFile.pool, err
+		}
+		return nil, err
+	}
+	return caBundleFile.pool, nil
+}
+
+//------------------------------------------------------------------------------
+
+// latestModTime returns the latest modification time of the files
+func latestModTime(paths ...string) (modTime time.Time, err error) {
+	for _, path := range paths {
+		info, statErr := os.Stat(path)
+		if statErr != nil {
+			return modTime, statErr
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// TLS configuration of the listeners
+//------------------------------------------------------------------------------
+
+// tlsState is the TLS configuration of a listener, which is updated by the config change
+// handler - so that changes apply to new connections without restart
+type tlsState struct {
+	rwMutex     sync.RWMutex
+	certificate *CertificateFiles
+	clientCas   *CaBundleFile
+	clientAuth  tls.ClientAuthType
+	minVersion  uint16
+	signature   string
+	started     bool
+	enabled     bool
+}
+
+// listenerTls is the TLS configuration of the main listener
+var listenerTls = &tlsState{}
+
+// adminTls is the TLS configuration of the admin listener, which shares the certificate of
+// the main listener - but with its own client CA bundle
+var adminTls = &tlsState{}
+
+// configureTls applies the TLS configuration of the listeners
+func configureTls() {
+	certFile, keyFile, caFile := config.GetTlsCertFile(), config.GetTlsKeyFile(), config.GetTlsClientCaFile()
+	clientAuth, err := parseClientAuth(config.GetTlsClientAuth(), len(caFile) > 0)
+	if err != nil {
+		logrus.Warn(fmt.Sprintf("Bad TLS client auth: %v, using default", err))
+		clientAuth, _ = parseClientAuth("", len(caFile) > 0)
+	}
+	minVersion, err := parseTlsVersion(config.GetTlsMinVersion())
+	if err != nil {
+		logrus.Warn(fmt.Sprintf("Bad TLS minimum version: %v, using TLS 1.2", err))
+		minVersion = tls.VersionTLS12
+	}
+	listenerTls.configure(certFile, keyFile, caFile, clientAuth, minVersion)
+	listenerTls.checkEnabled("network.tls.enabled", config.IsTlsEnabled())
+
+	adminCaFile := config.GetAdminTlsClientCaFile()
+	adminClientAuth, _ := parseClientAuth("", len(adminCaFile) > 0)
+	adminTls.configure(certFile, keyFile, adminCaFile, adminClientAuth, minVersion)
+	adminTls.checkEnabled("admin.tls.enabled", config.IsAdminTlsEnabled())
+}
+
+// start records whether the listener was created with TLS - which is fixed for the life
+// of the listener
+func (state *tlsState) start(enabled bool) {
+	state.rwMutex.Lock()
+	defer state.rwMutex.Unlock()
+	state.started = true
+	state.enabled = enabled
+}
+
+// checkEnabled warns if the configuration no longer matches whether the listener serves
+// TLS, since this is only applied at startup
+func (state *tlsState) checkEnabled(key string, enabled bool) {
+	state.rwMutex.RLock()
+	defer state.rwMutex.RUnlock()
+	if state.started && enabled != state.enabled {
+		logrus.Warnf("Change of %v to %v requires a restart - continuing with %v", key, enabled, state.enabled)
+	}
+}
+
+// configure applies the settings, replacing the file loaders if their paths change
+func (state *tlsState) configure(certFile string, keyFile string, caFile string, clientAuth tls.ClientAuthType, minVersion uint16) {
+	state.rwMutex.Lock()
+	defer state.rwMutex.Unlock()
+	signature := strings.Join([]string{certFile, keyFile, caFile}, "|")
+	if signature != state.signature {
+		state.certificate = NewCertificateFiles(certFile, keyFile)
+		state.clientCas = nil
+		if len(caFile) > 0 {
+			state.clientCas = NewCaBundleFile(caFile)
+		}
+		state.signature = signature
+	}
+	state.clientAuth = clientAuth
+	state.minVersion = minVersion
+}
+
+// parseClientAuth interprets the client certificate policy. With a CA bundle the default is
+// to require a verified client certificate.
+func parseClientAuth(value string, haveCas bool) (tls.ClientAuthType, error) {
+	switch strings.ToLower(value) {
+	case "":
+		if haveCas {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case "none":
+		return tls.NoClientCert, nil
+	case "verifyifgiven":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth '%v' - expected none, verifyIfGiven or require", value)
+	}
+}
+
+func parseTlsVersion(value string) (uint16, error) {
+	switch value {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version '%v' - expected 1.2 or 1.3", value)
+	}
+}
+
+// newTlsConfig returns the listener's TLS configuration, which defers to the current
+// state for each new connection
+func newTlsConfig(state *tlsState) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			state.rwMutex.RLock()
+			certificateFiles, caBundleFile := state.certificate, state.clientCas
+			tlsConfig := &tls.Config{
+				MinVersion: state.minVersion,
+				ClientAuth: state.clientAuth,
+			}
+			state.rwMutex.RUnlock()
+
+			certificate, err := certificateFiles.Certificate()
+			if err != nil {
+				logrus.Error(err)
+				if certificate == nil {
+					return nil, err
+				}
+			}
+			tlsConfig.Certificates = []tls.Certificate{*certificate}
+			if tlsConfig.ClientAuth != tls.NoClientCert {
+				if caBundleFile == nil {
+					return nil, fmt.Errorf("client certificate verification requires a CA bundle")
+				}
+				pool, err := caBundleFile.Pool()
+				if err != nil {
+					logrus.Error(err)
+					if pool == nil {
+						return nil, err
+					}
+				}
+				tlsConfig.ClientCAs = pool
+			}
+			return tlsConfig, nil
+		},
+	}
+}
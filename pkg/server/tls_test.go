@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key for the common name,
+// with the given modification time
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	if len(keyFile) > 0 {
+		writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), modTime)
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, der []byte) string {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+// TestCertificateFilesReload tests that a renewed certificate is loaded, and that the last
+// good certificate is kept if a reload fails
+func TestCertificateFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	modTime := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "first", modTime)
+
+	certificateFiles := NewCertificateFiles(certFile, keyFile)
+	certificate, err := certificateFiles.Certificate()
+	if err != nil || commonName(t, certificate.Certificate[0]) != "first" {
+		t.Fatalf("unexpected certificate: %v", err)
+	}
+
+	// Within the check interval the files are not checked
+	writeCertificate(t, certFile, keyFile, "second", modTime.Add(time.Second))
+	if certificate, _ = certificateFiles.Certificate(); commonName(t, certificate.Certificate[0]) != "first" {
+		t.Error("certificate reloaded within the check interval")
+	}
+
+	// After the check interval the renewed certificate is loaded
+	certificateFiles.lastCheck = time.Time{}
+	certificate, err = certificateFiles.Certificate()
+	if err != nil || commonName(t, certificate.Certificate[0]) != "second" {
+		t.Errorf("renewed certificate not loaded: %v", err)
+	}
+
+	// A bad key keeps the last good certificate
+	writeFile(t, keyFile, []byte("not a key"), modTime.Add(2*time.Second))
+	certificateFiles.lastCheck = time.Time{}
+	certificate, err = certificateFiles.Certificate()
+	if err == nil {
+		t.Error("expected an error for a bad key")
+	}
+	if certificate == nil || commonName(t, certificate.Certificate[0]) != "second" {
+		t.Error("last good certificate not kept")
+	}
+
+	// Missing files without a previous certificate are an error
+	if certificate, err = NewCertificateFiles(filepath.Join(dir, "missing.crt"), keyFile).Certificate(); err == nil || certificate != nil {
+		t.Error("expected an error for missing files")
+	}
+}
+
+// TestCaBundleFileReload tests that a changed CA bundle is loaded, and that the last good
+// pool is kept if a reload fails
+func TestCaBundleFileReload(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	modTime := time.Now().Add(-time.Minute)
+	writeCertificate(t, caFile, "", "first-ca", modTime)
+
+	caBundleFile := NewCaBundleFile(caFile)
+	pool, err := caBundleFile.Pool()
+	if err != nil || !poolContains(pool, "first-ca") {
+		t.Fatalf("unexpected pool: %v", err)
+	}
+
+	writeCertificate(t, caFile, "", "second-ca", modTime.Add(time.Second))
+	caBundleFile.lastCheck = time.Time{}
+	pool, err = caBundleFile.Pool()
+	if err != nil || !poolContains(pool, "second-ca") || poolContains(pool, "first-ca") {
+		t.Errorf("changed CA bundle not loaded: %v", err)
+	}
+
+	// A bundle without certificates keeps the last good pool
+	writeFile(t, caFile, []byte("no certificates"), modTime.Add(2*time.Second))
+	caBundleFile.lastCheck = time.Time{}
+	pool, err = caBundleFile.Pool()
+	if err == nil {
+		t.Error("expected an error for a bundle without certificates")
+	}
+	if pool == nil || !poolContains(pool, "second-ca") {
+		t.Error("last good pool not kept")
+	}
+}
+
+func poolContains(pool *x509.CertPool, commonName string) bool {
+	for _, subject := range pool.Subjects() {
+		var name pkix.RDNSequence
+		if _, err := asn1.Unmarshal(subject, &name); err == nil {
+			var parsed pkix.Name
+			parsed.FillFromRDNSequence(&name)
+			if parsed.CommonName == commonName {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// FileStore keeps each session as a json file in a directory - suitable for a
+// single replica whose sessions should survive a restart. Files are named by the
+// hash of the session ID, so that the IDs are not exposed on disk.
+type FileStore struct {
+	mutex       sync.Mutex
+	updateMutex sync.Mutex
+	dir         string
+	lastPurge   time.Time
+}
+
+const sessionFileExt = ".json"
+
+//------------------------------------------------------------------------------
+
+func NewFileStore(dir string) (store *FileStore, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		err = fmt.Errorf("could not create session directory %v: %w", dir, err)
+		return
+	}
+	store = &FileStore{dir: dir}
+	return
+}
+
+func (store *FileStore) path(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return filepath.Join(store.dir, hex.EncodeToString(hash[:])+sessionFileExt)
+}
+
+func (store *FileStore) Load(id string) (session Session, ok bool, err error) {
+	return store.load(store.path(id))
+}
+
+// load reads the session from its file
+func (store *FileStore) load(path string) (session Session, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &session); err != nil {
+		err = fmt.Errorf("could not interpret session file: %w", err)
+		return
+	}
+	ok = !session.IsExpired()
+	if !ok {
+		session = Session{}
+	}
+	return
+}
+
+func (store *FileStore) Save(id string, session Session) (err error) {
+	if err = store.save(store.path(id), session); err == nil {
+		store.purgeExpired()
+	}
+	return
+}
+
+// save writes the session to its file
+func (store *FileStore) save(path string, session Session) (err error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+
+	// Write-then-rename so that readers never see a partial file
+	tmp, err := os.CreateTemp(store.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("could not create session file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write session file: %w", err)
+	}
+	return
+}
+
+// UpdateRpt loads, updates and saves the session while excluding other updates - the
+// file store serves a single replica, so this is sufficient for atomicity
+func (store *FileStore) UpdateRpt(id string, rpt Rpt, pct string) (ok bool, err error) {
+	store.updateMutex.Lock()
+	defer store.updateMutex.Unlock()
+	session, ok, err := store.Load(id)
+	if err != nil || !ok {
+		return
+	}
+	session.updateRpt(rpt, pct)
+	err = store.Save(id, session)
+	return
+}
+
+func (store *FileStore) Delete(id string) error {
+	// Excluding updates, which would otherwise re-create the deleted session
+	store.updateMutex.Lock()
+	defer store.updateMutex.Unlock()
+	err := os.Remove(store.path(id))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+func (store *FileStore) Range(f func(session Session)) error {
+	paths, err := store.paths()
+	for _, path := range paths {
+		if session, ok, err := store.load(path); err == nil && ok {
+			f(session)
+		}
+	}
+	return err
+}
+
+func (store *FileStore) ClearRpts(match func(session Session) bool) (count int, err error) {
+	store.updateMutex.Lock()
+	defer store.updateMutex.Unlock()
+	paths, err := store.paths()
+	for _, path := range paths {
+		session, ok, loadErr := store.load(path)
+		if loadErr != nil || !ok {
+			continue
+		}
+		if cleared := session.clearRpts(match); cleared > 0 {
+			if err = store.save(path, session); err != nil {
+				return
+			}
+			count += cleared
+		}
+	}
+	return
+}
+
+// paths returns the paths of the session files
+func (store *FileStore) paths() (paths []string, err error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		err = fmt.Errorf("could not list session directory %v: %w", store.dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), sessionFileExt) {
+			paths = append(paths, filepath.Join(store.dir, entry.Name()))
+		}
+	}
+	return
+}
+
+func (store *FileStore) Close() error {
+	return nil
+}
+
+// purgeExpired opportunistically removes the files of expired sessions
+func (store *FileStore) purgeExpired() {
+	store.mutex.Lock()
+	if time.Since(store.lastPurge) < purgeInterval {
+		store.mutex.Unlock()
+		return
+	}
+	store.lastPurge = time.Now()
+	store.mutex.Unlock()
+
+	paths, _ := store.paths()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var session Session
+		if json.Unmarshal(data, &session) != nil || session.IsExpired() {
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// MemoryStore keeps sessions in memory - suitable for a single replica
+type MemoryStore struct {
+	rwMutex   sync.RWMutex
+	sessions  map[string]Session
+	lastPurge time.Time
+}
+
+//------------------------------------------------------------------------------
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]Session)}
+}
+
+func (store *MemoryStore) Load(id string) (session Session, ok bool, err error) {
+	store.rwMutex.RLock()
+	defer store.rwMutex.RUnlock()
+	session, ok = store.sessions[id]
+	if ok && session.IsExpired() {
+		session, ok = Session{}, false
+	}
+	return
+}
+
+func (store *MemoryStore) Save(id string, session Session) error {
+	store.rwMutex.Lock()
+	defer store.rwMutex.Unlock()
+	store.sessions[id] = session
+
+	// Opportunistically remove expired sessions
+	if time.Since(store.lastPurge) > purgeInterval {
+		store.lastPurge = time.Now()
+		for id, s := range store.sessions {
+			if s.IsExpired() {
+				delete(store.sessions, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) UpdateRpt(id string, rpt Rpt, pct string) (ok bool, err error) {
+	store.rwMutex.Lock()
+	defer store.rwMutex.Unlock()
+	session, ok := store.sessions[id]
+	if !ok || session.IsExpired() {
+		return false, nil
+	}
+	session.updateRpt(rpt, pct)
+	store.sessions[id] = session
+	return
+}
+
+func (store *MemoryStore) Delete(id string) error {
+	store.rwMutex.Lock()
+	defer store.rwMutex.Unlock()
+	delete(store.sessions, id)
+	return nil
+}
+
+func (store *MemoryStore) Range(f func(session Session)) error {
+	store.rwMutex.RLock()
+	sessions := make([]Session, 0, len(store.sessions))
+	for _, session := range store.sessions {
+		if !session.IsExpired() {
+			sessions = append(sessions, session)
+		}
+	}
+	store.rwMutex.RUnlock()
+	for _, session := range sessions {
+		f(session)
+	}
+	return nil
+}
+
+func (store *MemoryStore) ClearRpts(match func(session Session) bool) (count int, err error) {
+	store.rwMutex.Lock()
+	defer store.rwMutex.Unlock()
+	for id, session := range store.sessions {
+		if session.IsExpired() {
+			continue
+		}
+		if cleared := session.clearRpts(match); cleared > 0 {
+			store.sessions[id] = session
+			count += cleared
+		}
+	}
+	return
+}
+
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// Len returns the number of sessions in the store
+func (store *MemoryStore) Len() int {
+	store.rwMutex.RLock()
+	defer store.rwMutex.RUnlock()
+	return len(store.sessions)
+}
+
+// Interval at which expired sessions are purged from the store
+const purgeInterval = time.Minute
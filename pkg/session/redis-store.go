@@ -0,0 +1,410 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// RedisOptions configures the connection to a server that speaks the Redis protocol (RESP)
+type RedisOptions struct {
+	Address   string
+	Password  string
+	Database  int
+	KeyPrefix string
+	Timeout   time.Duration
+	PoolSize  int
+}
+
+// RedisStore keeps sessions in a Redis (or protocol-compatible) server - suitable for
+// multiple replicas that share sessions. Sessions expire via the key TTL.
+type RedisStore struct {
+	options RedisOptions
+	pool    chan *redisConn
+}
+
+// errRedisNil is the 'nil' reply, i.e. key not found
+var errRedisNil = errors.New("redis: nil")
+
+//------------------------------------------------------------------------------
+
+func NewRedisStore(options RedisOptions) *RedisStore {
+	if options.PoolSize <= 0 {
+		options.PoolSize = 10
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	return &RedisStore{options: options, pool: make(chan *redisConn, options.PoolSize)}
+}
+
+func (store *RedisStore) Load(id string) (session Session, ok bool, err error) {
+	reply, err := store.do("GET", store.options.KeyPrefix+id)
+	if err == errRedisNil {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	return decodeSession(reply)
+}
+
+// decodeSession interprets the reply to GET as a session, which is not ok if expired
+func decodeSession(reply interface{}) (session Session, ok bool, err error) {
+	data, isString := reply.(string)
+	if !isString {
+		err = fmt.Errorf("unexpected redis reply type for GET")
+		return
+	}
+	if err = json.Unmarshal([]byte(data), &session); err != nil {
+		err = fmt.Errorf("could not interpret session data: %w", err)
+		return
+	}
+	ok = !session.IsExpired()
+	if !ok {
+		session = Session{}
+	}
+	return
+}
+
+func (store *RedisStore) Save(id string, session Session) (err error) {
+	ttl := time.Until(session.Expiry).Milliseconds()
+	if ttl <= 0 {
+		return store.Delete(id)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+	_, err = store.do("SET", store.options.KeyPrefix+id, string(data), "PX", strconv.FormatInt(ttl, 10))
+	return
+}
+
+// Number of attempts of an update that conflicts with concurrent updates of the session,
+// and the backoff between attempts - which is randomised to spread the contenders
+const maxUpdateAttempts = 10
+const updateBackoff = 5 * time.Millisecond
+
+func (store *RedisStore) UpdateRpt(id string, rpt Rpt, pct string) (ok bool, err error) {
+	return store.update(store.options.KeyPrefix+id, func(session *Session) bool {
+		session.updateRpt(rpt, pct)
+		return true
+	})
+}
+
+// update applies the change to the session of the key with optimistic locking
+// (WATCH/MULTI/EXEC) - so that the update is atomic across all replicas that share the
+// server. An update that conflicts with a concurrent update is retried. The change reports
+// whether it modified the session, which is otherwise not written.
+func (store *RedisStore) update(key string, change func(session *Session) bool) (ok bool, err error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(updateBackoff) * int64(attempt))))
+		}
+		var conflict bool
+		if ok, conflict, err = store.updateOnce(key, change); err != nil || !conflict {
+			return
+		}
+	}
+	err = fmt.Errorf("session update abandoned after %d conflicting attempts", maxUpdateAttempts)
+	return
+}
+
+// updateOnce makes a single attempt at the update, as a transaction on one connection that
+// is aborted (conflict) if the session is modified concurrently
+func (store *RedisStore) updateOnce(key string, change func(session *Session) bool) (ok bool, conflict bool, err error) {
+	conn, err := store.getConn()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			// The connection may be left within the transaction
+			conn.Close()
+			return
+		}
+		store.putConn(conn)
+	}()
+	timeout := store.options.Timeout
+
+	if _, err = conn.do(timeout, "WATCH", key); err != nil {
+		return
+	}
+	reply, err := conn.do(timeout, "GET", key)
+	if err == errRedisNil {
+		_, err = conn.do(timeout, "UNWATCH")
+		return
+	}
+	if err != nil {
+		return
+	}
+	session, ok, err := decodeSession(reply)
+	ttl := time.Until(session.Expiry).Milliseconds()
+	if err != nil || !ok || ttl <= 0 {
+		ok = false
+		if err == nil {
+			_, err = conn.do(timeout, "UNWATCH")
+		}
+		return
+	}
+	if !change(&session) {
+		_, err = conn.do(timeout, "UNWATCH")
+		return
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+
+	if _, err = conn.do(timeout, "MULTI"); err != nil {
+		return
+	}
+	if _, err = conn.do(timeout, "SET", key, string(data), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		return
+	}
+	// A nil reply indicates that the transaction was aborted
+	if _, err = conn.do(timeout, "EXEC"); err == errRedisNil {
+		ok, conflict, err = false, true, nil
+	}
+	return
+}
+
+func (store *RedisStore) Delete(id string) (err error) {
+	_, err = store.do("DEL", store.options.KeyPrefix+id)
+	return
+}
+
+func (store *RedisStore) Range(f func(session Session)) error {
+	keys, err := store.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		reply, err := store.do("GET", key)
+		if err == errRedisNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if session, ok, err := decodeSession(reply); err == nil && ok {
+			f(session)
+		}
+	}
+	return nil
+}
+
+func (store *RedisStore) ClearRpts(match func(session Session) bool) (count int, err error) {
+	keys, err := store.keys()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		cleared := 0
+		if _, err = store.update(key, func(session *Session) bool {
+			cleared = session.clearRpts(match)
+			return cleared > 0
+		}); err != nil {
+			return
+		}
+		count += cleared
+	}
+	return
+}
+
+// keys returns the keys of the sessions, by incremental iteration (SCAN) so that the
+// server is not blocked
+func (store *RedisStore) keys() (keys []string, err error) {
+	pattern := redisGlobEscaper.Replace(store.options.KeyPrefix) + "*"
+	cursor := "0"
+	for {
+		var reply interface{}
+		if reply, err = store.do("SCAN", cursor, "MATCH", pattern, "COUNT", "100"); err != nil {
+			return
+		}
+		items, isArray := reply.([]interface{})
+		if !isArray || len(items) != 2 {
+			err = fmt.Errorf("unexpected redis reply for SCAN")
+			return
+		}
+		batch, _ := items[1].([]interface{})
+		for _, key := range batch {
+			if key, isString := key.(string); isString {
+				keys = append(keys, key)
+			}
+		}
+		if cursor, _ = items[0].(string); len(cursor) == 0 || cursor == "0" {
+			return
+		}
+	}
+}
+
+// redisGlobEscaper escapes the special characters of a redis glob pattern
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (store *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-store.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do executes the command on a pooled connection
+func (store *RedisStore) do(args ...string) (reply interface{}, err error) {
+	conn, err := store.getConn()
+	if err != nil {
+		return
+	}
+	reply, err = conn.do(store.options.Timeout, args...)
+	if err != nil && err != errRedisNil && !isRedisError(err) {
+		// The connection is in an unknown state
+		conn.Close()
+		return
+	}
+	store.putConn(conn)
+	return
+}
+
+func (store *RedisStore) getConn() (conn *redisConn, err error) {
+	select {
+	case conn = <-store.pool:
+		return
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", store.options.Address, store.options.Timeout)
+	if err != nil {
+		err = fmt.Errorf("could not connect to redis at %v: %w", store.options.Address, err)
+		return
+	}
+	conn = &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if len(store.options.Password) > 0 {
+		if _, err = conn.do(store.options.Timeout, "AUTH", store.options.Password); err != nil {
+			conn.Close()
+			err = fmt.Errorf("redis authentication failed: %w", err)
+			return
+		}
+	}
+	if store.options.Database != 0 {
+		if _, err = conn.do(store.options.Timeout, "SELECT", strconv.Itoa(store.options.Database)); err != nil {
+			conn.Close()
+			err = fmt.Errorf("redis database selection failed: %w", err)
+			return
+		}
+	}
+	return
+}
+
+func (store *RedisStore) putConn(conn *redisConn) {
+	select {
+	case store.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+//------------------------------------------------------------------------------
+// redisConn
+// Minimal implementation of the RESP protocol - sufficient for the commands used
+//------------------------------------------------------------------------------
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func isRedisError(err error) bool {
+	_, ok := err.(redisError)
+	return ok
+}
+
+// do writes the command and reads its reply
+func (conn *redisConn) do(timeout time.Duration, args ...string) (reply interface{}, err error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err = io.WriteString(conn, sb.String()); err != nil {
+		return
+	}
+	return conn.readReply()
+}
+
+func (conn *redisConn) readReply() (reply interface{}, err error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		err = fmt.Errorf("redis: empty reply")
+		return
+	}
+
+	switch line[0] {
+	case '+':
+		reply = line[1:]
+	case '-':
+		err = redisError(line[1:])
+	case ':':
+		reply, err = strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		var length int
+		if length, err = strconv.Atoi(line[1:]); err != nil {
+			return
+		}
+		if length < 0 {
+			err = errRedisNil
+			return
+		}
+		buf := make([]byte, length+2)
+		if _, err = io.ReadFull(conn.reader, buf); err != nil {
+			return
+		}
+		reply = string(buf[:length])
+	case '*':
+		var count int
+		if count, err = strconv.Atoi(line[1:]); err != nil {
+			return
+		}
+		if count < 0 {
+			err = errRedisNil
+			return
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = conn.readReply(); err != nil && err != errRedisNil {
+				return
+			}
+			err = nil
+		}
+		reply = items
+	default:
+		err = fmt.Errorf("redis: unexpected reply '%v'", line)
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// Session is the server-side state of a user session, referenced by the opaque
+// session ID that is held in the client's cookie
+type Session struct {
+	IdToken      string         `json:"idToken"`
+	RefreshToken string         `json:"refreshToken,omitempty"`
+	Rpts         map[string]Rpt `json:"rpts,omitempty"`
+	Pct          string         `json:"pct,omitempty"`
+	Expiry       time.Time      `json:"expiry"`
+}
+
+// Rpt is an RPT held in the session, with the Authorization Server that issued it and the
+// resource (path prefix) for which it was issued
+type Rpt struct {
+	Value      string    `json:"value"`
+	AuthServer string    `json:"authServer"`
+	Resource   string    `json:"resource"`
+	Updated    time.Time `json:"updated"`
+}
+
+// MaxRpts is the maximum number of RPTs held in a session - beyond which the least recently
+// updated are dropped
+const MaxRpts = 32
+
+// Key returns the key by which the RPT is held in the session - so that the RPTs of
+// different resources, and of different Authorization Servers, do not replace each other
+func (rpt *Rpt) Key() string {
+	return rpt.AuthServer + " " + rpt.Resource
+}
+
+// IsExpired reports whether the session has passed its expiry time
+func (session *Session) IsExpired() bool {
+	return time.Now().After(session.Expiry)
+}
+
+// SetRpt records the RPT, replacing any previous RPT for the same resource of the same
+// Authorization Server. The map of RPTs is replaced rather than modified, since it may be
+// shared with other copies of the session.
+func (session *Session) SetRpt(rpt Rpt) {
+	rpts := make(map[string]Rpt, len(session.Rpts)+1)
+	for key, value := range session.Rpts {
+		rpts[key] = value
+	}
+	rpts[rpt.Key()] = rpt
+	for len(rpts) > MaxRpts {
+		oldest := ""
+		for key, value := range rpts {
+			if len(oldest) == 0 || value.Updated.Before(rpts[oldest].Updated) {
+				oldest = key
+			}
+		}
+		delete(rpts, oldest)
+	}
+	session.Rpts = rpts
+}
+
+// GetRpt returns the most recently updated RPT for the resource.
+// The ok result indicates whether an RPT was found.
+func (session *Session) GetRpt(resource string) (rpt Rpt, ok bool) {
+	for _, value := range session.Rpts {
+		if value.Resource == resource && (!ok || value.Updated.After(rpt.Updated)) {
+			rpt, ok = value, true
+		}
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+
+// Store is the interface to the persistence of sessions
+type Store interface {
+	// Load returns the unexpired session for the ID.
+	// The ok result indicates whether the session was found.
+	Load(id string) (session Session, ok bool, err error)
+	// Save stores the session for the ID, until the session expiry
+	Save(id string, session Session) error
+	// UpdateRpt records the RPT - and the PCT, if not blank - in the unexpired session for
+	// the ID. The update is atomic, so that concurrent updates of the session are not lost.
+	// The ok result indicates whether the session was found.
+	UpdateRpt(id string, rpt Rpt, pct string) (ok bool, err error)
+	// Delete removes the session for the ID
+	Delete(id string) error
+	// Range calls f for each unexpired session
+	Range(f func(session Session)) error
+	// ClearRpts removes the RPTs from each unexpired session for which match is true - the
+	// update of each session being atomic. The number of RPTs removed is returned.
+	ClearRpts(match func(session Session) bool) (count int, err error)
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// updateRpt applies the update of UpdateRpt to the session
+func (session *Session) updateRpt(rpt Rpt, pct string) {
+	session.SetRpt(rpt)
+	if len(pct) > 0 {
+		session.Pct = pct
+	}
+}
+
+// clearRpts applies the update of ClearRpts to the session, returning the number of RPTs
+// removed - zero if the session does not match
+func (session *Session) clearRpts(match func(session Session) bool) (count int) {
+	if len(session.Rpts) > 0 && match(*session) {
+		count = len(session.Rpts)
+		session.Rpts = nil
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+
+// NewSessionId returns a new random session ID
+func NewSessionId() (id string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		err = fmt.Errorf("could not generate session ID: %w", err)
+		return
+	}
+	id = base64.RawURLEncoding.EncodeToString(buf)
+	return
+}
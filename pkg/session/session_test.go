@@ -0,0 +1,339 @@
+package session_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/session"
+)
+
+// testStore exercises the Store interface for the supplied implementation
+func testStore(t *testing.T, store session.Store) {
+	defer store.Close()
+
+	id, err := session.NewSessionId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not found
+	if _, ok, err := store.Load(id); ok || err != nil {
+		t.Errorf("expected no session, got ok=%v err=%v", ok, err)
+	}
+
+	// Save and load
+	s := session.Session{IdToken: "id-token", RefreshToken: "refresh-token", Expiry: time.Now().Add(time.Hour)}
+	s.SetRpt(session.Rpt{Value: "rpt-value", AuthServer: "https://as", Resource: "/ades", Updated: time.Now()})
+	if err := store.Save(id, s); err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok, err := store.Load(id)
+	if !ok || err != nil {
+		t.Fatalf("expected session, got ok=%v err=%v", ok, err)
+	}
+	if loaded.IdToken != s.IdToken || loaded.RefreshToken != s.RefreshToken || loaded.Rpts["https://as /ades"].Value != "rpt-value" {
+		t.Errorf("unexpected session loaded: %+v", loaded)
+	}
+
+	// Concurrent updates of the RPTs of different resources are all kept
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rpt := session.Rpt{Value: fmt.Sprintf("rpt-%d", i), AuthServer: "https://as", Resource: fmt.Sprintf("/service-%d", i), Updated: time.Now()}
+			if ok, err := store.UpdateRpt(id, rpt, "pct"); !ok || err != nil {
+				t.Errorf("update %d failed: ok=%v err=%v", i, ok, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	loaded, _, _ = store.Load(id)
+	for i := 0; i < 10; i++ {
+		if rpt, ok := loaded.GetRpt(fmt.Sprintf("/service-%d", i)); !ok || rpt.Value != fmt.Sprintf("rpt-%d", i) {
+			t.Errorf("lost concurrent update %d: %+v", i, loaded.Rpts)
+		}
+	}
+	if loaded.Pct != "pct" || loaded.IdToken != s.IdToken {
+		t.Errorf("unexpected session after updates: %+v", loaded)
+	}
+
+	// Sessions are listed, and their RPTs cleared selectively
+	otherId, _ := session.NewSessionId()
+	other := session.Session{IdToken: "other-token", Expiry: time.Now().Add(time.Hour)}
+	other.SetRpt(session.Rpt{Value: "other-rpt", AuthServer: "https://as", Resource: "/ades", Updated: time.Now()})
+	store.Save(otherId, other)
+	listed := map[string]int{}
+	if err := store.Range(func(s session.Session) { listed[s.IdToken] = len(s.Rpts) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed["id-token"] != 11 || listed["other-token"] != 1 {
+		t.Errorf("unexpected sessions listed: %v", listed)
+	}
+	count, err := store.ClearRpts(func(s session.Session) bool { return s.IdToken == "id-token" })
+	if count != 11 || err != nil {
+		t.Errorf("expected 11 RPTs cleared, got %d: %v", count, err)
+	}
+	loaded, _, _ = store.Load(id)
+	if len(loaded.Rpts) > 0 || loaded.Pct != "pct" {
+		t.Errorf("unexpected session after clearing its RPTs: %+v", loaded)
+	}
+	if loaded, _, _ = store.Load(otherId); len(loaded.Rpts) != 1 {
+		t.Errorf("RPTs of another session cleared: %+v", loaded)
+	}
+	store.Delete(otherId)
+
+	// Expired sessions are not returned
+	expiredId, _ := session.NewSessionId()
+	store.Save(expiredId, session.Session{IdToken: "old", Expiry: time.Now().Add(-time.Second)})
+	if _, ok, _ := store.Load(expiredId); ok {
+		t.Error("expected expired session to be absent")
+	}
+
+	// Delete
+	if err := store.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Load(id); ok {
+		t.Error("expected deleted session to be absent")
+	}
+
+	// A deleted session is not re-created by an update
+	if ok, err := store.UpdateRpt(id, session.Rpt{Value: "late"}, ""); ok || err != nil {
+		t.Errorf("expected no update of a deleted session, got ok=%v err=%v", ok, err)
+	}
+	if _, ok, _ := store.Load(id); ok {
+		t.Error("expected deleted session to remain absent")
+	}
+}
+
+// TestSessionRpts tests that the RPTs are held by Authorization Server and resource, the
+// latest being returned for a resource - and that the number held is bounded
+func TestSessionRpts(t *testing.T) {
+	s := session.Session{}
+	start := time.Now()
+	s.SetRpt(session.Rpt{Value: "a1", AuthServer: "https://as-a", Resource: "/ades", Updated: start})
+	s.SetRpt(session.Rpt{Value: "b1", AuthServer: "https://as-b", Resource: "/ades", Updated: start.Add(time.Second)})
+	s.SetRpt(session.Rpt{Value: "a2", AuthServer: "https://as-a", Resource: "/catalogue", Updated: start})
+	if len(s.Rpts) != 3 {
+		t.Fatalf("expected 3 RPTs: %+v", s.Rpts)
+	}
+	if rpt, ok := s.GetRpt("/ades"); !ok || rpt.Value != "b1" {
+		t.Errorf("expected the latest RPT for the resource: %+v", rpt)
+	}
+	if _, ok := s.GetRpt("/other"); ok {
+		t.Error("expected no RPT for another resource")
+	}
+
+	// Copies of the session are not affected by an update
+	shared := s
+	s.SetRpt(session.Rpt{Value: "a3", AuthServer: "https://as-a", Resource: "/ades", Updated: start.Add(2 * time.Second)})
+	if rpt, _ := shared.GetRpt("/ades"); rpt.Value != "b1" {
+		t.Errorf("update leaked into a copy of the session: %+v", rpt)
+	}
+
+	// The least recently updated are dropped
+	for i := 0; i < session.MaxRpts; i++ {
+		s.SetRpt(session.Rpt{Value: "x", AuthServer: "https://as-a", Resource: fmt.Sprintf("/r%d", i), Updated: start.Add(time.Hour)})
+	}
+	if len(s.Rpts) != session.MaxRpts {
+		t.Errorf("expected %d RPTs, got %d", session.MaxRpts, len(s.Rpts))
+	}
+	if _, ok := s.GetRpt("/catalogue"); ok {
+		t.Error("expected the least recently updated RPT to be dropped")
+	}
+}
+
+// TestMemoryStore tests the in-memory session store
+func TestMemoryStore(t *testing.T) {
+	testStore(t, session.NewMemoryStore())
+}
+
+// TestFileStore tests the file-backed session store
+func TestFileStore(t *testing.T) {
+	store, err := session.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
+
+// TestRedisStore tests the redis session store against a local stand-in server
+func TestRedisStore(t *testing.T) {
+	address := startFakeRedis(t, "secret")
+	testStore(t, session.NewRedisStore(session.RedisOptions{Address: address, Password: "secret", Database: 2, KeyPrefix: "test:"}))
+
+	// Bad password
+	store := session.NewRedisStore(session.RedisOptions{Address: address, Password: "wrong"})
+	if _, _, err := store.Load("any"); err == nil {
+		t.Error("expected authentication failure")
+	}
+}
+
+//------------------------------------------------------------------------------
+// Fake redis server - sufficient for the commands used by the RedisStore
+//------------------------------------------------------------------------------
+
+func startFakeRedis(t *testing.T, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mutex sync.Mutex
+	data := map[string]string{}
+	expiry := map[string]time.Time{}
+	versions := map[string]int{}
+
+	// execute applies the command, returning its reply
+	execute := func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "SELECT":
+			return "+OK\r\n"
+		case "SET":
+			data[args[1]] = args[2]
+			versions[args[1]]++
+			delete(expiry, args[1])
+			if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+				ms, _ := strconv.Atoi(args[4])
+				expiry[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			return "+OK\r\n"
+		case "GET":
+			value, ok := data[args[1]]
+			if exp, hasExp := expiry[args[1]]; hasExp && time.Now().After(exp) {
+				ok = false
+			}
+			if ok {
+				return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			}
+			return "$-1\r\n"
+		case "SCAN":
+			// A single batch of the keys that match the pattern
+			keys := []string{}
+			for key := range data {
+				if exp, hasExp := expiry[key]; hasExp && time.Now().After(exp) {
+					continue
+				}
+				if matched, _ := path.Match(args[3], key); matched {
+					keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(key), key))
+				}
+			}
+			return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+		case "DEL":
+			_, ok := data[args[1]]
+			delete(data, args[1])
+			versions[args[1]]++
+			if ok {
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		default:
+			return "-ERR unknown command\r\n"
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				authenticated := len(password) == 0
+				// Transaction state of the connection
+				var watched map[string]int
+				var queued [][]string
+				inMulti := false
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(args[0])
+					if !authenticated && cmd != "AUTH" {
+						io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+						continue
+					}
+					mutex.Lock()
+					switch {
+					case cmd == "AUTH":
+						if args[1] == password {
+							authenticated = true
+							io.WriteString(conn, "+OK\r\n")
+						} else {
+							io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+						}
+					case cmd == "WATCH":
+						if watched == nil {
+							watched = map[string]int{}
+						}
+						watched[args[1]] = versions[args[1]]
+						io.WriteString(conn, "+OK\r\n")
+					case cmd == "UNWATCH":
+						watched = nil
+						io.WriteString(conn, "+OK\r\n")
+					case cmd == "MULTI":
+						inMulti, queued = true, nil
+						io.WriteString(conn, "+OK\r\n")
+					case cmd == "EXEC":
+						aborted := false
+						for key, version := range watched {
+							aborted = aborted || versions[key] != version
+						}
+						if aborted {
+							io.WriteString(conn, "*-1\r\n")
+						} else {
+							fmt.Fprintf(conn, "*%d\r\n", len(queued))
+							for _, command := range queued {
+								io.WriteString(conn, execute(command))
+							}
+						}
+						inMulti, queued, watched = false, nil, nil
+					case inMulti:
+						queued = append(queued, args)
+						io.WriteString(conn, "+QUEUED\r\n")
+					default:
+						io.WriteString(conn, execute(args))
+					}
+					mutex.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func readCommand(reader *bufio.Reader) (args []string, err error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return
+	}
+	for i := 0; i < count; i++ {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return
+		}
+		length, _ := strconv.Atoi(strings.TrimSpace(line)[1:])
+		buf := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			return
+		}
+		args = append(args, string(buf[:length]))
+	}
+	return
+}
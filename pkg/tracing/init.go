@@ -0,0 +1,27 @@
+package tracing
+
+import (
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	configChangeHandler()
+	config.AddConfigChangeHandler(configChangeHandler)
+}
+
+func configChangeHandler() {
+	options := Options{
+		Exporter:     config.GetTracingExporter(),
+		ServiceName:  config.GetTracingServiceName(),
+		SampleRatio:  config.GetTracingSampleRatio(),
+		OtlpEndpoint: config.GetTracingOtlpEndpoint(),
+		OtlpInsecure: config.IsTracingOtlpInsecure(),
+		FilePath:     config.GetTracingFile(),
+	}
+	if err := Configure(options); err != nil {
+		logrus.Error(err)
+		return
+	}
+	logrus.Infof("Initialised tracing: exporter=%v, sample-ratio=%v", options.Exporter, options.SampleRatio)
+}
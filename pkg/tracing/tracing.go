@@ -0,0 +1,144 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/EOEPCA/uma-user-agent"
+
+// Supported exporters
+const (
+	ExporterNone   = "none"
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// Options configures the export of traces
+type Options struct {
+	Exporter     string
+	ServiceName  string
+	SampleRatio  float64
+	OtlpEndpoint string
+	OtlpInsecure bool
+	FilePath     string
+}
+
+// provider is the current tracer provider, which is replaced on reconfiguration
+var provider = struct {
+	mutex    sync.Mutex
+	provider *sdktrace.TracerProvider
+	file     io.Closer
+	options  Options
+}{}
+
+func init() {
+	// W3C trace context (traceparent) and baggage
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Tracer returns the tracer with which the agent's spans are created
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Configure (re)initialises the tracer provider according to the supplied options.
+// With exporter `none`, spans are still created (for propagation of the trace context)
+// but are not exported.
+func Configure(options Options) (err error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if provider.provider != nil && provider.options == options {
+		return
+	}
+
+	// Exporter
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	switch options.Exporter {
+	case ExporterNone, "":
+	case ExporterOtlp:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(options.OtlpEndpoint)}
+		if options.OtlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		writer := io.Writer(os.Stdout)
+		if len(options.FilePath) > 0 {
+			if file, err = os.OpenFile(options.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				break
+			}
+			writer = file
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(writer))
+	default:
+		err = fmt.Errorf("unknown trace exporter '%v'", options.Exporter)
+	}
+	if err != nil {
+		return fmt.Errorf("could not initialise trace exporter: %w", err)
+	}
+
+	// Provider
+	providerOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(options.ServiceName))),
+	}
+	if exporter != nil {
+		providerOpts = append(providerOpts, sdktrace.WithBatcher(exporter))
+	}
+	newProvider := sdktrace.NewTracerProvider(providerOpts...)
+	otel.SetTracerProvider(newProvider)
+
+	// Flush and release the previous provider
+	shutdownProvider(context.Background())
+	provider.provider, provider.options = newProvider, options
+	if file != nil {
+		provider.file = file
+	}
+	return
+}
+
+// Shutdown flushes any pending spans and releases the exporter
+func Shutdown(ctx context.Context) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	shutdownProvider(ctx)
+}
+
+func shutdownProvider(ctx context.Context) {
+	if provider.provider != nil {
+		provider.provider.Shutdown(ctx)
+		provider.provider = nil
+	}
+	if provider.file != nil {
+		provider.file.Close()
+		provider.file = nil
+	}
+}
+
+// Extract returns a context that carries the trace context (if any) from the headers
+// of the incoming request
+func Extract(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// Inject sets the headers of the outgoing request to propagate the trace context
+// carried by the request's context
+func Inject(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
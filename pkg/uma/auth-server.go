@@ -1,12 +1,22 @@
 package uma
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var AuthorizationServers = NewAuthorizationServerList()
@@ -32,18 +42,99 @@ func (authServer *AuthorizationServer) GetUrl() string {
 // GetTokenEndpoint performs a lookup (HTTP GET) on the Authorization Server via
 // its AS URL, to retrieve the Token Endpoint from the UMA configuration endpoint
 func (authServer *AuthorizationServer) GetTokenEndpoint() (tokenEndpointUrl string, err error) {
+	return authServer.GetTokenEndpointContext(context.Background())
+}
+
+// GetTokenEndpointContext is GetTokenEndpoint with a context, which carries the
+// trace context for the lookup
+func (authServer *AuthorizationServer) GetTokenEndpointContext(ctx context.Context) (tokenEndpointUrl string, err error) {
 	tokenEndpointUrl = ""
 	err = nil
 
 	// If we have it already, then return it
+	metrics.RecordCacheLookup("tokenEndpoint", len(authServer.tokenEndpoint) > 0)
 	if len(authServer.tokenEndpoint) > 0 {
 		tokenEndpointUrl = authServer.tokenEndpoint
 		return
 	}
 
 	// Fetch the UMA configuration from the Auth Server
-	umaConfigUrl := authServer.url + "/.well-known/uma2-configuration"
-	response, err := HttpClient.Get(umaConfigUrl)
+	umaConfig, err := authServer.getUmaConfiguration(ctx)
+	if err != nil {
+		return
+	}
+
+	// Check the Token Endpoint is non-empty
+	if len(umaConfig.TokenEndpoint) == 0 {
+		err = fmt.Errorf("blank Token Endpoint retrieved from %v", authServer.umaConfigUrl())
+		return
+	}
+
+	// Record the retrieved Url and return it
+	authServer.tokenEndpoint = umaConfig.TokenEndpoint
+	tokenEndpointUrl = authServer.tokenEndpoint
+	return
+}
+
+// GetRegistrationEndpoint performs a lookup (HTTP GET) on the Authorization Server via
+// its AS URL, to retrieve the Client Registration Endpoint (RFC 7591) from the UMA
+// configuration endpoint
+func (authServer *AuthorizationServer) GetRegistrationEndpoint(ctx context.Context) (registrationEndpointUrl string, err error) {
+	umaConfig, err := authServer.getUmaConfiguration(ctx)
+	if err != nil {
+		return
+	}
+	if len(umaConfig.RegistrationEndpoint) == 0 {
+		err = fmt.Errorf("no Registration Endpoint retrieved from %v", authServer.umaConfigUrl())
+		return
+	}
+	registrationEndpointUrl = umaConfig.RegistrationEndpoint
+	return
+}
+
+// GetRevocationEndpoint performs a lookup (HTTP GET) on the Authorization Server via
+// its AS URL, to retrieve the Revocation Endpoint (RFC 7009) from the UMA configuration
+// endpoint. A blank URL is returned if the Authorization Server does not advertise one.
+func (authServer *AuthorizationServer) GetRevocationEndpoint(ctx context.Context) (revocationEndpointUrl string, err error) {
+	umaConfig, err := authServer.getUmaConfiguration(ctx)
+	if err != nil {
+		return
+	}
+	revocationEndpointUrl = umaConfig.RevocationEndpoint
+	return
+}
+
+// umaConfiguration holds the endpoints of the UMA configuration of the Authorization Server
+type umaConfiguration struct {
+	TokenEndpoint        string `json:"token_endpoint"`
+	RegistrationEndpoint string `json:"registration_endpoint"`
+	RevocationEndpoint   string `json:"revocation_endpoint"`
+}
+
+func (authServer *AuthorizationServer) umaConfigUrl() string {
+	return authServer.url + "/.well-known/uma2-configuration"
+}
+
+// getUmaConfiguration fetches the UMA configuration from the Authorization Server
+func (authServer *AuthorizationServer) getUmaConfiguration(ctx context.Context) (umaConfig umaConfiguration, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "discovery", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("uma.as_uri", authServer.url)))
+	defer func(start time.Time) {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		metrics.UpstreamDuration.WithLabelValues("discovery").Observe(time.Since(start).Seconds())
+	}(time.Now())
+	umaConfigUrl := authServer.umaConfigUrl()
+	request, err := http.NewRequestWithContext(ctx, "GET", umaConfigUrl, nil)
+	if err != nil {
+		err = fmt.Errorf("could not prepare request for UMA service details from %v: %w", umaConfigUrl, err)
+		return
+	}
+	tracing.Inject(request)
+	logging.Inject(request)
+	response, err := GetHttpClient().Do(request)
 	if err != nil {
 		err = fmt.Errorf("could not retieve UMA service details from %v: %w", umaConfigUrl, err)
 		return
@@ -59,24 +150,11 @@ func (authServer *AuthorizationServer) GetTokenEndpoint() (tokenEndpointUrl stri
 	}
 
 	// Interpret as json response
-	bodyJson := struct {
-		TokenEndpoint string `json:"token_endpoint"`
-	}{}
-	err = json.Unmarshal(bodyBytes, &bodyJson)
+	err = json.Unmarshal(bodyBytes, &umaConfig)
 	if err != nil {
 		err = fmt.Errorf("could not interpret json response from %v: %w", umaConfigUrl, err)
 		return
 	}
-
-	// Check the Token Endpoint is non-empty
-	if len(bodyJson.TokenEndpoint) == 0 {
-		err = fmt.Errorf("blank Token Endpoint retrieved from %v", umaConfigUrl)
-		return
-	}
-
-	// Record the retrieved Url and return it
-	authServer.tokenEndpoint = bodyJson.TokenEndpoint
-	tokenEndpointUrl = authServer.tokenEndpoint
 	return
 }
 
@@ -94,6 +172,25 @@ func NewAuthorizationServerList() *AuthorizationServerList {
 	return &AuthorizationServerList{authServers: make(map[string]AuthorizationServer)}
 }
 
+// Len returns the number of Authorization Servers in the list
+func (asl *AuthorizationServerList) Len() int {
+	asl.rwMutex.RLock()
+	defer asl.rwMutex.RUnlock()
+	return len(asl.authServers)
+}
+
+// Urls returns the (sorted) URLs of the Authorization Servers in the list
+func (asl *AuthorizationServerList) Urls() (urls []string) {
+	asl.rwMutex.RLock()
+	defer asl.rwMutex.RUnlock()
+	urls = make([]string, 0, len(asl.authServers))
+	for _, authServer := range asl.authServers {
+		urls = append(urls, authServer.url)
+	}
+	sort.Strings(urls)
+	return
+}
+
 // Delete deletes the value for a key
 func (asl *AuthorizationServerList) Delete(key string) {
 	asl.rwMutex.Lock()
@@ -2,56 +2,228 @@ package uma
 
 import (
 	"crypto/tls"
+	"fmt"
+	"io"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/EOEPCA/uma-user-agent/pkg/breaker"
+	"github.com/EOEPCA/uma-user-agent/pkg/bulkhead"
 	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/logging"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/retry"
+	"github.com/EOEPCA/uma-user-agent/pkg/tracing"
 	"github.com/sirupsen/logrus"
 )
 
-var HttpClient *http.Client
+// httpClient is the client for all upstream requests, which is replaced on change of its
+// configuration
+var httpClient atomic.Pointer[http.Client]
 
+// GetHttpClient returns the client for upstream requests
+func GetHttpClient() *http.Client {
+	return httpClient.Load()
+}
+
+// Breakers holds the circuit breaker of each upstream endpoint
+var Breakers = breaker.NewRegistry(breaker.Settings{}, func(name string, from breaker.State, to breaker.State) {
+	logrus.Warnf("Circuit breaker for %v changed state: %v -> %v", name, from, to)
+	metrics.CircuitBreakerState.WithLabelValues(name).Set(float64(to))
+})
+
+// Bulkheads holds the concurrency bound of each upstream endpoint
+var Bulkheads = bulkhead.NewRegistry(bulkhead.Settings{}, func(name string, inFlight int, waiting int, shedReason string) {
+	metrics.UpstreamInFlight.WithLabelValues(name).Set(float64(inFlight))
+	metrics.UpstreamQueueDepth.WithLabelValues(name).Set(float64(waiting))
+	if len(shedReason) > 0 {
+		metrics.UpstreamShed.WithLabelValues(name, shedReason).Inc()
+	}
+})
+
+// initHttpClient (re)creates the http client, if its configuration has changed. The client
+// has its own transport (connection pool), cloned from the default.
 func initHttpClient() {
-	if config.AllowInsecureTlsSkipVerify() {
-		transport := http.DefaultTransport.(*http.Transport)
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		HttpClient = &http.Client{Transport: transport}
-	} else {
-		HttpClient = &http.Client{}
+	timeout, insecure := config.GetHttpTimeout(), config.AllowInsecureTlsSkipVerify()
+	previous := httpClient.Load()
+	if previous != nil && previous.Timeout == timeout &&
+		previous.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify == insecure {
+		return
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecure}
+	httpClient.Store(&http.Client{Transport: transport, Timeout: timeout})
+	if previous != nil {
+		previous.CloseIdleConnections()
+	}
+	logrus.Infof("Initialised Http Client: timeout=%v, insecure-tls=%v", timeout, insecure)
 }
 
 func configChangeHandler() {
 	initHttpClient()
-	HttpClient.Timeout = time.Second * config.GetHttpTimeout()
-	logrus.Infof("Initialised Http Client: timeout=%v, insecure-tls=%v", HttpClient.Timeout, config.AllowInsecureTlsSkipVerify())
+	Breakers.Configure(breaker.Settings{
+		FailureThreshold:    config.GetCircuitBreakerFailureThreshold(),
+		OpenTimeout:         config.GetCircuitBreakerOpenTimeout(),
+		HalfOpenMaxRequests: config.GetCircuitBreakerHalfOpenMaxRequests(),
+	})
+	Bulkheads.Configure(bulkhead.Settings{
+		MaxInFlight:  config.GetLoadSheddingMaxInFlight(),
+		MaxQueue:     config.GetLoadSheddingMaxQueue(),
+		QueueTimeout: config.GetLoadSheddingQueueTimeout(),
+	})
+}
+
+// upstreamName identifies the upstream endpoint of the request, for its circuit breaker
+func upstreamName(req *http.Request) string {
+	return fmt.Sprintf("%s://%s%s", req.URL.Scheme, req.URL.Host, req.URL.Path)
+}
+
+// retryPolicyDefaults are the built-in idempotency rules of the upstream operations, whose
+// POST requests can safely be repeated - keyed by (lower-case) operation name
+var retryPolicyDefaults = map[string]bool{
+	"exchangeticketforrpt": true, // a replayed ticket is rejected by the AS, without side-effect
+	"revoketoken":          true, // revocation is idempotent (RFC 7009)
+}
+
+// getRetryPolicy returns the retry policy for the upstream operation, from the global retry
+// settings with any overrides for the operation - taken from the config snapshot
+func getRetryPolicy(cfg *config.Config, operation string) retry.Policy {
+	policy := retry.Policy{
+		MaxRetries:         cfg.RetriesHttpRequest,
+		InitialBackoff:     cfg.RetriesBackoffInitial,
+		MaxBackoff:         cfg.RetriesBackoffMax,
+		Multiplier:         cfg.RetriesBackoffMultiplier,
+		Jitter:             cfg.RetriesBackoffJitter,
+		Budget:             cfg.RetriesBudget,
+		RetryableStatuses:  cfg.RetriesRetryableStatuses,
+		RetryNonIdempotent: retryPolicyDefaults[strings.ToLower(operation)],
+	}
+	if upstream, ok := cfg.RetriesUpstreams[strings.ToLower(operation)]; ok {
+		if upstream.MaxRetries != nil {
+			policy.MaxRetries = *upstream.MaxRetries
+		}
+		if upstream.RetryableStatuses != nil {
+			policy.RetryableStatuses = upstream.RetryableStatuses
+		}
+		if upstream.RetryNonIdempotent != nil {
+			policy.RetryNonIdempotent = *upstream.RetryNonIdempotent
+		}
+	}
+	return policy
 }
 
 // MakeResilentRequest makes the provided http request with additional logic to perform
-// a configurable number of retries.
+// retries according to the retry policy of the upstream operation (reason).
 // Conditions that will cause us to retry...
-// * the response code is 5xx
-// * there is an error due to http timeout
+// * the response code is retryable (by default 429 and 5xx) - respecting any Retry-After
+// * there is an error due to connection failure or http timeout
+// Non-idempotent requests are only retried where permitted by the policy, or where the
+// upstream cannot have processed the request. Retries are delayed by exponential backoff
+// with jitter, and are not started beyond the time budget of the policy or the deadline of
+// the request's context. The request body is replayed for each attempt (via GetBody), and
+// the body of a discarded response is closed.
+// The trace context and request ID carried by the request's context are propagated in the
+// request headers, and the retry policy is taken from its config snapshot.
+// The request is subject to the circuit breaker of the upstream endpoint - if open then the
+// request fails fast with an error that wraps breaker.ErrOpen. The request also waits for
+// a slot within the concurrency bound of the upstream - if saturated then the request is
+// shed with an error that wraps bulkhead.ErrShed.
 func MakeResilentRequest(req *http.Request, requestLogger *logrus.Entry, reason string) (response *http.Response, err error) {
-	for attempts := 0; attempts <= config.GetRetriesHttpRequest(); attempts++ {
-		response, err = HttpClient.Do(req)
-		// Check if conditions are met for a retry and, of so, 'continue' to repeat the loop and so make another attempt
+	upstream := upstreamName(req)
+	circuitBreaker := Breakers.Get(upstream)
+	if circuitBreaker.State() == breaker.StateOpen {
+		metrics.CircuitBreakerRejections.WithLabelValues(upstream).Inc()
+		return nil, fmt.Errorf("[%s] request to %v not attempted: %w", reason, upstream, breaker.ErrOpen)
+	}
+	release, err := Bulkheads.Get(upstream).Acquire(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("[%s] request to %v not attempted: %w", reason, upstream, err)
+	}
+	defer release()
+	done, err := circuitBreaker.Allow()
+	if err != nil {
+		metrics.CircuitBreakerRejections.WithLabelValues(upstream).Inc()
+		return nil, fmt.Errorf("[%s] request to %v not attempted: %w", reason, upstream, err)
+	}
+	defer func() {
+		// Expiry or cancellation of the request's context (e.g. the decision deadline, or a
+		// client that has gone away) is not a failure of the upstream
+		switch {
+		case err != nil && req.Context().Err() != nil:
+			done(breaker.OutcomeNeutral)
+		case err != nil || (response != nil && response.StatusCode >= 500):
+			done(breaker.OutcomeFailure)
+		default:
+			done(breaker.OutcomeSuccess)
+		}
+	}()
+
+	tracing.Inject(req)
+	logging.Inject(req)
+	policy := getRetryPolicy(config.FromContext(req.Context()), reason)
+	start := time.Now()
+	for attempts := 0; ; attempts++ {
+		if attempts > 0 {
+			metrics.HttpRetries.WithLabelValues(reason).Inc()
+		}
+		response, err = GetHttpClient().Do(req)
+
+		// Check if conditions are met for a retry
+		retryRequest := false
+		var retryAfter time.Duration
 		if err == nil {
-			// Bad status code
-			if response.StatusCode >= 500 {
-				requestLogger.Warnf("[%s] retrying request due to bad response code: %d", reason, response.StatusCode)
-				continue
+			if policy.ShouldRetryStatus(req.Method, response.StatusCode) {
+				retryRequest = true
+				retryAfter, _ = retry.ParseRetryAfter(response.Header.Get("Retry-After"), time.Now())
 			}
 		} else {
 			response = nil
-			// Error is a timeout
-			if urlErr, ok := err.(*url.Error); ok && urlErr.Timeout() {
-				requestLogger.Warnf("[%s] retrying request due to timeout", reason)
-				continue
+			retryRequest = req.Context().Err() == nil && policy.ShouldRetryError(req.Method, err)
+		}
+		if !retryRequest || attempts >= policy.MaxRetries {
+			break
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			requestLogger.Warnf("[%s] cannot retry request - its body cannot be replayed", reason)
+			break
+		}
+		delay := policy.Delay(attempts+1, retryAfter)
+		if policy.Budget > 0 && time.Since(start)+delay > policy.Budget {
+			requestLogger.Warnf("[%s] not retrying request - retry in %v would exceed the time budget of %v", reason, delay, policy.Budget)
+			break
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			requestLogger.Warnf("[%s] not retrying request - retry in %v would exceed the request deadline", reason, delay)
+			break
+		}
+
+		// Retrying - so log the cause and discard the failed response
+		if response != nil {
+			requestLogger.Warnf("[%s] retrying request in %v due to response code: %d", reason, delay, response.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+			response = nil
+		} else {
+			requestLogger.Warnf("[%s] retrying request in %v due to error: %v", reason, delay, err)
+		}
+
+		// Wait, unless the request is abandoned
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, fmt.Errorf("[%s] request abandoned while waiting to retry: %w", reason, req.Context().Err())
+		}
+
+		// Replay the body
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("[%s] could not replay request body for retry: %w", reason, err)
 			}
 		}
-		break
 	}
 	return
 }
@@ -0,0 +1,100 @@
+package uma_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EOEPCA/uma-user-agent/pkg/breaker"
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/uma"
+)
+
+// stalledServer returns a server whose requests do not complete until abandoned by the
+// client - counting the attempts, if requested
+func stalledServer(t *testing.T, attempts *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts != nil {
+			atomic.AddInt32(attempts, 1)
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestBreakerIgnoresDeadline tests that requests abandoned on expiry of the caller's deadline
+// do not count as failures of the upstream, whereas 5xx responses do
+func TestBreakerIgnoresDeadline(t *testing.T) {
+	server := stalledServer(t, nil)
+	circuitBreaker := uma.Breakers.Get(server.URL + "/")
+
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/", nil)
+		_, err := uma.MakeResilentRequest(req, testLogger, "stalled")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got: %v", err)
+		}
+	}
+	if state := circuitBreaker.State(); state != breaker.StateClosed {
+		t.Fatalf("expected the breaker to remain closed after expired deadlines, got %v", state)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	circuitBreaker = uma.Breakers.Get(failing.URL + "/")
+	for i := 0; i < 10 && circuitBreaker.State() == breaker.StateClosed; i++ {
+		req, _ := http.NewRequest(http.MethodGet, failing.URL+"/", nil)
+		if response, err := uma.MakeResilentRequest(req, testLogger, "failing"); err == nil {
+			response.Body.Close()
+		}
+	}
+	if state := circuitBreaker.State(); state != breaker.StateOpen {
+		t.Errorf("expected the breaker to open on 5xx responses, got %v", state)
+	}
+}
+
+// TestRequestAbandonedOnDeadline tests that expiry or cancellation of the request's context
+// stops the request promptly, without retries - however many the policy allows
+func TestRequestAbandonedOnDeadline(t *testing.T) {
+	if err := config.ParseFlags("test", []string{"--retries.httpRequest=3", "--retries.backoff.initial=1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer config.ParseFlags("test", []string{"--retries.httpRequest=1", "--retries.backoff.initial=100"})
+
+	var attempts int32
+	server := stalledServer(t, &attempts)
+	abandon := func(name string, ctx context.Context, expected error) {
+		t.Helper()
+		atomic.StoreInt32(&attempts, 0)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/", nil)
+		start := time.Now()
+		_, err := uma.MakeResilentRequest(req, testLogger, "stalled")
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%v: request not abandoned promptly, after %v", name, elapsed)
+		}
+		if !errors.Is(err, expected) {
+			t.Errorf("%v: expected %v, got: %v", name, expected, err)
+		}
+		if n := atomic.LoadInt32(&attempts); n != 1 {
+			t.Errorf("%v: expected a single attempt, got %d", name, n)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	abandon("deadline", ctx, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	abandon("cancel", ctx, context.Canceled)
+}
@@ -2,9 +2,13 @@ package uma
 
 import (
 	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
 )
 
 func init() {
 	initHttpClient()
 	config.AddConfigChangeHandler(configChangeHandler)
+	metrics.RegisterGaugeFunc("authorization_servers", "Number of known Authorization Servers.", func() float64 {
+		return float64(AuthorizationServers.Len())
+	})
 }
@@ -0,0 +1,97 @@
+package uma
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ClientMetadata is the metadata of the client to be registered (RFC 7591 section 2)
+type ClientMetadata struct {
+	ClientName              string   `json:"client_name,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	RedirectUris            []string `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+// ClientRegistration is the information of the registered client (RFC 7591 section 3.2.1)
+type ClientRegistration struct {
+	ClientId                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIdIssuedAt        int64  `json:"client_id_issued_at,omitempty"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientUri   string `json:"registration_client_uri,omitempty"`
+}
+
+// IsExpired indicates whether the client secret has expired - zero meaning no expiry
+func (registration *ClientRegistration) IsExpired() bool {
+	return registration.ClientSecretExpiresAt > 0 && time.Now().Unix() >= registration.ClientSecretExpiresAt
+}
+
+// RegisterClient registers the client at the Registration Endpoint of the Authorization
+// Server (RFC 7591) - authorized by the initial access token, if supplied, or else by
+// open registration
+func RegisterClient(ctx context.Context, requestLogger *logrus.Entry, authServer AuthorizationServer, initialAccessToken string, metadata ClientMetadata) (registration ClientRegistration, err error) {
+	// Get the registration endpoint
+	registrationEndpoint, err := authServer.GetRegistrationEndpoint(ctx)
+	if err != nil {
+		err = fmt.Errorf("error getting registration endpoint for Authorization Server %v: %w", authServer.url, err)
+		return
+	}
+
+	// Prepare the request
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		err = fmt.Errorf("could not prepare client metadata: %w", err)
+		return
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", registrationEndpoint, bytes.NewReader(data))
+	if err != nil {
+		err = fmt.Errorf("error preparing request to Registration Endpoint %v: %w", registrationEndpoint, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	if len(initialAccessToken) > 0 {
+		request.Header.Set("Authorization", "Bearer "+initialAccessToken)
+	}
+
+	// Make the request
+	requestLogger.Debug("Registering client at registration endpoint: ", registrationEndpoint)
+	response, err := MakeResilentRequest(request, requestLogger, "RegisterClient")
+	if err != nil {
+		err = fmt.Errorf("error making request to Registration Endpoint %v: %w", registrationEndpoint, err)
+		return
+	}
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		err = EndpointError(response, "Registration Endpoint", registrationEndpoint)
+		return
+	}
+
+	// Read the response body
+	body := response.Body
+	defer body.Close()
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		err = fmt.Errorf("could not read response data from Registration Endpoint %v: %w", registrationEndpoint, err)
+		return
+	}
+	err = json.Unmarshal(bodyBytes, &registration)
+	if err != nil {
+		err = fmt.Errorf("could not interpret json response from Registration Endpoint %v: %w", registrationEndpoint, err)
+		return
+	}
+	if len(registration.ClientId) == 0 || len(registration.ClientSecret) == 0 {
+		err = fmt.Errorf("no client credentials in response from Registration Endpoint %v", registrationEndpoint)
+	}
+	return
+}
@@ -1,14 +1,23 @@
 package uma
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/EOEPCA/uma-user-agent/pkg/config"
+	"github.com/EOEPCA/uma-user-agent/pkg/metrics"
+	"github.com/EOEPCA/uma-user-agent/pkg/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //------------------------------------------------------------------------------
@@ -51,13 +60,39 @@ func UnpackWwwAuthenticateHeader(wwwAuthenticate string) (authServerUrl string,
 type UmaClient struct {
 	Id     string
 	Secret string
+	// PreviousSecret is the secret being rotated-out, if any - used only if the Secret is
+	// rejected by the Authorization Server
+	PreviousSecret string
+	// AuthMethod is the method of client authentication at the Token Endpoint - by default
+	// client_secret_post
+	AuthMethod string
 }
 
 // ExchangeTicketForRpt exchanges the ticket for an RPT at the Authorization Server
 func (umaClient *UmaClient) ExchangeTicketForRpt(requestLogger *logrus.Entry, authServer AuthorizationServer, userIdToken string, ticket string) (rpt string, forbidden bool, err error) {
+	rpt, _, forbidden, err = umaClient.ExchangeTicketForRptWithPct(context.Background(), requestLogger, authServer, userIdToken, ticket, "")
+	return
+}
+
+// ExchangeTicketForRptWithPct exchanges the ticket for an RPT at the Authorization Server,
+// presenting the Persisted Claims Token (PCT) from a previous exchange if there is one.
+// The PCT (if any) issued by the Authorization Server is returned with the RPT.
+// The context carries the trace context for the exchange.
+func (umaClient *UmaClient) ExchangeTicketForRptWithPct(ctx context.Context, requestLogger *logrus.Entry, authServer AuthorizationServer, userIdToken string, ticket string, pct string) (rpt string, newPct string, forbidden bool, err error) {
 	rpt = ""
+	newPct = ""
 	forbidden = false
 	err = nil
+	ctx, span := tracing.Tracer().Start(ctx, "ExchangeTicketForRpt", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("uma.as_uri", authServer.url)))
+	defer func(start time.Time) {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.SetAttributes(attribute.Bool("uma.forbidden", forbidden))
+		span.End()
+		metrics.UpstreamDuration.WithLabelValues("ExchangeTicketForRpt").Observe(time.Since(start).Seconds())
+	}(time.Now())
 
 	// Check we have a User ID Token
 	if len(userIdToken) == 0 {
@@ -67,7 +102,7 @@ func (umaClient *UmaClient) ExchangeTicketForRpt(requestLogger *logrus.Entry, au
 	}
 
 	// Get the token endpoint
-	tokenEndpoint, err := authServer.GetTokenEndpoint()
+	tokenEndpoint, err := authServer.GetTokenEndpointContext(ctx)
 	if err != nil {
 		msg := "error getting token endpoint for Authorization Server: " + authServer.url
 		err = fmt.Errorf("%s: %w", msg, err)
@@ -76,16 +111,31 @@ func (umaClient *UmaClient) ExchangeTicketForRpt(requestLogger *logrus.Entry, au
 	}
 	requestLogger.Debug("Sucessfully retrieved URL for Token Endpoint: ", tokenEndpoint)
 
+	// Request the RPT - falling back to the previous client secret during rotation
+	err = WithClientSecrets(requestLogger, umaClient.Secret, umaClient.PreviousSecret, func(secret string) (err error) {
+		rpt, newPct, forbidden, err = umaClient.requestRpt(ctx, requestLogger, tokenEndpoint, secret, userIdToken, ticket, pct)
+		return
+	})
+	return rpt, newPct, forbidden, err
+}
+
+// requestRpt requests the RPT from the Token Endpoint, authenticating with the client secret
+func (umaClient *UmaClient) requestRpt(ctx context.Context, requestLogger *logrus.Entry, tokenEndpoint string, secret string, userIdToken string, ticket string, pct string) (rpt string, newPct string, forbidden bool, err error) {
 	// Prepare the request
 	data := url.Values{}
 	data.Set("claim_token_format", "http://openid.net/specs/openid-connect-core-1_0.html#IDToken")
 	data.Set("claim_token", userIdToken)
 	data.Set("ticket", ticket)
 	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:uma-ticket")
-	data.Set("client_id", umaClient.Id)
-	data.Set("client_secret", umaClient.Secret)
+	if umaClient.AuthMethod != config.AuthMethodClientSecretBasic {
+		data.Set("client_id", umaClient.Id)
+		data.Set("client_secret", secret)
+	}
 	data.Set("scope", "openid")
-	request, err := http.NewRequest("POST", tokenEndpoint, strings.NewReader(data.Encode()))
+	if len(pct) > 0 {
+		data.Set("pct", pct)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", tokenEndpoint, strings.NewReader(data.Encode()))
 	if err != nil {
 		msg := "error preparing request to Token Endpoint: " + tokenEndpoint
 		err = fmt.Errorf("%s: %w", msg, err)
@@ -94,6 +144,10 @@ func (umaClient *UmaClient) ExchangeTicketForRpt(requestLogger *logrus.Entry, au
 	}
 	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	request.Header.Set("Cache-Control", "no-cache")
+	if umaClient.AuthMethod == config.AuthMethodClientSecretBasic {
+		// The credentials are form-encoded (RFC 6749 section 2.3.1)
+		request.SetBasicAuth(url.QueryEscape(umaClient.Id), url.QueryEscape(secret))
+	}
 
 	// Make the request
 	requestLogger.Debug("Requesting RPT from token endpoint: ", tokenEndpoint)
@@ -105,16 +159,16 @@ func (umaClient *UmaClient) ExchangeTicketForRpt(requestLogger *logrus.Entry, au
 		return
 	}
 	if response.StatusCode != http.StatusOK {
-		var msg string
 		if response.StatusCode == http.StatusForbidden {
+			response.Body.Close()
 			forbidden = true
-			msg = fmt.Sprintf("access request is FORBIDDEN (403) by Token Endpoint: %v", tokenEndpoint)
+			msg := fmt.Sprintf("access request is FORBIDDEN (403) by Token Endpoint: %v", tokenEndpoint)
 			requestLogger.Warn(msg)
+			err = fmt.Errorf(msg)
 		} else {
-			msg = fmt.Sprintf("unexpected response code '%v' from Token Endpoint: %v", response.StatusCode, tokenEndpoint)
-			requestLogger.Error(msg)
+			err = EndpointError(response, "Token Endpoint", tokenEndpoint)
+			requestLogger.Error(err)
 		}
-		err = fmt.Errorf(msg)
 		return
 	}
 	requestLogger.Debug("Token endpoint replied with 200 (OK)")
@@ -131,6 +185,7 @@ func (umaClient *UmaClient) ExchangeTicketForRpt(requestLogger *logrus.Entry, au
 	// Get the RPT from the json response
 	bodyJson := struct {
 		AccessToken string `json:"access_token"`
+		Pct         string `json:"pct"`
 	}{}
 	err = json.Unmarshal(bodyBytes, &bodyJson)
 	if err != nil {
@@ -138,9 +193,67 @@ func (umaClient *UmaClient) ExchangeTicketForRpt(requestLogger *logrus.Entry, au
 		return
 	}
 	rpt = bodyJson.AccessToken
+	newPct = bodyJson.Pct
 	requestLogger.Debug("Successfully extracted RPT from token endpoint response")
 
-	return rpt, forbidden, err
+	return rpt, newPct, forbidden, err
+}
+
+// RevokeRpt revokes the RPT at the Revocation Endpoint (RFC 7009) of the Authorization
+// Server that issued it. Authorization Servers that do not advertise a Revocation Endpoint
+// are skipped without error.
+func (umaClient *UmaClient) RevokeRpt(ctx context.Context, requestLogger *logrus.Entry, authServer AuthorizationServer, rpt string) (err error) {
+	revocationEndpoint, err := authServer.GetRevocationEndpoint(ctx)
+	if err != nil {
+		err = fmt.Errorf("error getting revocation endpoint for Authorization Server %v: %w", authServer.url, err)
+		return
+	}
+	if len(revocationEndpoint) == 0 {
+		requestLogger.Debugf("Authorization Server %v does not support token revocation", authServer.url)
+		return
+	}
+
+	// Revoke the RPT - falling back to the previous client secret during rotation
+	return WithClientSecrets(requestLogger, umaClient.Secret, umaClient.PreviousSecret, func(secret string) error {
+		return umaClient.revokeRpt(ctx, requestLogger, revocationEndpoint, secret, rpt)
+	})
+}
+
+// revokeRpt requests the revocation at the Revocation Endpoint, authenticating with the
+// client secret
+func (umaClient *UmaClient) revokeRpt(ctx context.Context, requestLogger *logrus.Entry, revocationEndpoint string, secret string, rpt string) (err error) {
+	// Prepare the request
+	data := url.Values{}
+	data.Set("token", rpt)
+	data.Set("token_type_hint", "access_token")
+	if umaClient.AuthMethod != config.AuthMethodClientSecretBasic {
+		data.Set("client_id", umaClient.Id)
+		data.Set("client_secret", secret)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", revocationEndpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		err = fmt.Errorf("error preparing request to Revocation Endpoint %v: %w", revocationEndpoint, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if umaClient.AuthMethod == config.AuthMethodClientSecretBasic {
+		request.SetBasicAuth(url.QueryEscape(umaClient.Id), url.QueryEscape(secret))
+	}
+
+	// Make the request
+	requestLogger.Debug("Revoking RPT at revocation endpoint: ", revocationEndpoint)
+	response, err := MakeResilentRequest(request, requestLogger, "RevokeToken")
+	if err != nil {
+		err = fmt.Errorf("error making request to Revocation Endpoint %v: %w", revocationEndpoint, err)
+		return
+	}
+	// RFC 7009 - invalid tokens also result in 200 (OK)
+	if response.StatusCode != http.StatusOK {
+		err = EndpointError(response, "Revocation Endpoint", revocationEndpoint)
+		return
+	}
+	response.Body.Close()
+	return
 }
 
 // GetUserIdTokenBasicAuth performs basic auth to obtain an ID token with the supplied credentials
@@ -178,7 +291,7 @@ func (umaClient *UmaClient) GetUserIdTokenBasicAuth(requestLogger *logrus.Entry,
 
 	// Make the request
 	requestLogger.Debug("Requesting User ID Token from token endpoint: ", tokenEndpoint)
-	response, err := HttpClient.Do(request)
+	response, err := GetHttpClient().Do(request)
 	if err != nil {
 		msg := "error making request to Token Endpoint: " + tokenEndpoint
 		requestLogger.Error(msg, ": ", err)
@@ -216,3 +329,44 @@ func (umaClient *UmaClient) GetUserIdTokenBasicAuth(requestLogger *logrus.Entry,
 }
 
 //------------------------------------------------------------------------------
+
+// ErrInvalidClient indicates that the Authorization Server rejected the client credentials
+var ErrInvalidClient = errors.New("invalid_client")
+
+// EndpointError returns the error for the unsuccessful response of the named endpoint,
+// including the OAuth error code of the response body (RFC 6749 section 5.2) if present.
+// The response body is closed.
+func EndpointError(response *http.Response, endpointName string, endpoint string) error {
+	bodyJson := struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	bodyBytes, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+	response.Body.Close()
+	json.Unmarshal(bodyBytes, &bodyJson)
+	if bodyJson.Error == ErrInvalidClient.Error() {
+		return fmt.Errorf("%w: client authentication failed (%v) at %v: %v", ErrInvalidClient, response.StatusCode, endpointName, endpoint)
+	}
+	if len(bodyJson.Error) > 0 {
+		return fmt.Errorf("unexpected response code '%v' (%v) from %v: %v", response.StatusCode, bodyJson.Error, endpointName, endpoint)
+	}
+	return fmt.Errorf("unexpected response code '%v' from %v: %v", response.StatusCode, endpointName, endpoint)
+}
+
+// WithClientSecrets makes the request with the client secret - and, if the client is
+// rejected (invalid_client) during rotation, again with the previous secret.
+// Acceptance of the client secret completes its rotation.
+func WithClientSecrets(requestLogger *logrus.Entry, secret string, previousSecret string, request func(secret string) error) (err error) {
+	err = request(secret)
+	if err == nil {
+		config.ClientSecretAccepted(secret)
+		return
+	}
+	if errors.Is(err, ErrInvalidClient) && len(previousSecret) > 0 && previousSecret != secret {
+		requestLogger.Warn("The client secret was rejected, falling back to the previous client secret")
+		err = request(previousSecret)
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
@@ -0,0 +1,40 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Build details, which are set at build time via...
+//
+//	go build -ldflags "-X github.com/EOEPCA/uma-user-agent/pkg/version.Version=<tag> ..."
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info describes the build of the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build details - falling back to the VCS details recorded by the go
+// toolchain, where not set at build time
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && len(info.Commit) == 0:
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && len(info.BuildDate) == 0:
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}